@@ -0,0 +1,47 @@
+package sp2p
+
+import (
+	"testing"
+
+	"github.com/kooksee/kdb"
+)
+
+// 没有地址的种子节点在New的时候被拒绝
+func TestBootstrapIncompleteSeed(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{})
+	tr, err := sn.Listen(testAddr(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	c := NewConfig()
+	c.InitDb(kdb.GetKdb())
+	c.Namespace = "incomplete-seed/"
+	c.Transport = tr
+	c.Seeds = []string{"sp2p://" + Hash{1}.Hex()}
+	if p, err := New(c); err == nil {
+		p.Close()
+		t.Fatal("incomplete seed accepted")
+	}
+}
+
+func TestBootstrapSeeds(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Seed: 1})
+
+	// 没有种子也没有恢复出来的节点,引导什么也不做
+	a := newTestNode(t, sn, testAddr(1))
+	waitBootstrap(t, a)
+	if st := a.GetBootstrapStatus(); st.Err != errNoSeeds.Error() || st.Seeds != 0 || st.TableSize != 0 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	b := newTestNode(t, sn, testAddr(2), func(c *Config) { c.Seeds = []string{a.tab.selfNode.string()} })
+	waitBootstrap(t, b)
+	if st := b.GetBootstrapStatus(); st.Err != "" || st.Seeds != 1 || st.SeedsLive != 1 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	if !hasNode(b, a.tab.selfNode.ID) {
+		t.Fatal("seed is not in the table")
+	}
+}
@@ -1,110 +1,288 @@
 package sp2p
 
 import (
+	"sync"
 	"time"
 
 	"github.com/emirpasic/gods/lists/arraylist"
 	"github.com/kooksee/kdb"
-	"encoding/hex"
-	"errors"
 )
 
 var bucketPrefix = []byte("bkt")
 
 type bucket struct {
+	sync.Mutex
+
+	cfg   *Config
 	peers *arraylist.List
 	h     *kdb.KHash
+
+	// 桶满了以后新发现的节点先放到替换缓存中,最新的在最后面
+	replacements []*node
+	// 是否正在对最久没有活动的节点做存活检查
+	checking bool
 }
 
-func newBuckets() *bucket {
+func newBuckets(c *Config) *bucket {
 	return &bucket{
+		cfg:   c,
 		peers: arraylist.New(),
-		h:     getDb().KHash(bucketPrefix),
+		h:     c.db.KHash(c.dbPrefix(bucketPrefix)),
 	}
 }
 
-func (b *bucket) updateNodes(nodes ... *node) {
+func (b *bucket) updateNodes(nodes ... *node) *node {
 	for _, n := range nodes {
 		n.updateAt = time.Now()
-		b.addNodes(n)
 	}
+	return b.addNodes(nodes...)
 }
 
-// addNode add node to bucket, if bucket is full, will remove an old one
-func (b *bucket) addNodes(nodes ... *node) {
+// addNodes 添加节点,已经存在的节点会被更新
+// 桶满了的时候不会直接淘汰旧节点,新节点放到替换缓存中,
+// 并返回最久没有活动的节点,调用者需要ping它来决定是否淘汰
+func (b *bucket) addNodes(nodes ... *node) *node {
+	b.Lock()
+	defer b.Unlock()
 
-	logger := getLog()
+	logger := b.cfg.l
 
-	// 把最活跃的放到最前面,然后移除最不活跃的
 	if err := b.h.WithTx(func(k *kdb.KHBatch) error {
-		for _, node := range nodes {
-			logger.Info("add node", "node", node.string())
-			b.peers.Add(node)
-			if err := k.Set(nodesBackupKey(node.ID.Bytes()), []byte(node.string())); err != nil {
-				logger.Error("add peer error", "err", err)
+		for _, n := range nodes {
+			if i := b.indexOf(n.ID); i != -1 {
+				// 保留节点的往返时间
+				if old, _ := b.peers.Get(i); n.rtt == 0 {
+					n.rtt = old.(*node).rtt
+				}
+				b.peers.Set(i, n)
+				b.save(k, n)
 				continue
 			}
-		}
-
-		b.peers.Sort(func(a, b interface{}) int { return int(b.(*node).updateAt.Sub(a.(*node).updateAt)) })
-		size := b.peers.Size()
-		if size < cfg.BucketSize {
-			return errors.New("")
-		}
 
-		for i := cfg.BucketSize; i < size; i++ {
-			val, e := b.peers.Get(i)
-			if !e {
-				continue
-			}
-			b.peers.Remove(i)
-			if err := k.MDel(nodesBackupKey(val.(*node).ID.Bytes())); err != nil {
-				logger.Error("delete peer error", "err", err)
+			if b.peers.Size() < b.cfg.BucketSize {
+				logger.Info("add node", "node", n.string())
+				b.peers.Add(n)
+				b.save(k, n)
 				continue
 			}
+
+			b.addReplacement(n)
 		}
 		return nil
 	}); err != nil {
 		logger.Error("addNodes error", "err", err.Error())
 	}
+
+	// 把最活跃的放到最前面
+	b.sort()
+
+	if b.checking || len(b.replacements) == 0 || b.peers.Size() < b.cfg.BucketSize {
+		return nil
+	}
+
+	b.checking = true
+	val, _ := b.peers.Get(b.peers.Size() - 1)
+	return val.(*node)
+}
+
+func (b *bucket) addReplacement(n *node) {
+	for i, r := range b.replacements {
+		if r.ID == n.ID {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			break
+		}
+	}
+
+	b.replacements = append(b.replacements, n)
+	if len(b.replacements) > b.cfg.ReplacementSize {
+		b.replacements = b.replacements[len(b.replacements)-b.cfg.ReplacementSize:]
+	}
+}
+
+// checked 存活检查结束,节点还活着就保留,否则用替换缓存中的节点替换掉它
+func (b *bucket) checked(id Hash, rtt time.Duration, err error) {
+	b.Lock()
+	b.checking = false
+	b.Unlock()
+
+	if err == nil {
+		b.pingSuccess(id, rtt)
+	} else {
+		b.replace(id)
+	}
+}
+
+// pingSuccess 节点回复了ping,更新活跃时间和往返时间并清空失败次数
+func (b *bucket) pingSuccess(id Hash, rtt time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	i := b.indexOf(id)
+	if i == -1 {
+		return
+	}
+
+	val, _ := b.peers.Get(i)
+	n := val.(*node)
+	n.updateAt = time.Now()
+	n.fails = 0
+	if rtt > 0 {
+		n.rtt = rtt
+	}
+	b.sort()
+	b.persist(n)
+}
+
+// pingFail 节点没有回复ping,连续失败MaxPingFails次以后用替换缓存中的节点替换掉它
+func (b *bucket) pingFail(id Hash) {
+	b.Lock()
+	i := b.indexOf(id)
+	if i == -1 {
+		b.Unlock()
+		return
+	}
+	val, _ := b.peers.Get(i)
+	n := val.(*node)
+	n.fails++
+	fails := n.fails
+	b.persist(n)
+	b.Unlock()
+
+	if fails >= b.cfg.MaxPingFails {
+		b.cfg.l.Info("node ping failed too many times", "node", n.string(), "fails", fails)
+		b.replace(id)
+	}
+}
+
+// replace 删除节点,并从替换缓存中拿最新的节点补充进来
+func (b *bucket) replace(id Hash) {
+	b.Lock()
+	defer b.Unlock()
+
+	if err := b.h.WithTx(func(k *kdb.KHBatch) error {
+		i := b.indexOf(id)
+		if i == -1 {
+			return nil
+		}
+		b.peers.Remove(i)
+		b.del(k, id)
+
+		if len(b.replacements) == 0 {
+			return nil
+		}
+		n := b.replacements[len(b.replacements)-1]
+		b.replacements = b.replacements[:len(b.replacements)-1]
+		b.cfg.l.Info("replace node", "id", id.Hex(), "node", n.string())
+		b.peers.Add(n)
+		b.save(k, n)
+		return nil
+	}); err != nil {
+		b.cfg.l.Error("replace node error", "err", err)
+	}
+
+	b.sort()
+}
+
+func (b *bucket) save(k *kdb.KHBatch, n *node) {
+	if err := k.Set(b.cfg.nodesBackupKey(n.ID.Bytes()), n.record()); err != nil {
+		b.cfg.l.Error("add peer error", "err", err)
+	}
+}
+
+// persist 把节点的最新状态写到kdb
+func (b *bucket) persist(n *node) {
+	if err := b.h.WithTx(func(k *kdb.KHBatch) error {
+		b.save(k, n)
+		return nil
+	}); err != nil {
+		b.cfg.l.Error("persist peer error", "err", err)
+	}
+}
+
+// flush 把桶中所有节点的最新状态写到kdb
+func (b *bucket) flush() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.peers.Size() == 0 {
+		return
+	}
+
+	if err := b.h.WithTx(func(k *kdb.KHBatch) error {
+		b.peers.Each(func(_ int, value interface{}) {
+			b.save(k, value.(*node))
+		})
+		return nil
+	}); err != nil {
+		b.cfg.l.Error("flush peers error", "err", err)
+	}
+}
+
+func (b *bucket) del(k *kdb.KHBatch, id Hash) {
+	if err := k.MDel(b.cfg.nodesBackupKey(id.Bytes())); err != nil {
+		b.cfg.l.Error("delete peer error", "err", err)
+	}
+}
+
+func (b *bucket) sort() {
+	b.peers.Sort(func(a, b interface{}) int { return int(b.(*node).updateAt.Sub(a.(*node).updateAt)) })
 }
 
-// findNode check if the bucket already have this node, if so, return its index, otherwise, return -1
-func (b *bucket) findNode(node *node) int {
-	return b.peers.IndexOf(node)
+// indexOf check if the bucket already have this node, if so, return its index, otherwise, return -1
+func (b *bucket) indexOf(id Hash) int {
+	for i, val := range b.peers.Values() {
+		if val.(*node).ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// nodes returns a copy of the node list
+func (b *bucket) nodes() []*node {
+	b.Lock()
+	defer b.Unlock()
+
+	nodes := make([]*node, 0, b.peers.Size())
+	b.peers.Each(func(_ int, value interface{}) {
+		nodes = append(nodes, value.(*node))
+	})
+	return nodes
 }
 
 func (b *bucket) random() *node {
-	if b.size() == 0 {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.peers.Size() == 0 {
 		return nil
 	}
 
-	val, _ := b.peers.Get(int(rand32(uint32(b.size()))))
+	val, _ := b.peers.Get(int(rand32(uint32(b.peers.Size()))))
 	return val.(*node)
 }
 
 func (b *bucket) deleteNodes(targets ... Hash) {
+	b.Lock()
+	defer b.Unlock()
+
 	if err := b.h.WithTx(func(k *kdb.KHBatch) error {
-		for _, n := range targets {
-			if a := b.peers.IndexOf(n); a != -1 {
-				val, bl := b.peers.Get(a)
-				if !bl {
-					continue
-				}
-				if err := k.MDel(nodesBackupKey(val.(*node).ID.Bytes())); err != nil {
-					getLog().Error("deleteNodes error", "err", err)
-					continue
-				}
-				getLog().Info("delete node: %s", hex.EncodeToString(n.Bytes()))
-				b.peers.Remove(a)
+		for _, id := range targets {
+			if i := b.indexOf(id); i != -1 {
+				b.peers.Remove(i)
+				b.del(k, id)
+				b.cfg.l.Info("delete node", "id", id.Hex())
 			}
 		}
 		return nil
 	}); err != nil {
-		getLog().Error("update peer", "err", err)
+		b.cfg.l.Error("update peer", "err", err)
 	}
 }
 
 func (b *bucket) size() int {
+	b.Lock()
+	defer b.Unlock()
+
 	return b.peers.Size()
 }
@@ -0,0 +1,448 @@
+package sp2p
+
+import (
+	"crypto/ed25519"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/json-iterator/go"
+	"github.com/satori/go.uuid"
+)
+
+// 协议版本,放在每个数据报的第一个字节,决定后面使用的编码
+const (
+	// CodecJSON 消息体使用json编码,用于调试
+	CodecJSON = byte(0x1)
+	// CodecBinaryV1 没有标志位和协议名称的二进制编码,用于和旧版本的节点通信
+	CodecBinaryV1 = byte(0x2)
+	// CodecBinary 紧凑的二进制编码
+	CodecBinary = byte(0x3)
+)
+
+// 数据报格式: version(1) + type(1) + sig(64) + body
+// 签名覆盖 version + type + body
+const frameHeaderLen = 2 + ed25519.SignatureSize
+
+// 二进制编码中消息的标志位
+const flagReliable = byte(1 << 0)
+
+var (
+	errUnknownVersion = errors.New("kmsg version is unknown")
+	errShortFrame     = errors.New("kmsg is too short")
+	errLegacyCodec    = errors.New("reliable or sub-protocol kmsg can not use CodecBinaryV1")
+)
+
+// newData 解析出协议名称以后创建对应类型的空消息
+type newData func(proto string) (IPacket, error)
+
+type codec interface {
+	encode(msg *KMsg) ([]byte, error)
+	decode(body []byte, msg *KMsg, nd newData) error
+}
+
+var codecs = map[byte]codec{
+	CodecJSON:     jsonCodec{},
+	CodecBinaryV1: binaryCodec{v1: true},
+	CodecBinary:   binaryCodec{},
+}
+
+// Encode 使用ver对应的编码序列化消息,并用私钥签名
+func (t *KMsg) Encode(ver byte, priv ed25519.PrivateKey) ([]byte, error) {
+	c, ok := codecs[ver]
+	if !ok {
+		return nil, errUnknownVersion
+	}
+
+	body, err := c.encode(t)
+	if err != nil {
+		return nil, err
+	}
+
+	dt := t.Data.T()
+	b := make([]byte, frameHeaderLen, frameHeaderLen+len(body))
+	b[0], b[1] = ver, dt
+	b = append(b, body...)
+	copy(b[2:frameHeaderLen], sign(priv, signData(ver, dt, body)))
+	return b, nil
+}
+
+// Decode 解析一个数据报并校验发送者的签名,消息类型在hm或者它挂载的子协议中查找
+func (t *KMsg) Decode(hm *Protocol, msg []byte) error {
+	if len(msg) < frameHeaderLen {
+		return errShortFrame
+	}
+
+	ver, dt := msg[0], msg[1]
+	c, ok := codecs[ver]
+	if !ok {
+		return errUnknownVersion
+	}
+
+	sig := msg[2:frameHeaderLen]
+	if isZero(sig) {
+		return errUnsignedMsg
+	}
+
+	body := msg[frameHeaderLen:]
+	if err := c.decode(body, t, func(proto string) (IPacket, error) {
+		return hm.newPacket(proto, dt)
+	}); err != nil {
+		return err
+	}
+
+	id, err := HexID(t.FID)
+	if err != nil {
+		return errInvalidSig
+	}
+	return verify(id, signData(ver, dt, body), sig)
+}
+
+func signData(ver, dt byte, body []byte) []byte {
+	return append([]byte{ver, dt}, body...)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) encode(msg *KMsg) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) decode(body []byte, msg *KMsg, nd newData) error {
+	// 先解析出协议名称,再解析消息数据
+	type kmsg KMsg
+	aux := struct {
+		*kmsg
+		Data jsoniter.RawMessage `json:"data,omitempty"`
+	}{kmsg: (*kmsg)(msg)}
+	if err := json.Unmarshal(body, &aux); err != nil {
+		return err
+	}
+
+	data, err := nd(msg.Proto)
+	if err != nil {
+		return err
+	}
+	msg.Data = data
+	return json.Unmarshal(aux.Data, data)
+}
+
+// binaryCodec 节点ID使用32字节,消息ID使用16字节的uuid,地址使用压缩的IP和端口,
+// 消息数据实现了encoding.BinaryMarshaler的使用二进制,否则使用json
+// v1是旧的格式,地址后面没有标志位和协议名称
+type binaryCodec struct {
+	v1 bool
+}
+
+func (c binaryCodec) encode(msg *KMsg) ([]byte, error) {
+	w := &wbuf{}
+	w.str(msg.Version)
+	w.msgID(msg.ID)
+	w.msgID(msg.RID)
+	w.nodeID(msg.FID)
+	w.nodeID(msg.TID)
+	w.addr(msg.FAddr)
+	w.addr(msg.TAddr)
+	if c.v1 {
+		if msg.Reliable || msg.Proto != "" {
+			return nil, errLegacyCodec
+		}
+	} else {
+		var flags byte
+		if msg.Reliable {
+			flags |= flagReliable
+		}
+		w.byte(flags)
+		w.str(msg.Proto)
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	data, err := marshalData(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	return append(w.b, data...), nil
+}
+
+func (c binaryCodec) decode(body []byte, msg *KMsg, nd newData) error {
+	r := &rbuf{b: body}
+	msg.Version = r.str()
+	msg.ID = r.msgID()
+	msg.RID = r.msgID()
+	msg.FID = r.nodeID()
+	msg.TID = r.nodeID()
+	msg.FAddr = r.addr()
+	msg.TAddr = r.addr()
+	if !c.v1 {
+		msg.Reliable = r.byte()&flagReliable != 0
+		msg.Proto = r.str()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	data, err := nd(msg.Proto)
+	if err != nil {
+		return err
+	}
+	msg.Data = data
+	return unmarshalData(r.b, msg.Data)
+}
+
+// marshalData 消息数据实现了encoding.BinaryMarshaler的使用二进制,否则使用json
+func marshalData(m IPacket) ([]byte, error) {
+	if b, ok := m.(encoding.BinaryMarshaler); ok {
+		return b.MarshalBinary()
+	}
+	return json.Marshal(m)
+}
+
+func unmarshalData(b []byte, m IPacket) error {
+	if u, ok := m.(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(b)
+	}
+	return json.Unmarshal(b, m)
+}
+
+var errShortBuf = errors.New("binary codec: unexpected end of data")
+
+// wbuf 二进制编码的写缓冲区,出错以后后面的写入都会被忽略
+type wbuf struct {
+	b   []byte
+	err error
+}
+
+func (w *wbuf) byte(v byte) {
+	w.b = append(w.b, v)
+}
+
+func (w *wbuf) uvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	w.b = append(w.b, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+// bytes 长度前缀的字节数组
+func (w *wbuf) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.b = append(w.b, b...)
+}
+
+func (w *wbuf) str(s string) {
+	w.bytes([]byte(s))
+}
+
+func (w *wbuf) hash(h Hash) {
+	w.b = append(w.b, h[:]...)
+}
+
+// nodeID hex编码的节点ID转换成32字节,空ID写全0
+func (w *wbuf) nodeID(s string) {
+	if s == "" {
+		w.hash(EmptyHash)
+		return
+	}
+
+	id, err := HexID(s)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	w.hash(id)
+}
+
+// msgID uuid格式的消息ID写16字节,其它格式的ID写长度前缀的字符串
+func (w *wbuf) msgID(s string) {
+	if u, err := uuid.FromString(s); err == nil {
+		w.byte(1)
+		w.b = append(w.b, u.Bytes()...)
+		return
+	}
+	w.byte(0)
+	w.str(s)
+}
+
+// addr IP地址写成 len(1) + ip + port(2),不是IP的地址写成 0xff + 字符串
+func (w *wbuf) addr(s string) {
+	if s == "" {
+		w.byte(0)
+		return
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	ip := net.ParseIP(host)
+	p, perr := strconv.ParseUint(port, 10, 16)
+	if err != nil || ip == nil || perr != nil {
+		w.byte(0xff)
+		w.str(s)
+		return
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	w.byte(byte(len(ip)))
+	w.b = append(w.b, ip...)
+	w.b = append(w.b, byte(p>>8), byte(p))
+}
+
+// nodes 节点URL列表写成 count + (id(32) + addr)...
+func (w *wbuf) nodes(rawNodes []string) {
+	w.uvarint(uint64(len(rawNodes)))
+	for _, raw := range rawNodes {
+		n, err := NodeParse(raw)
+		if err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+			return
+		}
+		w.hash(n.ID)
+		w.addr(n.addrString())
+	}
+}
+
+// rbuf 二进制编码的读缓冲区,出错以后后面的读取都返回零值
+type rbuf struct {
+	b   []byte
+	err error
+}
+
+func (r *rbuf) raw(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errShortBuf
+		return nil
+	}
+	d := r.b[:n]
+	r.b = r.b[n:]
+	return d
+}
+
+func (r *rbuf) byte() byte {
+	if d := r.raw(1); d != nil {
+		return d[0]
+	}
+	return 0
+}
+
+func (r *rbuf) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errShortBuf
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *rbuf) bytes() []byte {
+	n := r.uvarint()
+	if n > uint64(len(r.b)) {
+		if r.err == nil {
+			r.err = errShortBuf
+		}
+		return nil
+	}
+	// 空值解码成nil,和编码之前没有设置的字段一致
+	if n == 0 {
+		return nil
+	}
+	return r.raw(int(n))
+}
+
+func (r *rbuf) str() string {
+	return string(r.bytes())
+}
+
+func (r *rbuf) hash() Hash {
+	return BytesToHash(r.raw(len(EmptyHash)))
+}
+
+func (r *rbuf) nodeID() string {
+	h := r.hash()
+	if h.IsEmpty() {
+		return ""
+	}
+	return h.Hex()
+}
+
+func (r *rbuf) msgID() string {
+	if r.byte() == 1 {
+		u, err := uuid.FromBytes(r.raw(uuid.Size))
+		if err != nil {
+			if r.err == nil {
+				r.err = err
+			}
+			return ""
+		}
+		return u.String()
+	}
+	return r.str()
+}
+
+func (r *rbuf) addr() string {
+	n := r.byte()
+	switch n {
+	case 0:
+		return ""
+	case 0xff:
+		return r.str()
+	case net.IPv4len, net.IPv6len:
+		ip := net.IP(r.raw(int(n)))
+		p := r.raw(2)
+		if r.err != nil {
+			return ""
+		}
+		return net.JoinHostPort(ip.String(), strconv.Itoa(int(p[0])<<8|int(p[1])))
+	default:
+		if r.err == nil {
+			r.err = errors.New(f("binary codec: invalid ip length %d", n))
+		}
+		return ""
+	}
+}
+
+func (r *rbuf) nodes() []string {
+	count := r.uvarint()
+	// 每个节点至少33个字节,防止伪造的数量导致分配过大的内存
+	if count > uint64(len(r.b)/(len(EmptyHash)+1)) {
+		if r.err == nil {
+			r.err = errShortBuf
+		}
+		return nil
+	}
+
+	nodes := make([]string, 0, count)
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		id := r.hash()
+		addr := r.addr()
+		if r.err != nil {
+			break
+		}
+
+		ua, err := parseUDPAddr(addr)
+		if err != nil {
+			r.err = err
+			break
+		}
+		nodes = append(nodes, newNode(id, ua.IP, uint16(ua.Port)).string())
+	}
+	return nodes
+}
@@ -0,0 +1,161 @@
+package sp2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+)
+
+var (
+	goldenKey  = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x11}, ed25519.SeedSize))
+	goldenFrom = PubkeyID(goldenKey.Public().(ed25519.PublicKey))
+	goldenTo   = BytesToHash(bytes.Repeat([]byte{0x22}, len(EmptyHash)))
+	goldenNode = newNode(goldenTo, net.IPv4(10, 0, 0, 2), 8080).string()
+)
+
+const (
+	goldenID  = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	goldenRID = "6ba7b811-9dad-11d1-80b4-00c04fd430c8"
+)
+
+// goldenMsg 除了消息数据以外固定的消息头
+func goldenMsg(data IPacket) *KMsg {
+	return &KMsg{
+		Version: "1.0.0",
+		ID:      goldenID,
+		RID:     goldenRID,
+		FID:     goldenFrom.Hex(),
+		TID:     goldenTo.Hex(),
+		FAddr:   "10.0.0.1:8080",
+		TAddr:   "10.0.0.2:8080",
+		Data:    data,
+	}
+}
+
+var goldenVectors = []struct {
+	name string
+	ver  byte
+	msg  *KMsg
+	hex  string
+}{
+	{"ping", CodecBinary, goldenMsg(&pingReq{Protos: []string{DiscProtocol}}),
+		"0301ac0ca6767783202491b1f9e60ccbc16c1c0c513d4e9c394d30df7e8e030041e273266d998059513cc595638be2d09ba85f390cabda296329ec7da205fe25aa0805312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f9000000106646973632f31"},
+	{"pong", CodecBinary, goldenMsg(&pongResp{Protos: []string{DiscProtocol, "kv/2"}}),
+		"03041b538def3431e01271017b8c380c88feac1f140c7104bee2934c7758b1fd4dc88279df2fa589cc4282f4ee3e9c8bb09670d9b3fe39b376ef26068b07e8f99f0205312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f9000000206646973632f31046b762f32"},
+	{"find node req", CodecBinary, goldenMsg(&findNodeReq{N: 16, Target: goldenTo.Hex()}),
+		"0302f1fce89b3366c642ec8be40957896c104163cf1a7942b879a2a01b987ce377cd2e4928f8f4de67345aa838617e99e73e51844cbed75a29b69947ff9b510ebb0c05312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f900000102222222222222222222222222222222222222222222222222222222222222222"},
+	{"find node resp", CodecBinary, goldenMsg(&findNodeResp{Nodes: []string{goldenNode}}),
+		"030312756476510a78b5db35f648690836db97bdc1b79f0420d324432c6752bd3e557d58e9f0604a793515c0c65426279e3cd79d5199b72118ddc92d5266d9a7ae0b05312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f900000012222222222222222222222222222222222222222222222222222222222222222040a0000021f90"},
+	{"store req", CodecBinary, goldenMsg(&storeReq{Key: goldenTo.Hex(), Value: []byte("value"), Time: 1700000000000000000}),
+		"0305998c841bd2689b37d457bbd5e59361274e563b874384ae2197b4e8e4903cd83e78d4f5a2ab28706ded37c6b72bfac8410808aa54a5ed5f464e6439d98a59710505312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f90000022222222222222222222222222222222222222222222222222222222222222220576616c75658080a8b1e39fe7cb17"},
+	{"store resp", CodecBinary, goldenMsg(&storeResp{}),
+		"03068ce9fefe4066da9825c57b6b8dca6ca47a417ab65d9bde3fa27ba630fc3197cbb6ad94d3b123f00f92751d34f94772c8a5e76ef9eced8fdbffc1cdcd556c070305312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f900000"},
+	{"find value req", CodecBinary, goldenMsg(&findValueReq{Key: goldenTo.Hex()}),
+		"0307c4ea451269156ecedf154fc4b19e22fadf21f3a88296b459eb6d3671fdf43004fb2d85a5f71c770723789c0bba648dd62983ed352d581184ef1914831685130105312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f9000002222222222222222222222222222222222222222222222222222222222222222"},
+	{"find value resp", CodecBinary, goldenMsg(&findValueResp{Value: []byte("value"), Time: 1700000000000000000, Nodes: []string{goldenNode}}),
+		"0308da329c3d89d2e4747775001b0f051b23a4a85d4e0d1a89e6903e891e4da92e3700fd0cf212044a328e9ef5f2911a55a298b927365f7e7d5cbac05200dbbfc20905312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f9000000576616c75658080a8b1e39fe7cb17012222222222222222222222222222222222222222222222222222222222222222040a0000021f90"},
+	{"ack resp", CodecBinary, goldenMsg(&ackResp{}),
+		"03098abfab05edf3aa87baa32059329ac918c4609a3dc82534bf73b3fa1875ff400784ebe7221db40b90666eb8d32c4bd52d4e297b16eee2a3fee1a27d687373c40b05312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f900000"},
+	{"handshake req", CodecBinary, goldenMsg(&handshakeReq{Eph: bytes.Repeat([]byte{0x33}, 32), Time: 1700000000000000000, Cookie: bytes.Repeat([]byte{0x35}, cookieLen)}),
+		"030aee405c2d5d9cb344f3d57efaa7b9a13f4b0691e55fb372b5625979d4c7dbe76f5a4d40468723ec280ec44be48c2bf4cbaf318d761a0825d93ba1c4a408e9560905312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f9000002033333333333333333333333333333333333333333333333333333333333333338080a8b1e39fe7cb171035353535353535353535353535353535"},
+	{"handshake resp", CodecBinary, goldenMsg(&handshakeResp{Eph: bytes.Repeat([]byte{0x44}, 32)}),
+		"030b8ab641c4128b0928f81335ec728e01baab7c1657c96c71e9148af4046df974bde0744d01f3e74841c9e09190b47dc191f15dbe4e61c24de824000583bf7dcd0305312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f90000020444444444444444444444444444444444444444444444444444444444444444400"},
+	{"gossip req", CodecBinary, goldenMsg(&gossipReq{
+		ID: goldenRID, Origin: goldenFrom.Hex(), OriginAddr: "10.0.0.1:8080", Time: 1700000000000000000, TTL: 5, Hops: 1,
+		Proto: "kv/2", DT: 0x40, Data: []byte("data"), Sig: bytes.Repeat([]byte{0x55}, ed25519.SignatureSize),
+	}),
+		"030c7f19e1c8f39302659621be0b2296ada01e48f1fd081150a20ae5b2df35100a1d9d5c411e2813621bb3dff91b8070babfeb70cfa729ef06c40403a16ca1ecd20505312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f900000016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c9778737040a0000011f908080a8b1e39fe7cb17050100046b762f324004646174614055555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555"},
+	{"gossip ack", CodecBinary, goldenMsg(&gossipAck{ID: goldenRID, Hops: 2}),
+		"030dc5676c5a5c444b3522cb74e412f166e4099034e46a18b84b756f1ec86f78028970de4918fd0702620590b20e7a39bfd59f576a1bfda76c02fdee69a0af1d0d0f05312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f900000016ba7b8119dad11d180b400c04fd430c802"},
+	{"topic req", CodecBinary, goldenMsg(&topicReq{Topic: "news", Op: topicJoin}),
+		"030e71c69f7dba26b3ac87fcd2720ece6867e02a499a2eb681f0025bfaffc7ae982f8ce85c84c0e1e18501adbbfabf739854cb56f94e747540ce8aee609b3063a70705312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f900000046e65777301"},
+	{"topic resp", CodecBinary, goldenMsg(&topicResp{Peers: []string{goldenNode}}),
+		"030f9e2e6be6a2fdfc3c517e4c7a15f033c7b81a40868e36ed506048f2d3360b281fffa7d8ebfedbef8c642c01e28ff357c25f5b361eed3728c9f35d856badb1a90305312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f900000012222222222222222222222222222222222222222222222222222222222222222040a0000021f90"},
+	{"topic msg", CodecBinary, goldenMsg(&topicMsg{
+		ID: goldenRID, Topic: "news", Origin: goldenFrom.Hex(), OriginAddr: "10.0.0.1:8080", Time: 1700000000000000000, TTL: 6,
+		Payload: []byte("payload"), Sig: bytes.Repeat([]byte{0x66}, ed25519.SignatureSize),
+	}),
+		"031078c5ebe44646381c8bd5b160c8c05cc1dab76273826fa608a3aef6a2653b49939e10a07a7dbbd32ab83ff13d845f914051f6af51177fcfecc394ded12c23ef0005312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f900000016ba7b8119dad11d180b400c04fd430c8046e657773d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c9778737040a0000011f908080a8b1e39fe7cb1706077061796c6f61644066666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666666"},
+	{"topic graft", CodecBinary, goldenMsg(&topicGraft{Topic: "news", Prune: true}),
+		"0311504332af5ee1a3c1399fceabbde434a82373b9b43ad6b8d8a17e5f035e998c0661410585f3065373ee192c487718a2d6add7a4a264a6b4de709468766cd3b20805312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f900000046e65777301"},
+	{"route msg", CodecBinary, goldenMsg(&routeMsg{
+		ID: goldenRID, Origin: goldenFrom.Hex(), OriginAddr: "10.0.0.1:8080", Target: goldenTo.Hex(), TTL: 19,
+		Path: []string{goldenNode}, Proto: "kv/2", DT: 0x40, Data: []byte("data"), Sig: bytes.Repeat([]byte{0x77}, ed25519.SignatureSize),
+	}),
+		"0312f384fdbb31b8c3a09fe6d0dba5eb1d00e8dcd96f2b62118607d48638fd8705e843a40170cfd636e5c10f04be975838f9e70b87bec568f3773884fb14838afd0c05312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f900000016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c9778737040a0000011f90222222222222222222222222222222222222222222222222222222222222222213012222222222222222222222222222222222222222222222222222222222222222040a0000021f90000000046b762f324004646174614077777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777777"},
+	// 调试用的json编码,签名的帧头和二进制编码相同,后面是json编码的整个消息
+	{"ping json", CodecJSON, goldenMsg(&pingReq{Protos: []string{DiscProtocol}}),
+		"0101cd3fd254d9d2332776623e693c446b81b02e2d0406d0ebd14a389a130433b52f099557271c07ab2d1a61a4bea5145c48ba5dadf0f50a95f017b0ca36e4df90037b2276657273696f6e223a22312e302e30222c226964223a2236626137623831302d396461642d313164312d383062342d303063303466643433306338222c22746964223a2232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232222c227461646472223a2231302e302e302e323a38303830222c226661646472223a2231302e302e302e313a38303830222c22666964223a2264303461623233323734326262346162336131333638626434363135653465366430323234616237316130313662616638353230613333326339373738373337222c22726964223a2236626137623831312d396461642d313164312d383062342d303063303466643433306338222c2264617461223a7b2270726f746f73223a5b22646973632f31225d7d7d"},
+	{"store req json", CodecJSON, goldenMsg(&storeReq{Key: "key", Value: []byte("value"), Time: 1700000000000000000}),
+		"0105c0b6c2f5c1a0c93822d48c2ee75814b067f1ecac409941f81a631104e4c45fbcf1bd2805543f38f3867aef9e7051b1c555aa1575e606a3eb353bb5a32e62590d7b2276657273696f6e223a22312e302e30222c226964223a2236626137623831302d396461642d313164312d383062342d303063303466643433306338222c22746964223a2232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232323232222c227461646472223a2231302e302e302e323a38303830222c226661646472223a2231302e302e302e313a38303830222c22666964223a2264303461623233323734326262346162336131333638626434363135653465366430323234616237316130313662616638353230613333326339373738373337222c22726964223a2236626137623831312d396461642d313164312d383062342d303063303466643433306338222c2264617461223a7b226b6579223a226b6579222c2276616c7565223a22646d46736457553d222c2274696d65223a313730303030303030303030303030303030307d7d"},
+	// 旧版本的二进制编码没有标志位和协议名称
+	{"ping v1", CodecBinaryV1, goldenMsg(&pingReq{Protos: []string{DiscProtocol}}),
+		"02013cad8751ef3453b706635a10e347b61324acde7cf05063ef4e00d83889c1480bfdc717c09d78d153dbc6377c5ad0ea38a237924422474b06c37dad46b190df0205312e302e30016ba7b8109dad11d180b400c04fd430c8016ba7b8119dad11d180b400c04fd430c8d04ab232742bb4ab3a1368bd4615e4e6d0224ab71a016baf8520a332c97787372222222222222222222222222222222222222222222222222222222222222222040a0000011f90040a0000021f900106646973632f31"},
+}
+
+func TestGoldenVectors(t *testing.T) {
+	for _, v := range goldenVectors {
+		t.Run(v.name, func(t *testing.T) {
+			want, err := hex.DecodeString(v.hex)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := v.msg.Encode(v.ver, goldenKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, want) {
+				t.Fatalf("encode mismatch\ngot  %x\nwant %x", b, want)
+			}
+
+			got := &KMsg{}
+			if err := got.Decode(GetHManager(), want); err != nil {
+				t.Fatal(err)
+			}
+			got.Data, v.msg.Data = v.msg.Data, got.Data
+			if !reflect.DeepEqual(got, v.msg) {
+				t.Fatalf("decode mismatch\ngot  %+v\nwant %+v", got, v.msg)
+			}
+			if !reflect.DeepEqual(got.Data, v.msg.Data) {
+				t.Fatalf("decode data mismatch\ngot  %+v\nwant %+v", v.msg.Data, got.Data)
+			}
+		})
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	frame, err := goldenMsg(&findNodeReq{N: 16, Target: goldenTo.Hex()}).Encode(CodecBinary, goldenKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := append([]byte(nil), frame...)
+	unknown[0] = 0x7f
+	if err := new(KMsg).Decode(GetHManager(), unknown); err != errUnknownVersion {
+		t.Fatalf("unknown version: err = %v, want %v", err, errUnknownVersion)
+	}
+
+	if err := new(KMsg).Decode(GetHManager(), frame[:frameHeaderLen-1]); err != errShortFrame {
+		t.Fatalf("short frame: err = %v, want %v", err, errShortFrame)
+	}
+
+	// 消息头或者消息数据被截断
+	for _, n := range []int{frameHeaderLen + 4, frameHeaderLen + 40, len(frame) - 1} {
+		if err := new(KMsg).Decode(GetHManager(), frame[:n]); err == nil {
+			t.Fatalf("truncated to %d bytes: decode succeeded", n)
+		}
+	}
+
+	// 二进制编码的消息数据被截断
+	body, err := (&findValueResp{Value: []byte("value"), Nodes: []string{goldenNode}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := new(findValueResp).UnmarshalBinary(body[:len(body)-1]); err == nil {
+		t.Fatal("truncated find value resp: decode succeeded")
+	}
+}
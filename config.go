@@ -1,22 +1,37 @@
 package sp2p
 
 import (
-	"time"
-	"github.com/inconshreveable/log15"
+	"crypto/ed25519"
+	"errors"
 	"net"
-	"github.com/kooksee/kdb"
 	"os"
 	"path/filepath"
-	"github.com/patrickmn/go-cache"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kooksee/kdb"
 )
 
 var (
-	cfg *kConfig
+	cfg *Config
 )
 
-type kConfig struct {
-	// 接收数据的最大缓存区
+// Config 一个节点的配置,用NewConfig创建
+type Config struct {
+	// 接收数据的最大缓存区,要大于MTU
 	MaxBufLen int
+	// 单个数据报的最大长度,超过的消息会被分片发送
+	MTU int
+	// 一个消息最多拆分的分片数量
+	MaxFragments int
+	// 分片在这个时间内没有收齐就丢弃
+	FragmentTimeout time.Duration
+	// 每个发送者以及所有发送者缓存分片的最大字节数,包括每个分组的额外开销
+	MaxSenderFragmentBytes int
+	MaxFragmentBytes       int
+	// 每个发送者同时没有收齐的分组的最大数量
+	MaxSenderFragmentGroups int
 
 	// ntp服务器检测超时次数
 	NtpFailureThreshold int
@@ -29,9 +44,14 @@ type kConfig struct {
 	// Allowed clock drift before warning user
 	DriftThreshold time.Duration
 
-	PingTick     *time.Ticker
-	FindNodeTick *time.Ticker
-	NtpTick      *time.Ticker
+	// 定时任务的间隔,节点在New的时候创建自己的定时器,Close的时候停止
+	PingInterval     time.Duration
+	FindNodeInterval time.Duration
+	NtpInterval      time.Duration
+	// 检查路由表大小,少于MinNodeSize的时候重新引导
+	BootstrapInterval time.Duration
+	// 重新向汇合点注册订阅的主题
+	TopicInterval time.Duration
 
 	// Kademlia concurrency factor
 	Alpha int
@@ -39,6 +59,31 @@ type kConfig struct {
 	NodeResponseNumber int
 	// 节点广播的数量
 	NodeBroadcastNumber int
+	// 广播最多转发的跳数
+	BroadcastTTL int
+	// 收到广播的节点是否给发起者回复回执,用来统计覆盖率,验证过发起者地址的节点都会回复,默认关闭
+	BroadcastReceipt bool
+	// 只给验证过地址的发起者回复回执,这里限制给每个发起者回复回执的速率
+	ReceiptRateLimit RateLimit
+	// 路由消息最多转发的跳数
+	MaxRouteHops int
+	// 同时转发的路由消息的最大数量,超过的消息被丢弃
+	MaxRouteForwards int
+	// 发起路由的节点在路由表中找不到更近的节点时会查找一次目标,这里限制查找的速率,转发的节点不查找
+	RouteLookupLimit RateLimit
+	// 汇合点保存订阅者的时间,要大于TopicInterval
+	TopicExpiration time.Duration
+	// 每个主题主动转发的订阅者数量
+	TopicMeshSize int
+	// 订阅channel的缓存大小,满了以后丢弃消息
+	TopicBufferSize int
+	// 汇合点每个主题最多保存的订阅者数量
+	MaxTopicMembers int
+	// 汇合点最多保存的主题数量,以及每个节点最多注册的主题数量
+	MaxTopics        int
+	MaxTopicsPerNode int
+	// 主题名称的最大长度
+	MaxTopicNameLen int
 	// 节点分区存储的数量
 	NodePartitionNumber int
 
@@ -50,32 +95,111 @@ type kConfig struct {
 
 	ConnReadTimeout  time.Duration
 	ConnWriteTimeout time.Duration
+	// 等待请求回复的超时时间
+	RequestTimeout time.Duration
+	// 可靠消息第一次重发前等待确认的时间,之后每次翻倍
+	RetransmitTimeout time.Duration
+	// 可靠消息最多重发的次数
+	MaxRetransmits int
 
+	// kdb中所有key的前缀,同一个kdb中的多个节点需要使用不同的Namespace
+	Namespace      string
 	NodesBackupKey string
+	// 恢复路由表的时候,超过这个时间没有活动的节点会被丢弃
+	NodeExpireAge time.Duration
+	// kv存储在kdb中的前缀
+	KVPrefix string
+	// 存储的值的最大长度
+	MaxValueSize int
+	// 存储的值的写入时间最多比本地时间晚多少,超过的写入被拒绝,防止一个值永远不能被覆盖
+	MaxClockSkew time.Duration
+	// 值在写入以后保存的时间,过期以后被删除,写入者需要在过期之前重新Put
+	ValueExpiration time.Duration
+	// 保存值的节点把值重新复制给离key最近的节点的间隔,要小于ValueExpiration
+	RepublishInterval time.Duration
+	// 每个节点写入的字节数的令牌桶,Burst不能小于MaxValueSize
+	StoreByteLimit RateLimit
 
 	BucketSize int
+	// 每个桶的替换缓存大小
+	ReplacementSize int
+	// 节点连续ping失败多少次以后被移出路由表
+	MaxPingFails int
+	// ping/pong验证过的节点地址的有效期,过期以后需要重新验证才会回复findNodeReq
+	BondExpiration time.Duration
+	// 对方没有验证过我们的地址的时候,发送请求之前ping对方并最多等待BondWait,让对方反向ping我们
+	BondWait time.Duration
 
 	MaxNodeSize int
 	MinNodeSize int
 	Version     string
+	// 发送消息使用的编码,CodecBinary、旧版本的CodecBinaryV1或者调试用的CodecJSON
+	Codec byte
+	// 握手以后加密所有消息,不接收握手以外的明文消息
+	Encrypt bool
+	// 会话的有效期,过期以后重新握手
+	SessionTTL time.Duration
+	// 因为无法解密而重新握手的最小间隔
+	RehandshakeCooldown time.Duration
+	// 最多和多少个节点同时保持会话,超过以后先淘汰没有完成ping/pong的节点,再淘汰最久没有使用的会话
+	MaxSessions int
+	// 等待握手的时候每个节点最多暂存的消息数量
+	MaxParkedMsgs int
+	// 握手请求的时间戳和本地时间最多相差多少,超过的当作重放丢弃
+	HandshakeMaxAge time.Duration
 
 	StoreAckNum int
 
+	// 处理收到的消息和发送消息的协程数量
+	HandleWorkers int
+	WriteWorkers  int
+	// 另外保留给高优先级消息的处理协程数量,慢的处理函数占住所有HandleWorkers的时候ping、握手和ack还能处理
+	HighWorkers int
+	// Handle注册的处理函数的ctx的超时时间,处理函数应该在ctx结束以后返回,为0的时候不超时
+	HandlerTimeout time.Duration
+	// 每个优先级队列的长度
+	QueueSize int
+	// 队列满了以后收到的消息和发送的消息的处理方式
+	InboundDropPolicy  DropPolicy
+	OutboundDropPolicy DropPolicy
+
+	// 每个源IP的所有数据报和每个节点的所有消息的速率限制
+	IPRateLimit   RateLimit
+	PeerRateLimit RateLimit
+	// 按照消息类型限制每个节点的速率,明文消息还按照源IP限制,
+	// 消息解码以后按照子协议和类型查找限制,内置协议的Proto为空
+	TypeRateLimits map[MsgType]RateLimit
+	// 令牌桶的最大数量,超过以后淘汰最久没有使用的
+	MaxRateBuckets int
+	// 节点在BanWindow内超过速率限制BanThreshold次以后封禁BanDuration,BanThreshold为0的时候不封禁,源IP不会被封禁
+	BanThreshold int
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+
+	// 入站和出站消息的中间件,第一个在最外层,New以后用UseInbound和UseOutbound追加,
+	// 入站链和出站链的最外层总是Recover,不需要自己添加
+	Inbound  []Middleware
+	Outbound []Middleware
+
 	Host          string
 	Port          int
 	AdvertiseAddr *net.UDPAddr
-	NodeId        string
+	// 数据报的收发,为空的时候监听Host:Port的UDP
+	Transport Transport
+	// 节点私钥(ed25519 seed的hex编码),为空时从kdb中加载或者生成
+	PrivKey string
 
+	// 种子节点,格式为sp2p://<hex node id>@10.3.58.6:30303
 	Seeds []string
 
-	uuidC chan string
-	db    *kdb.KDB
-	l     log15.Logger
-	cache *cache.Cache
-	p2p   ISP2P
+	priv ed25519.PrivateKey
+	db   *kdb.KDB
+	kvMu sync.Mutex
+	l    log15.Logger
+	p2p  ISP2P
 }
 
-func (t *kConfig) InitLog(l ... log15.Logger) *kConfig {
+func (t *Config) InitLog(l ...log15.Logger) *Config {
 	if len(l) != 0 {
 		t.l = l[0].New("package", "sp2p")
 	} else {
@@ -85,28 +209,77 @@ func (t *kConfig) InitLog(l ... log15.Logger) *kConfig {
 	return t
 }
 
-func (t *kConfig) InitP2P() *kConfig {
-	t.p2p = newSP2p()
+// InitP2P 用这份配置创建节点,全局API使用这个节点
+func (t *Config) InitP2P() *Config {
+	p2p, err := New(t)
+	if err != nil {
+		panic(errs("init p2p error", err.Error()))
+	}
+	t.p2p = p2p
 	return t
 }
 
-func (t *kConfig) GetP2P() ISP2P {
+func (t *Config) GetP2P() ISP2P {
 	if t.p2p == nil {
 		panic("please init p2p")
 	}
 	return t.p2p
 }
 
-func (t *kConfig) InitDb(db ... *kdb.KDB) *kConfig {
+// InitDb 设置节点使用的kdb,不传的时候使用进程内共享的默认kdb,
+// 共享同一个kdb的节点要设置不同的Namespace
+func (t *Config) InitDb(db ...*kdb.KDB) *Config {
 	if len(db) != 0 {
 		t.db = db[0]
 	} else {
-		kdb.InitKdb(filepath.Join("kdata", "db"))
+		defaultDbOnce.Do(func() { kdb.InitKdb(filepath.Join("kdata", "db")) })
 		t.db = kdb.GetKdb()
 	}
 	return t
 }
 
+// dbPrefix 加上Namespace的kdb前缀
+func (t *Config) dbPrefix(p []byte) []byte {
+	return append([]byte(t.Namespace), p...)
+}
+
+var (
+	defaultDbOnce sync.Once
+
+	// 正在使用的kdb和Namespace,防止两个节点读写同一份数据
+	dbUsers   = make(map[*kdb.KDB]map[string]bool)
+	dbUsersMu sync.Mutex
+)
+
+// claimDb 登记节点使用的kdb和Namespace,已经被其他节点使用的时候返回错误
+func (t *Config) claimDb() error {
+	dbUsersMu.Lock()
+	defer dbUsersMu.Unlock()
+
+	ns, ok := dbUsers[t.db]
+	if !ok {
+		ns = make(map[string]bool)
+		dbUsers[t.db] = ns
+	}
+	if ns[t.Namespace] {
+		return errors.New(f("kdb namespace %q is used by another node, set a different Namespace or db", t.Namespace))
+	}
+	ns[t.Namespace] = true
+	return nil
+}
+
+func (t *Config) releaseDb() {
+	dbUsersMu.Lock()
+	defer dbUsersMu.Unlock()
+
+	if ns, ok := dbUsers[t.db]; ok {
+		delete(ns, t.Namespace)
+		if len(ns) == 0 {
+			delete(dbUsers, t.db)
+		}
+	}
+}
+
 func getLog() log15.Logger {
 	if getCfg().l == nil {
 		panic("please init sp2p log")
@@ -114,24 +287,30 @@ func getLog() log15.Logger {
 	return getCfg().l
 }
 
-func getDb() *kdb.KDB {
-	if getCfg().db == nil {
-		getLog().Error("please init sp2p db")
-		panic("")
-	}
-	return getCfg().db
-}
-
-func getCfg() *kConfig {
+func getCfg() *Config {
 	if cfg == nil {
 		panic("please init sp2p config")
 	}
 	return cfg
 }
 
-func DefaultConfig() *kConfig {
-	cfg = &kConfig{
+func (t *Config) nodesBackupKey(k []byte) []byte {
+	return append([]byte(t.NodesBackupKey), k...)
+}
+
+// DefaultConfig 创建默认配置,全局API使用这份配置
+func DefaultConfig() *Config {
+	cfg = NewConfig()
+	return cfg
+}
+
+// NewConfig 创建一份新的配置,每个节点使用自己的配置,这样同一个进程中可以运行多个节点
+func NewConfig() *Config {
+	return &Config{
 		MaxBufLen:           1024 * 16,
+		MTU:                 1200,
+		MaxFragments:        256,
+		FragmentTimeout:     10 * time.Second,
 		NtpFailureThreshold: 32,
 		NtpWarningCooldown:  10 * time.Minute,
 		NtpPool:             "pool.ntp.org",
@@ -140,32 +319,90 @@ func DefaultConfig() *kConfig {
 		Alpha:               3,
 		NodeResponseNumber:  8,
 		NodeBroadcastNumber: 16,
+		BroadcastTTL:        6,
+		BroadcastReceipt:    false,
+		ReceiptRateLimit:    RateLimit{Rate: 1, Burst: 10},
+		MaxRouteHops:        20,
+		MaxRouteForwards:    256,
+		RouteLookupLimit:    RateLimit{Rate: 1, Burst: 10},
+		TopicExpiration:     3 * time.Minute,
+		TopicMeshSize:       6,
+		TopicBufferSize:     64,
+		MaxTopicMembers:     1024,
+		MaxTopics:           4096,
+		MaxTopicsPerNode:    64,
+		MaxTopicNameLen:     256,
 		NodePartitionNumber: 8,
 		HashBits:            len(Hash{}) * 8,
 		PingNodeNum:         8,
 		FindNodeNUm:         20,
 		ConnReadTimeout:     5 * time.Second,
 		ConnWriteTimeout:    5 * time.Second,
+		RequestTimeout:      5 * time.Second,
+		RetransmitTimeout:   500 * time.Millisecond,
+		MaxRetransmits:      4,
 
 		Host:           "0.0.0.0",
 		Port:           8080,
 		NodesBackupKey: "nbk:",
+		NodeExpireAge:  24 * time.Hour,
+		KVPrefix:       "kv",
+		MaxValueSize:   16 * 1024,
+		MaxClockSkew:   time.Minute,
+
+		ValueExpiration:   24 * time.Hour,
+		RepublishInterval: time.Hour,
+		StoreByteLimit:    RateLimit{Rate: 64 * 1024, Burst: 1024 * 1024},
 
-		PingTick:     time.NewTicker(10 * time.Minute),
-		FindNodeTick: time.NewTicker(1 * time.Hour),
-		NtpTick:      time.NewTicker(10 * time.Minute),
+		PingInterval:      10 * time.Minute,
+		FindNodeInterval:  1 * time.Hour,
+		NtpInterval:       10 * time.Minute,
+		BootstrapInterval: 1 * time.Minute,
+		TopicInterval:     1 * time.Minute,
 
 		MaxNodeSize: 2000,
 		MinNodeSize: 100,
 		Version:     "1.0.0",
+		Codec:       CodecBinary,
 
-		AdvertiseAddr: nil,
-		BucketSize:    16,
-		StoreAckNum:   2,
+		Encrypt:             true,
+		SessionTTL:          time.Hour,
+		RehandshakeCooldown: 5 * time.Second,
+		MaxSessions:         4096,
+		MaxParkedMsgs:       64,
+		HandshakeMaxAge:     5 * time.Minute,
 
-		uuidC: make(chan string, 500),
-		cache: cache.New(10*time.Minute, 30*time.Minute),
-	}
+		AdvertiseAddr:   nil,
+		BucketSize:      16,
+		ReplacementSize: 10,
+		MaxPingFails:    3,
+		BondExpiration:  24 * time.Hour,
+		BondWait:        500 * time.Millisecond,
+		StoreAckNum:     2,
 
-	return cfg
+		HandleWorkers:      32,
+		WriteWorkers:       8,
+		HighWorkers:        4,
+		HandlerTimeout:     10 * time.Second,
+		QueueSize:          1024,
+		InboundDropPolicy:  DropOldest,
+		OutboundDropPolicy: Reject,
+
+		IPRateLimit:   RateLimit{Rate: 2000, Burst: 4000},
+		PeerRateLimit: RateLimit{Rate: 200, Burst: 400},
+		TypeRateLimits: map[MsgType]RateLimit{
+			{Type: findNodeReqT}:  {Rate: 5, Burst: 20},
+			{Type: findValueReqT}: {Rate: 10, Burst: 20},
+			{Type: storeReqT}:     {Rate: 10, Burst: 20},
+			{Type: topicReqT}:     {Rate: 5, Burst: 20},
+		},
+		MaxRateBuckets: 65536,
+		BanThreshold:   100,
+		BanWindow:      time.Minute,
+		BanDuration:    10 * time.Minute,
+
+		MaxSenderFragmentBytes:  1024 * 1024,
+		MaxFragmentBytes:        16 * 1024 * 1024,
+		MaxSenderFragmentGroups: 32,
+	}
 }
@@ -0,0 +1,187 @@
+package sp2p
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// 分片的数据报格式: fragmentV(1) + group(16) + index(2) + total(2) + data
+// 分片本身不签名,重组以后的完整消息会校验签名
+const (
+	fragmentV         = byte(0xf0)
+	fragmentGroupLen  = 16
+	fragmentHeaderLen = 1 + fragmentGroupLen + 2 + 2
+
+	// 内存统计中每个分组的额外开销: fragGroup结构体和map的entry,以及每个分片的slice header
+	fragGroupOverhead = 128
+	fragPartOverhead  = 24
+)
+
+var (
+	errFragmentTooMany = errors.New("fragment count exceeds MaxFragments")
+	errFragmentInvalid = errors.New("fragment is invalid")
+	errFragmentMemory  = errors.New("fragment memory limit exceeded")
+	errFragmentGroups  = errors.New("too many open fragment groups")
+)
+
+// fragment 把超过MTU的消息拆分成多个数据报
+func fragment(b []byte, mtu, maxFragments int) ([][]byte, error) {
+	if len(b) <= mtu {
+		return [][]byte{b}, nil
+	}
+
+	size := mtu - fragmentHeaderLen
+	total := (len(b) + size - 1) / size
+	if total > maxFragments || total > 0xffff {
+		return nil, errFragmentTooMany
+	}
+
+	// 分组ID由消息内容决定,重发同一个消息的时候可以补齐之前丢失的分片
+	sum := sha256.Sum256(b)
+	group := sum[:fragmentGroupLen]
+	frames := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(b) {
+			end = len(b)
+		}
+
+		frame := make([]byte, fragmentHeaderLen, fragmentHeaderLen+end-i*size)
+		frame[0] = fragmentV
+		copy(frame[1:], group)
+		binary.BigEndian.PutUint16(frame[1+fragmentGroupLen:], uint16(i))
+		binary.BigEndian.PutUint16(frame[3+fragmentGroupLen:], uint16(total))
+		frames = append(frames, append(frame, b[i*size:end]...))
+	}
+	return frames, nil
+}
+
+type fragGroup struct {
+	sender string
+	parts  [][]byte
+	got    int
+	size   int
+	expire time.Time
+}
+
+// reassembler 按照发送者和分组重组分片,超时的分组会被丢弃,
+// 每个发送者和所有发送者缓存的数据以及每个发送者的分组数量都有上限
+type reassembler struct {
+	mu sync.Mutex
+
+	cfg     *Config
+	groups  map[string]*fragGroup
+	senders map[string]int
+	open    map[string]int
+	total   int
+	lastGC  time.Time
+}
+
+func newReassembler(c *Config) *reassembler {
+	return &reassembler{
+		cfg:     c,
+		groups:  make(map[string]*fragGroup),
+		senders: make(map[string]int),
+		open:    make(map[string]int),
+	}
+}
+
+// add 添加一个分片,收齐了返回完整的消息
+func (r *reassembler) add(from *net.UDPAddr, b []byte) ([]byte, error) {
+	if len(b) <= fragmentHeaderLen {
+		return nil, errFragmentInvalid
+	}
+
+	index := int(binary.BigEndian.Uint16(b[1+fragmentGroupLen:]))
+	total := int(binary.BigEndian.Uint16(b[3+fragmentGroupLen:]))
+	if total < 2 || index >= total || total > r.cfg.MaxFragments {
+		return nil, errFragmentInvalid
+	}
+
+	sender := from.String()
+	key := sender + string(b[1:1+fragmentGroupLen])
+	data := b[fragmentHeaderLen:]
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastGC) > time.Second {
+		r.gc(now)
+	}
+
+	g, ok := r.groups[key]
+	if !ok {
+		if r.open[sender] >= r.cfg.MaxSenderFragmentGroups {
+			return nil, errFragmentGroups
+		}
+		cost := fragGroupOverhead + len(key) + total*fragPartOverhead
+		if !r.reserve(sender, cost) {
+			return nil, errFragmentMemory
+		}
+		g = &fragGroup{sender: sender, parts: make([][]byte, total), size: cost, expire: now.Add(r.cfg.FragmentTimeout)}
+		r.groups[key] = g
+		r.open[sender]++
+	}
+	if len(g.parts) != total {
+		return nil, errFragmentInvalid
+	}
+	if g.parts[index] != nil {
+		return nil, nil
+	}
+
+	if !r.reserve(sender, len(data)) {
+		r.drop(key, g)
+		return nil, errFragmentMemory
+	}
+
+	g.parts[index] = append([]byte(nil), data...)
+	g.got++
+	g.size += len(data)
+
+	if g.got < total {
+		return nil, nil
+	}
+
+	msg := make([]byte, 0, g.size)
+	for _, p := range g.parts {
+		msg = append(msg, p...)
+	}
+	r.drop(key, g)
+	return msg, nil
+}
+
+// reserve 没有超过内存上限的时候给sender记上n个字节
+func (r *reassembler) reserve(sender string, n int) bool {
+	if r.senders[sender]+n > r.cfg.MaxSenderFragmentBytes || r.total+n > r.cfg.MaxFragmentBytes {
+		return false
+	}
+	r.senders[sender] += n
+	r.total += n
+	return true
+}
+
+func (r *reassembler) drop(key string, g *fragGroup) {
+	delete(r.groups, key)
+	r.total -= g.size
+	if r.senders[g.sender] -= g.size; r.senders[g.sender] <= 0 {
+		delete(r.senders, g.sender)
+	}
+	if r.open[g.sender]--; r.open[g.sender] <= 0 {
+		delete(r.open, g.sender)
+	}
+}
+
+// gc 丢弃超时还没有收齐的分组
+func (r *reassembler) gc(now time.Time) {
+	r.lastGC = now
+	for key, g := range r.groups {
+		if now.After(g.expire) {
+			r.drop(key, g)
+		}
+	}
+}
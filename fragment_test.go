@@ -0,0 +1,136 @@
+package sp2p
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 超过MTU的消息在乱序和重复的网络上分片发送,对方重组以后只处理一次
+func TestFragmentReassembly(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{
+		Latency:      time.Millisecond,
+		Jitter:       5 * time.Millisecond,
+		DupRate:      0.3,
+		ReorderRate:  0.3,
+		ReorderDelay: 10 * time.Millisecond,
+		Seed:         1,
+	})
+	small := func(c *Config) { c.MTU = 256 }
+	a := newTestNode(t, sn, testAddr(1), small)
+	b := newTestNode(t, sn, testAddr(2), small)
+
+	got := make(chan string, 4)
+	if err := Handle(b.GetHManager(), func(ctx context.Context, peer Peer, m *testMsg) error {
+		got <- m.Text
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	text := strings.Repeat("fragment ", 500)
+	bn := b.tab.selfNode
+	if err := a.Write(&KMsg{TID: bn.ID.Hex(), TAddr: bn.addrString(), Data: &testMsg{Text: text}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-got:
+		if s != text {
+			t.Fatalf("reassembled %d bytes, want %d", len(s), len(text))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fragmented message was not delivered")
+	}
+	settle(t, sn)
+
+	if len(got) != 0 {
+		t.Fatal("fragmented message handled twice")
+	}
+	b.frag.mu.Lock()
+	defer b.frag.mu.Unlock()
+	if n := len(b.frag.groups); n != 0 {
+		t.Fatalf("%d fragment groups left open", n)
+	}
+}
+
+// 分片的数量、每个发送者的分组数量和缓存的字节数都有上限
+func TestFragmentLimits(t *testing.T) {
+	c := NewConfig()
+	c.MaxFragments = 4
+	c.MaxSenderFragmentGroups = 2
+	c.MaxSenderFragmentBytes = 2 * (fragGroupOverhead + 2*fragmentGroupLen + 4*fragPartOverhead + 400)
+	c.MaxFragmentBytes = 1 << 20
+
+	if _, err := fragment(make([]byte, 1000), 100+fragmentHeaderLen, c.MaxFragments); err != errFragmentTooMany {
+		t.Fatalf("fragment 10 parts: %v, want %v", err, errFragmentTooMany)
+	}
+
+	msg := func(i byte) [][]byte {
+		frames, err := fragment(bytes.Repeat([]byte{i}, 400), 100+fragmentHeaderLen, c.MaxFragments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return frames
+	}
+
+	r := newReassembler(c)
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8080}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 8080}
+
+	// 倒序到达也能重组,重复的分片被忽略
+	frames := msg(1)
+	for i := len(frames) - 1; i > 0; i-- {
+		if b, err := r.add(from, frames[i]); b != nil || err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+	}
+	if b, err := r.add(from, frames[1]); b != nil || err != nil {
+		t.Fatalf("duplicate part: %v", err)
+	}
+	if b, err := r.add(from, frames[0]); err != nil || !bytes.Equal(b, bytes.Repeat([]byte{1}, 400)) {
+		t.Fatalf("reassembled %d bytes, err %v", len(b), err)
+	}
+	if r.total != 0 || len(r.senders) != 0 || len(r.open) != 0 {
+		t.Fatalf("reassembler still holds %d bytes", r.total)
+	}
+
+	// 声明的分片数量超过MaxFragments
+	bad := append([]byte(nil), frames[0]...)
+	bad[3+fragmentGroupLen] = 0
+	bad[4+fragmentGroupLen] = byte(c.MaxFragments + 1)
+	if _, err := r.add(from, bad); err != errFragmentInvalid {
+		t.Fatalf("too many parts: %v, want %v", err, errFragmentInvalid)
+	}
+
+	// 每个发送者最多同时有两个没有收齐的分组,别的发送者不受影响
+	for i := byte(2); i <= 3; i++ {
+		if _, err := r.add(from, msg(i)[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.add(from, msg(4)[0]); err != errFragmentGroups {
+		t.Fatalf("third group: %v, want %v", err, errFragmentGroups)
+	}
+	if _, err := r.add(other, msg(4)[0]); err != nil {
+		t.Fatalf("other sender: %v", err)
+	}
+
+	// 超过每个发送者的内存上限以后整个分组被丢弃,已经缓存的分组不受影响
+	c.MaxSenderFragmentGroups = 4
+	held := r.senders[from.String()]
+	frames = msg(5)
+	for _, frame := range frames[:len(frames)-1] {
+		if _, err := r.add(from, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.add(from, frames[len(frames)-1]); err != errFragmentMemory {
+		t.Fatalf("last part: %v, want %v", err, errFragmentMemory)
+	}
+	if n := r.senders[from.String()]; n != held || r.open[from.String()] != 2 {
+		t.Fatalf("sender holds %d bytes in %d groups, want %d in 2", n, r.open[from.String()], held)
+	}
+}
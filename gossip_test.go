@@ -0,0 +1,199 @@
+package sp2p
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newGossipNodes 创建n个节点,每个节点收到的testMsg计数到got中
+func newGossipNodes(t *testing.T, sn *SimNetwork, n int, opts ...func(c *Config)) ([]*sp2p, []int32) {
+	t.Helper()
+
+	nodes := make([]*sp2p, n)
+	got := make([]int32, n)
+	for i := range nodes {
+		i := i
+		nodes[i] = newTestNode(t, sn, testAddr(i+1), opts...)
+		waitBootstrap(t, nodes[i])
+		if err := Handle(nodes[i].GetHManager(), func(ctx context.Context, peer Peer, m *testMsg) error {
+			atomic.AddInt32(&got[i], 1)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nodes, got
+}
+
+// 每个节点都认识其它所有节点,广播会多次到达同一个节点,但是只处理一次
+func TestGossipDedup(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	nodes, got := newGossipNodes(t, sn, 4, func(c *Config) {
+		c.BroadcastTTL = 3
+		c.NodeBroadcastNumber = 3
+	})
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b {
+				a.tab.addNode(b.tab.selfNode)
+			}
+		}
+	}
+
+	if _, err := nodes[0].Broadcast(&KMsg{Data: &testMsg{Text: "hello"}}); err != nil {
+		t.Fatal(err)
+	}
+	settle(t, sn)
+
+	// 发起者自己不处理
+	for i, want := range []int32{0, 1, 1, 1} {
+		if n := atomic.LoadInt32(&got[i]); n != want {
+			t.Fatalf("node %d handled the broadcast %d times, want %d", i, n, want)
+		}
+	}
+	dup := uint64(0)
+	for _, s := range nodes {
+		dup += atomic.LoadUint64(&s.metrics.gossipDupMsg)
+	}
+	if dup == 0 {
+		t.Fatal("no duplicate broadcast was dropped")
+	}
+}
+
+// 节点连成一条线,广播最多转发BroadcastTTL跳
+func TestGossipTTL(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	nodes, got := newGossipNodes(t, sn, 4, func(c *Config) { c.BroadcastTTL = 2 })
+	for i := 0; i+1 < len(nodes); i++ {
+		nodes[i].tab.addNode(nodes[i+1].tab.selfNode)
+		nodes[i+1].tab.addNode(nodes[i].tab.selfNode)
+	}
+
+	if _, err := nodes[0].Broadcast(&KMsg{Data: &testMsg{Text: "hello"}}); err != nil {
+		t.Fatal(err)
+	}
+	settle(t, sn)
+
+	for i, want := range []int32{0, 1, 1, 0} {
+		if n := atomic.LoadInt32(&got[i]); n != want {
+			t.Fatalf("node %d handled the broadcast %d times, want %d", i, n, want)
+		}
+	}
+}
+
+// 超过去重窗口或者时间在未来的广播被丢弃,即使签名是对的
+func TestGossipStale(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	nodes, got := newGossipNodes(t, sn, 2)
+	a, b := nodes[0], nodes[1]
+
+	m := &testMsg{Text: "old"}
+	data, err := marshalData(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, ts := range []time.Time{now.Add(-dedupWindow), now.Add(2 * a.cfg.MaxClockSkew)} {
+		g := &gossipReq{
+			ID:         a.nextID(),
+			Origin:     a.tab.selfNode.ID.Hex(),
+			OriginAddr: a.tab.selfNode.addrString(),
+			Time:       uint64(ts.UnixNano()),
+			TTL:        1,
+			Proto:      a.hm.protoOf(m),
+			DT:         m.T(),
+			Data:       data,
+		}
+		g.Sig = sign(a.cfg.priv, g.signData())
+		b.gossip(&KMsg{FID: a.tab.selfNode.ID.Hex(), Data: g}, g)
+
+		if n := atomic.LoadUint64(&b.metrics.staleGossipMsg); n != uint64(i+1) {
+			t.Fatalf("stale gossip %d not dropped", i)
+		}
+	}
+	settle(t, sn)
+	if n := atomic.LoadInt32(&got[1]); n != 0 {
+		t.Fatalf("stale gossip handled %d times", n)
+	}
+}
+
+// 回执只发给完成过ping/pong的发起者地址,每个发起者的回执有速率限制
+func TestGossipReceipt(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	var mu sync.Mutex
+	var acks []string
+	nodes, _ := newGossipNodes(t, sn, 2, func(c *Config) {
+		c.BroadcastReceipt = true
+		c.ReceiptRateLimit = RateLimit{Rate: 0.001, Burst: 2}
+		c.Outbound = []Middleware{func(next Handler) Handler {
+			return func(p ISP2P, msg *KMsg) error {
+				if _, ok := msg.Data.(*gossipAck); ok {
+					mu.Lock()
+					acks = append(acks, msg.TAddr)
+					mu.Unlock()
+				}
+				return next(p, msg)
+			}
+		}}
+	})
+	a, b := nodes[0], nodes[1]
+	sent := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), acks...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := b.PingNode(ctx, a.Self()); err != nil {
+		t.Fatal(err)
+	}
+	a.tab.addNode(b.tab.selfNode)
+
+	// OriginAddr不是发起者验证过的地址,不回复回执
+	m := &testMsg{Text: "spoof"}
+	data, err := marshalData(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &gossipReq{
+		ID:         a.nextID(),
+		Origin:     a.tab.selfNode.ID.Hex(),
+		OriginAddr: testAddr(9).String(),
+		Time:       uint64(time.Now().UnixNano()),
+		Receipt:    true,
+		Proto:      a.hm.protoOf(m),
+		DT:         m.T(),
+		Data:       data,
+	}
+	g.Sig = sign(a.cfg.priv, g.signData())
+	b.gossip(&KMsg{FID: a.tab.selfNode.ID.Hex(), Data: g}, g)
+	settle(t, sn)
+	if n := len(sent()); n != 0 {
+		t.Fatalf("sent %d receipts to an unverified address", n)
+	}
+
+	ids := make([]string, 3)
+	for i := range ids {
+		if ids[i], err = a.Broadcast(&KMsg{Data: &testMsg{Text: "hello"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settle(t, sn)
+
+	if st, _ := a.BroadcastStats(ids[0]); st.Reached != 1 {
+		t.Fatalf("broadcast reached %d nodes, want 1", st.Reached)
+	}
+	got := sent()
+	if len(got) != 2 {
+		t.Fatalf("sent %d receipts, want 2", len(got))
+	}
+	for _, addr := range got {
+		if addr != a.tab.selfNode.addrString() {
+			t.Fatalf("receipt sent to %s", addr)
+		}
+	}
+}
@@ -1,48 +1,295 @@
 package sp2p
 
 import (
-	"sync"
+	"context"
+	"errors"
 	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// 内置的子协议,包含节点发现等核心消息,没有指定协议的消息都属于它
+// 0x00-0x3f 保留给内置的协议消息,应用消息使用 0x40-0xff
+const (
+	DiscProtocol = "disc/1"
+	MaxCoreType  = byte(0x3f)
+)
+
+// 节点最多声明的协议数量和协议名称(包括版本号)的最大长度,超过的协议列表不会被接受
+const (
+	maxProtocols       = 32
+	maxProtocolNameLen = 64
 )
 
+var (
+	ErrReservedType      = errors.New("message type is reserved for core packets")
+	ErrDuplicateType     = errors.New("message type is already registered")
+	ErrDuplicateProtocol = errors.New("protocol is already registered")
+	ErrTooManyProtocols  = errors.New("too many protocols")
+	errProtocolList      = errors.New("protocol list is too long")
+	errUnknownProtocol   = errors.New("kmsg protocol is unknown")
+	errUnsupportedProto  = errors.New("peer does not support the protocol")
+)
+
+// isCoreType 内置协议中保留给核心消息的类型,不能包装在广播或者路由消息中
+func isCoreType(proto string, dt byte) bool {
+	return (proto == "" || proto == DiscProtocol) && dt <= MaxCoreType
+}
+
+var protocolName = regexp.MustCompile(`^[a-zA-Z0-9_.\-]+$`)
+
+// NewProtocol 创建名称为name/version的子协议,注册完消息以后用AddProtocol加到节点上
+func NewProtocol(name string, version int) (*Protocol, error) {
+	full := f("%s/%d", name, version)
+	if !protocolName.MatchString(name) || version < 0 || len(full) > maxProtocolNameLen {
+		return nil, errors.New(f("invalid protocol %s", full))
+	}
+	return &Protocol{name: full, hmap: make(map[byte]*handler)}, nil
+}
+
 var (
 	hmOnce sync.Once
-	hm     *handleManager
+	hm     *Protocol
 )
 
-func GetHManager() *handleManager {
+// GetHManager 全局的消息注册表,New的时候每个节点复制一份
+func GetHManager() *Protocol {
 	hmOnce.Do(func() {
-		hm = &handleManager{hmap: make(map[byte]reflect.Type)}
+		hm = &Protocol{
+			name:   DiscProtocol,
+			core:   true,
+			hmap:   make(map[byte]*handler),
+			protos: make(map[string]*Protocol),
+		}
 	})
 	return hm
 }
 
-type handleManager struct {
-	hmap map[byte]reflect.Type
+// HandlerFunc 应用消息的处理函数,返回的错误会记录到日志,
+// ctx在Config.HandlerTimeout以后结束,处理函数阻塞的时候应该等待ctx,不要一直占住处理协程
+type HandlerFunc func(ctx context.Context, peer Peer, msg IPacket) error
+
+type handler struct {
+	typ reflect.Type
+	// 为空的时候消息自己实现了IMessage.OnHandle
+	fn HandlerFunc
+}
+
+// Protocol 命名的子协议,有自己独立的消息类型空间,不同的子协议之间消息类型不会冲突
+// 协议名称带版本号,不兼容的修改使用新的版本,例如 "kv/2"
+// GetHManager返回的内置协议也是一个Protocol,其它子协议挂载在它上面
+type Protocol struct {
+	mu   sync.RWMutex
+	name string
+	// 内置协议保留了0x00-0x3f的消息类型
+	core bool
+	hmap map[byte]*handler
+	// 内置协议上挂载的其它子协议
+	protos map[string]*Protocol
 }
 
-func (h *handleManager) Registry(handlers ... interface{}) {
+// Name 协议名称,例如 "disc/1"
+func (h *Protocol) Name() string {
+	return h.name
+}
+
+// AddProtocol 挂载子协议,节点在ping/pong中向对方声明自己支持的协议
+func (h *Protocol) AddProtocol(p *Protocol) error {
+	if !h.core || p.core {
+		return errors.New("protocol can only be added to the core protocol")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.protos[p.name]; ok || p.name == h.name {
+		return ErrDuplicateProtocol
+	}
+	// 加上内置协议以后不能超过maxProtocols,否则对方不会接受协议列表
+	if len(h.protos)+1 >= maxProtocols {
+		return ErrTooManyProtocols
+	}
+	h.protos[p.name] = p
+	return nil
+}
+
+// protocol 根据名称找到子协议,空名称是内置协议
+func (h *Protocol) protocol(name string) *Protocol {
+	if name == "" || name == h.name {
+		return h
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.protos[name]
+}
+
+// protocols 支持的所有协议名称
+func (h *Protocol) protocols() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	names := []string{h.name}
+	for name := range h.protos {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// protoOf 根据消息的Go类型找到它所属的协议,内置协议返回空
+func (h *Protocol) protoOf(m IPacket) string {
+	typ := reflect.TypeOf(m)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	for _, name := range h.protocols() {
+		p := h.protocol(name)
+		p.mu.RLock()
+		v, ok := p.hmap[m.T()]
+		p.mu.RUnlock()
+		if ok && v.typ == typ {
+			if p == h {
+				return ""
+			}
+			return name
+		}
+	}
+	return ""
+}
+
+// newPacket 创建协议proto中类型为dt的空消息,用来解码
+func (h *Protocol) newPacket(proto string, dt byte) (IPacket, error) {
+	p := h.protocol(proto)
+	if p == nil {
+		return nil, errUnknownProtocol
+	}
+	if !p.contain(dt) {
+		return nil, errors.New(f("kmsg type %d of %s is nonexistent", dt, p.Name()))
+	}
+	return p.getHandler(dt), nil
+}
+
+// Register 注册自己处理业务的消息,类型不能在保留范围内,也不能重复
+func (h *Protocol) Register(msgs ...IMessage) error {
+	for _, m := range msgs {
+		if err := h.add(m, nil, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Registry 注册消息,出错的时候panic
+//
+// Deprecated: use Register or Handle, which return errors.
+func (h *Protocol) Registry(handlers ...interface{}) {
 	for _, handler := range handlers {
+		m, ok := reflect.New(reflect.TypeOf(handler)).Interface().(IMessage)
+		if !ok {
+			panic(f("handle %T is not IMessage", handler))
+		}
+		if err := h.add(m, nil, false); err != nil {
+			panic(f("%s, type: %d, desc: %s", err, m.T(), m.String()))
+		}
+	}
+}
 
-		h1 := reflect.TypeOf(handler)
-		h3 := reflect.New(h1).Interface().(IMessage)
+// registerCore 注册内置的协议消息
+func (h *Protocol) registerCore(msgs ...IMessage) {
+	for _, m := range msgs {
+		if err := h.add(m, nil, true); err != nil {
+			panic(f("%s, type: %d, desc: %s", err, m.T(), m.String()))
+		}
+	}
+}
 
-		name := h3.T()
-		if h.contain(name) {
-			getLog().Error("handle exist", "type", name, "desc", h3.String())
-			panic("")
+// Handle 注册类型为PT的应用消息和它的处理函数
+//
+//	sp2p.Handle(p.GetHManager(), func(ctx context.Context, peer sp2p.Peer, m *Chat) error {
+//		return peer.Reply(&ChatAck{})
+//	})
+//
+// 注册到子协议的消息可以使用全部的0x00-0xff
+//
+//	kv, _ := sp2p.NewProtocol("kv", 2)
+//	sp2p.Handle(kv, onGet)
+//	p.GetHManager().AddProtocol(kv)
+func Handle[T any, PT interface {
+	*T
+	IPacket
+}](h *Protocol, fn func(ctx context.Context, peer Peer, msg PT) error) error {
+	return h.add(PT(new(T)), func(ctx context.Context, peer Peer, msg IPacket) error {
+		return fn(ctx, peer, msg.(PT))
+	}, false)
+}
+
+func (h *Protocol) add(m IPacket, fn HandlerFunc, core bool) error {
+	if reflect.TypeOf(m).Kind() != reflect.Ptr {
+		return errors.New(f("message %T must be a pointer", m))
+	}
+
+	t := m.T()
+	if h.core && core != (t <= MaxCoreType) {
+		if core {
+			return errors.New(f("core packet type %d is out of the reserved range", t))
 		}
-		h.hmap[name] = h1
+		return ErrReservedType
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.hmap[t]; ok {
+		return ErrDuplicateType
+	}
+	h.hmap[t] = &handler{typ: reflect.TypeOf(m).Elem(), fn: fn}
+	return nil
+}
+
+// clone 复制一份注册表,每个sp2p实例有自己的注册表,子协议的注册表是共享的
+func (h *Protocol) clone() *Protocol {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	c := &Protocol{
+		name:   h.name,
+		core:   h.core,
+		hmap:   make(map[byte]*handler, len(h.hmap)),
+		protos: make(map[string]*Protocol, len(h.protos)),
+	}
+	for k, v := range h.hmap {
+		c.hmap[k] = v
+	}
+	for k, v := range h.protos {
+		c.protos[k] = v
 	}
+	return c
 }
 
-func (h *handleManager) contain(name byte) bool {
+func (h *Protocol) contain(name byte) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
 	_, ok := h.hmap[name]
 	return ok
 }
 
-func (h *handleManager) getHandler(name byte) IMessage {
-	h1 := h.hmap[name]
-	h2 := reflect.New(h1)
-	return h2.Interface().(IMessage)
+// getHandler 创建一个对应类型的空消息,用来解码
+func (h *Protocol) getHandler(name byte) IPacket {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return reflect.New(h.hmap[name].typ).Interface().(IPacket)
+}
+
+func (h *Protocol) handlerFunc(name byte) HandlerFunc {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if v, ok := h.hmap[name]; ok {
+		return v.fn
+	}
+	return nil
 }
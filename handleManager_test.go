@@ -0,0 +1,160 @@
+package sp2p
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lowMsg 类型在内置协议保留范围内的应用消息
+type lowMsg struct{}
+
+func (t *lowMsg) T() byte        { return 0x01 }
+func (t *lowMsg) String() string { return "lowMsg" }
+
+// kvMsg 子协议中的消息,和testMsg的类型字节相同
+type kvMsg struct{}
+
+func (t *kvMsg) T() byte        { return 0x40 }
+func (t *kvMsg) String() string { return "kvMsg" }
+
+// ackMsg 自己处理业务的消息,和testMsg的类型字节相同
+type ackMsg struct{ testMsg }
+
+func (t *ackMsg) OnHandle(ISP2P, *KMsg) {}
+
+func nopHandler[PT any](ctx context.Context, peer Peer, msg PT) error { return nil }
+
+func TestHandleCollisions(t *testing.T) {
+	hm := GetHManager().clone()
+
+	if err := Handle(hm, nopHandler[*testMsg]); err != nil {
+		t.Fatal(err)
+	}
+	if err := Handle(hm, nopHandler[*testMsg]); err != ErrDuplicateType {
+		t.Fatalf("duplicate Handle: %v", err)
+	}
+	if err := hm.Register(&ackMsg{}); err != ErrDuplicateType {
+		t.Fatalf("Register over Handle: %v", err)
+	}
+	if err := Handle(hm, nopHandler[*lowMsg]); err != ErrReservedType {
+		t.Fatalf("Handle reserved type: %v", err)
+	}
+	if err := hm.Register(&pingReq{}); err != ErrReservedType {
+		t.Fatalf("Register core type: %v", err)
+	}
+
+	// 每个节点的注册表是复制出来的,互不影响
+	if other := GetHManager().clone(); other.contain((&testMsg{}).T()) {
+		t.Fatal("registration leaked into the global registry")
+	}
+}
+
+func TestProtocolCollisions(t *testing.T) {
+	hm := GetHManager().clone()
+	if err := Handle(hm, nopHandler[*testMsg]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewProtocol("k v", 1); err == nil {
+		t.Fatal("invalid protocol name accepted")
+	}
+	kv, err := NewProtocol("kv", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 子协议有自己的类型空间,可以使用内置协议保留的类型,也可以和内置协议中的应用消息重复
+	if err := Handle(kv, nopHandler[*lowMsg]); err != nil {
+		t.Fatal(err)
+	}
+	if err := Handle(kv, nopHandler[*kvMsg]); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Register(&ackMsg{}); err != ErrDuplicateType {
+		t.Fatalf("duplicate type in sub protocol: %v", err)
+	}
+
+	if err := hm.AddProtocol(kv); err != nil {
+		t.Fatal(err)
+	}
+	if err := hm.AddProtocol(kv); err != ErrDuplicateProtocol {
+		t.Fatalf("duplicate protocol: %v", err)
+	}
+	if err := kv.AddProtocol(hm); err == nil {
+		t.Fatal("protocol added to a sub protocol")
+	}
+
+	if p := hm.protoOf(&kvMsg{}); p != "kv/2" {
+		t.Fatalf("kvMsg belongs to %q", p)
+	}
+	if p := hm.protoOf(&testMsg{}); p != "" {
+		t.Fatalf("testMsg belongs to %q", p)
+	}
+	m, err := hm.newPacket("kv/2", 0x40)
+	if _, ok := m.(*kvMsg); !ok || err != nil {
+		t.Fatalf("kv/2 type 0x40 decodes to %T %v", m, err)
+	}
+	m, err = hm.newPacket(DiscProtocol, 0x40)
+	if _, ok := m.(*testMsg); !ok || err != nil {
+		t.Fatalf("%s type 0x40 decodes to %T %v", DiscProtocol, m, err)
+	}
+	if _, err := hm.newPacket("chat/1", 0x40); err != errUnknownProtocol {
+		t.Fatalf("unknown protocol: %v", err)
+	}
+}
+
+// 节点在ping/pong中声明支持的协议,不发送对方没有声明的子协议消息
+func TestProtocolNegotiation(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1))
+	b := newTestNode(t, sn, testAddr(2))
+	c := newTestNode(t, sn, testAddr(3))
+
+	var handled int32
+	for _, s := range []*sp2p{a, b} {
+		s := s
+		kv, err := NewProtocol("kv", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Handle(kv, func(ctx context.Context, peer Peer, m *kvMsg) error {
+			if s == b {
+				atomic.AddInt32(&handled, 1)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.GetHManager().AddProtocol(kv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, s := range []*sp2p{b, c} {
+		if _, err := a.PingNode(ctx, s.Self()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bid, cid := NodeID(b.tab.selfNode.ID), NodeID(c.tab.selfNode.ID)
+	waitFor(t, 5*time.Second, "peer protocols were not recorded", func() bool {
+		return len(a.PeerProtocols(bid)) == 2 && len(a.PeerProtocols(cid)) == 1
+	})
+	if p := a.PeerProtocols(bid); p[0] != DiscProtocol || p[1] != "kv/2" {
+		t.Fatalf("b declared %v", p)
+	}
+
+	bn, cn := b.tab.selfNode, c.tab.selfNode
+	if err := a.Write(&KMsg{TID: bn.ID.Hex(), TAddr: bn.addrString(), Data: &kvMsg{}}); err != nil {
+		t.Fatal(err)
+	}
+	// Write在发送协程中才检查协议,直接调用write拿到错误
+	if err := a.write(&KMsg{TID: cn.ID.Hex(), TAddr: cn.addrString(), Data: &kvMsg{}}); err != errUnsupportedProto {
+		t.Fatalf("write kv/2 to c: %v, want %v", err, errUnsupportedProto)
+	}
+	waitFor(t, 5*time.Second, "b did not handle kvMsg", func() bool {
+		return atomic.LoadInt32(&handled) == 1
+	})
+}
@@ -50,11 +50,6 @@ func (a Hash) IsEmpty() bool {
 // Big converts this Hash to a big int.
 func (a Hash) Big() *big.Int { return new(big.Int).SetBytes(a[:]) }
 
-// GenNodeID 随机生成一个NODE ID
-func GenNodeID() Hash {
-	return MustBytesID(randBytes(len(EmptyHash)))
-}
-
 // BigToHash converts a big int to Hash.
 func BigToHash(b *big.Int) Hash { return BytesToHash(b.Bytes()) }
 
@@ -66,6 +61,9 @@ func BytesToHash(b []byte) Hash {
 }
 
 // StringToHash converts a string to the hash
+//
+// Deprecated: StringToHash copies the raw bytes of s, it does not parse hex.
+// Use HexToHash or ParseNodeID for hex node ids.
 func StringToHash(s string) Hash {
 	return BytesToHash([]byte(s))
 }
@@ -1,13 +1,28 @@
 package sp2p
 
+import (
+	"context"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
 type IHandler func(*sp2p, *KMsg)
 
-type IMessage interface {
+// IPacket 消息数据,实现了encoding.BinaryMarshaler的使用二进制编码,否则使用json,
+// 实现了 Priority() Priority 的按照这个优先级排队,否则是PriorityNormal
+type IPacket interface {
 	// 获取类型
 	T() byte
 	// 描述信息
 	String() string
-	// 业务处理
+}
+
+// IMessage 自己处理业务的消息,新的应用消息用Handle注册处理函数,
+// 内置的协议消息通过类型断言拿到*sp2p调用内部的方法
+type IMessage interface {
+	IPacket
+	// 业务处理,在处理协程中同步调用,不能阻塞,需要等待网络的工作用s.spawn放到单独的协程中
 	OnHandle(ISP2P, *KMsg)
 }
 
@@ -33,18 +48,95 @@ type ITable interface {
 }
 
 type ISP2P interface {
+	// 节点自己的配置、日志和消息注册表
+	GetCfg() *Config
+	GetLogger() log15.Logger
+	GetHManager() *Protocol
+
 	GetAddr() string
-	Write(msg *KMsg)
+	// 把消息放到发送队列,队列满了并且OutboundDropPolicy是Reject的时候返回ErrQueueFull
+	Write(msg *KMsg) error
+	// 可靠发送,对方确认以后返回Delivered,没有确认会按照指数退避重发
+	WriteReliable(ctx context.Context, msg *KMsg) DeliveryResult
+	// 回复请求,目标地址优先使用接收请求时观察到的地址,路由过来的请求沿原路返回
+	Reply(req *KMsg, data IPacket)
+	// 逐跳把data路由到target,target不存在的时候由离它最近的活节点处理
+	SendTo(ctx context.Context, target NodeID, data IPacket) error
+	// 路由一个请求并等待原路返回的回复,只接受target自己的回复,target不存在的时候等待到超时
+	RequestTo(ctx context.Context, target NodeID, data IPacket) (*KMsg, error)
+	// 发送请求并等待回复,超时时间为RequestTimeout
+	Request(ctx context.Context, msg *KMsg) (*KMsg, error)
+	// 迭代查找离target最近的节点
+	Lookup(ctx context.Context, target NodeID) ([]Node, error)
+	// 把数据存储到离key最近的节点,StoreAckNum个节点确认以后返回,同一个key最后写入的值覆盖之前的值
+	Put(ctx context.Context, key, value []byte) error
+	// 从DHT中查找数据,返回StoreAckNum个节点中最新的值
+	Get(ctx context.Context, key []byte) ([]byte, error)
+	// 从种子节点引导
+	Bootstrap() error
+	// 引导的进度和结果
+	GetBootstrapStatus() BootstrapStatus
+	// ping节点并返回往返时间
+	PingNode(ctx context.Context, n Node) (time.Duration, error)
+	// 自己的节点信息
+	Self() Node
+	// 路由表中的所有节点
+	Nodes() []Node
+	TableSize() int
+	// 把节点加到路由表,已经存在的节点更新活动时间
+	AddPeer(n Node) error
+	UpdatePeer(n Node) error
+	RemovePeer(id NodeID) error
+	// 路由表中离target最近的n个节点
+	ClosestNodes(target NodeID, n int) ([]Node, error)
+	// 路由表中随机的n个节点
+	RandomNodes(n int) ([]Node, error)
+	// 路由表中比measure离target更近的节点
+	CloserNodes(target, measure NodeID) []Node
+
+	// Deprecated: use PingNode.
+	Ping(ctx context.Context, rawUrl string) (time.Duration, error)
+	// Deprecated: use Self.
 	GetSelfNode() string
+	// Deprecated: use Nodes.
 	GetNodes() []string
-	TableSize() int
+	// Deprecated: use UpdatePeer.
 	UpdateNode(rawUrl string) error
+	// Deprecated: use AddPeer.
 	AddNode(rawUrl string) error
+	// Deprecated: use RemovePeer.
+	DeleteNode(id string) error
+	// Deprecated: use ClosestNodes.
 	FindMinDisNodes(targetID string, n int) (nodes []string, err error)
+	// Deprecated: use RandomNodes.
 	FindRandomNodes(n int) (nodes []string)
+	// Deprecated: use CloserNodes with Self().ID as measure.
 	FindNodeWithTargetBySelf(d string) (nodes []string)
+	// Deprecated: use CloserNodes.
 	FindNodeWithTarget(targetId string, measure string) (nodes []string)
-	Broadcast(msg *KMsg)
+	// 全网广播msg.Data,返回广播ID
+	Broadcast(msg *KMsg) (string, error)
+	// 自己发起的广播的覆盖情况
+	BroadcastStats(id string) (BroadcastStats, bool)
+	// 自己支持的协议,第一个是DiscProtocol
+	Protocols() []string
+	// 对方在ping/pong中声明的协议,没有收到过声明返回nil
+	PeerProtocols(id NodeID) []string
+	// 追加入站和出站消息的中间件,追加的中间件在已有中间件的里层
+	UseInbound(mws ...Middleware)
+	UseOutbound(mws ...Middleware)
+	// 因为超过速率限制被临时封禁的节点,源IP只限速不封禁
+	Bans() []Ban
+	// 解除封禁,不在封禁中的时候返回false
+	Unban(b Ban) bool
+	// 订阅主题,调用cancel取消订阅并关闭channel
+	Subscribe(topic string) (<-chan Message, func())
+	// 发布消息到主题的所有订阅者
+	Publish(topic string, payload []byte) error
 	PingN()
 	FindN()
+	// 停止所有协程,保存路由表并关闭连接
+	Close() error
+	// 运行时统计,例如签名校验失败而被丢弃的消息数量
+	GetMetrics() map[string]uint64
 }
@@ -0,0 +1,269 @@
+package sp2p
+
+import (
+	"container/list"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errRateLimited = errors.New("rate limit exceeded")
+	errBanned      = errors.New("peer is banned")
+)
+
+// RateLimit 令牌桶,每秒补充Rate个令牌,最多保存Burst个,Rate为0的时候不限制
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// MsgType 子协议中的消息类型,内置协议的Proto为空
+type MsgType struct {
+	Proto string
+	Type  byte
+}
+
+// msgType 消息的类型,DiscProtocol和空协议是同一个协议
+func msgType(proto string, dt byte) MsgType {
+	if proto == DiscProtocol {
+		proto = ""
+	}
+	return MsgType{Proto: proto, Type: dt}
+}
+
+// Ban 因为超过速率限制被临时封禁的节点,源IP可以伪造,只限速不封禁
+type Ban struct {
+	ID     NodeID
+	Reason string
+	Until  time.Time
+}
+
+func (b Ban) subject() string {
+	return nodeSubject(b.ID.Hash())
+}
+
+func ipSubject(ip string) string { return "ip:" + ip }
+func nodeSubject(id Hash) string { return "node:" + id.Hex() }
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+	lim    RateLimit
+}
+
+// take 补充令牌以后取n个令牌,令牌不够的时候返回false
+func (b *tokenBucket) take(now time.Time, n float64) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.lim.Rate
+	if max := float64(b.lim.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+type strike struct {
+	n     int
+	reset time.Time
+}
+
+// limiter 按照源IP和节点ID限制消息速率,BanWindow内超过限制BanThreshold次的节点被封禁BanDuration,
+// 只有验证过身份的节点ID会被封禁,防止伪造源IP让别人被封禁
+type limiter struct {
+	mu sync.Mutex
+
+	cfg *Config
+	// 令牌桶最多MaxRateBuckets个,超过以后淘汰最久没有使用的,防止大量的源IP占用内存
+	buckets map[string]*list.Element
+	lru     *list.List
+	strikes map[string]*strike
+	bans    map[string]Ban
+	lastGC  time.Time
+}
+
+func newLimiter(c *Config) *limiter {
+	return &limiter{
+		cfg:     c,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+		strikes: make(map[string]*strike),
+		bans:    make(map[string]Ban),
+	}
+}
+
+// allowIP 每个数据报按照源IP限制
+func (l *limiter) allowIP(ip string) error {
+	return l.allow(ipSubject(ip), nil, "", l.cfg.IPRateLimit)
+}
+
+// allowIPType 明文消息按照源IP和消息类型限制
+func (l *limiter) allowIPType(ip string, mt MsgType) error {
+	return l.allowType(ipSubject(ip), nil, mt)
+}
+
+// allowNode 验证了身份以后按照节点ID限制
+func (l *limiter) allowNode(id Hash) error {
+	b := &Ban{ID: NodeID(id)}
+	return l.allow(b.subject(), b, "", l.cfg.PeerRateLimit)
+}
+
+// allowNodeType 验证了身份的节点按照消息类型限制
+func (l *limiter) allowNodeType(id Hash, mt MsgType) error {
+	b := &Ban{ID: NodeID(id)}
+	return l.allowType(b.subject(), b, mt)
+}
+
+// allowRouteLookup 发起路由时的查找,限制的是自己
+func (l *limiter) allowRouteLookup() error {
+	return l.allow("local:route-lookup", nil, "", l.cfg.RouteLookupLimit)
+}
+
+// allowReceipt 给同一个广播发起者回复回执的速率,限制的是自己
+func (l *limiter) allowReceipt(origin Hash) error {
+	return l.allow("receipt:"+origin.Hex(), nil, "", l.cfg.ReceiptRateLimit)
+}
+
+// allowStoreBytes 每个节点写入的字节数,一个字节一个令牌,超过配额不封禁
+func (l *limiter) allowStoreBytes(id Hash, n int) error {
+	return l.allowN("store:"+id.Hex(), nil, "", l.cfg.StoreByteLimit, float64(n))
+}
+
+// allowType 按照消息类型限制
+func (l *limiter) allowType(sub string, b *Ban, mt MsgType) error {
+	lim, ok := l.cfg.TypeRateLimits[mt]
+	if !ok {
+		return nil
+	}
+	return l.allow(sub, b, f("/%s/%d", mt.Proto, mt.Type), lim)
+}
+
+// allow 从sub的令牌桶中取一个令牌,b不为空的时候多次超过限制会封禁b
+func (l *limiter) allow(sub string, b *Ban, bucket string, lim RateLimit) error {
+	return l.allowN(sub, b, bucket, lim, 1)
+}
+
+// allowN 从sub的令牌桶中取n个令牌
+func (l *limiter) allowN(sub string, b *Ban, bucket string, lim RateLimit, n float64) error {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastGC) > time.Minute {
+		l.gc(now)
+	}
+
+	if ban, ok := l.bans[sub]; ok {
+		if now.Before(ban.Until) {
+			return errBanned
+		}
+		delete(l.bans, sub)
+	}
+	if lim.Rate <= 0 {
+		return nil
+	}
+
+	tb := l.bucket(sub+bucket, lim, now)
+	if tb.take(now, n) {
+		return nil
+	}
+	if b == nil {
+		return errRateLimited
+	}
+
+	st, ok := l.strikes[sub]
+	if !ok || now.After(st.reset) {
+		st = &strike{reset: now.Add(l.cfg.BanWindow)}
+		l.strikes[sub] = st
+	}
+	if st.n++; l.cfg.BanThreshold > 0 && st.n >= l.cfg.BanThreshold {
+		delete(l.strikes, sub)
+		ban := *b
+		ban.Reason = f("exceeded rate limit %d times", st.n)
+		ban.Until = now.Add(l.cfg.BanDuration)
+		l.bans[sub] = ban
+		l.cfg.l.Warn("ban peer", "subject", sub, "until", ban.Until)
+	}
+	return errRateLimited
+}
+
+// bucket 返回key的令牌桶,并且标记为最近使用
+func (l *limiter) bucket(key string, lim RateLimit, now time.Time) *tokenBucket {
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		tb := e.Value.(*tokenBucket)
+		if tb.lim != lim {
+			tb.tokens, tb.last, tb.lim = float64(lim.Burst), now, lim
+		}
+		return tb
+	}
+
+	for l.cfg.MaxRateBuckets > 0 && l.lru.Len() >= l.cfg.MaxRateBuckets {
+		l.removeBucket(l.lru.Back())
+	}
+	tb := &tokenBucket{key: key, tokens: float64(lim.Burst), last: now, lim: lim}
+	l.buckets[key] = l.lru.PushFront(tb)
+	return tb
+}
+
+func (l *limiter) removeBucket(e *list.Element) {
+	l.lru.Remove(e)
+	delete(l.buckets, e.Value.(*tokenBucket).key)
+}
+
+// gc 删除已经补满的令牌桶、过期的计数和封禁
+func (l *limiter) gc(now time.Time) {
+	l.lastGC = now
+	for e := l.lru.Front(); e != nil; {
+		next := e.Next()
+		if tb := e.Value.(*tokenBucket); now.Sub(tb.last).Seconds()*tb.lim.Rate >= float64(tb.lim.Burst) {
+			l.removeBucket(e)
+		}
+		e = next
+	}
+	for k, st := range l.strikes {
+		if now.After(st.reset) {
+			delete(l.strikes, k)
+		}
+	}
+	for k, b := range l.bans {
+		if now.After(b.Until) {
+			delete(l.bans, k)
+		}
+	}
+}
+
+// list 还在有效期内的封禁,按照到期时间排序
+func (l *limiter) list() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(l.bans))
+	for _, b := range l.bans {
+		if now.Before(b.Until) {
+			bans = append(bans, b)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// unban 解除封禁,同时清空超限的计数
+func (l *limiter) unban(b Ban) bool {
+	sub := b.subject()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.bans[sub]
+	delete(l.bans, sub)
+	delete(l.strikes, sub)
+	return ok
+}
@@ -0,0 +1,99 @@
+package sp2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+func newTestLimiter(opts ...func(c *Config)) *limiter {
+	l := log15.New()
+	l.SetHandler(log15.DiscardHandler())
+
+	c := NewConfig()
+	c.InitLog(l)
+	for _, opt := range opts {
+		opt(c)
+	}
+	return newLimiter(c)
+}
+
+// 子协议中和内置协议类型字节相同的消息不受内置协议的类型限制
+func TestLimiterTypeByProto(t *testing.T) {
+	lim := RateLimit{Rate: 0.001, Burst: 2}
+	l := newTestLimiter(func(c *Config) {
+		c.TypeRateLimits = map[MsgType]RateLimit{{Type: findNodeReqT}: lim}
+		c.BanThreshold = 0
+	})
+	id := Hash{1}
+
+	for i := 0; i < 10; i++ {
+		if err := l.allowNodeType(id, msgType("kv/1", findNodeReqT)); err != nil {
+			t.Fatalf("sub protocol message %d limited: %v", i, err)
+		}
+	}
+	for i := 0; i < lim.Burst; i++ {
+		if err := l.allowNodeType(id, msgType(DiscProtocol, findNodeReqT)); err != nil {
+			t.Fatalf("core message %d limited: %v", i, err)
+		}
+	}
+	if err := l.allowNodeType(id, msgType("", findNodeReqT)); err != errRateLimited {
+		t.Fatalf("expected %v after burst, got %v", errRateLimited, err)
+	}
+}
+
+// 令牌桶超过MaxRateBuckets以后淘汰最久没有使用的
+func TestLimiterBucketLRU(t *testing.T) {
+	l := newTestLimiter(func(c *Config) { c.MaxRateBuckets = 4 })
+
+	for i := 0; i < 10; i++ {
+		if i == 8 {
+			// 1.0.0.6 重新使用,不会被淘汰
+			l.allowIP("1.0.0.6")
+		}
+		l.allowIP(f("1.0.0.%d", i))
+	}
+
+	if n := l.lru.Len(); n != 4 || len(l.buckets) != 4 {
+		t.Fatalf("expected 4 buckets, got %d/%d", n, len(l.buckets))
+	}
+	for _, ip := range []string{"1.0.0.6", "1.0.0.7", "1.0.0.8", "1.0.0.9"} {
+		if _, ok := l.buckets[ipSubject(ip)]; !ok {
+			t.Fatalf("bucket of %s evicted", ip)
+		}
+	}
+}
+
+// 节点在BanWindow内超过限制BanThreshold次以后被封禁,源IP只限速
+func TestLimiterBan(t *testing.T) {
+	l := newTestLimiter(func(c *Config) {
+		c.IPRateLimit = RateLimit{Rate: 0.001, Burst: 1}
+		c.PeerRateLimit = RateLimit{Rate: 0.001, Burst: 1}
+		c.BanThreshold = 3
+		c.BanWindow = time.Minute
+		c.BanDuration = time.Hour
+	})
+	id := Hash{2}
+
+	if err := l.allowNode(id); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := l.allowNode(id); err != errRateLimited {
+			t.Fatalf("strike %d: expected %v, got %v", i, errRateLimited, err)
+		}
+	}
+	if err := l.allowNode(id); err != errBanned {
+		t.Fatalf("expected %v, got %v", errBanned, err)
+	}
+	if bans := l.list(); len(bans) != 1 || bans[0].ID != NodeID(id) {
+		t.Fatalf("unexpected bans %v", bans)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := l.allowIP("1.0.0.1"); err == errBanned {
+			t.Fatal("source ip banned")
+		}
+	}
+}
@@ -1,92 +1,295 @@
 package sp2p
 
-func (s *sp2p) Write(msg *KMsg) {
-	go s.writeTx(msg)
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+func (s *sp2p) Write(msg *KMsg) error {
+	return s.writeTx(msg)
 }
 
-func (s *sp2p) GetSelfNode() string {
-	return s.tab.selfNode.string()
+func (s *sp2p) WriteReliable(ctx context.Context, msg *KMsg) DeliveryResult {
+	return s.writeReliable(ctx, msg)
 }
 
-func (s *sp2p) GetNodes() []string {
-	return s.tab.getRawNodes()
+func (s *sp2p) GetCfg() *Config {
+	return s.cfg
+}
+
+func (s *sp2p) GetLogger() log15.Logger {
+	return s.l
+}
+
+func (s *sp2p) GetHManager() *Protocol {
+	return s.hm
+}
+
+func (s *sp2p) Reply(req *KMsg, data IPacket) {
+	if req.route != nil {
+		route := req.route
+		s.spawn(func() { s.routeReply(route, data) })
+		return
+	}
+	msg := &KMsg{TID: req.FID, TAddr: req.SrcAddr(), RID: req.ID, Proto: req.Proto, Data: data}
+	// 握手的回复不需要会话,直接发送,不排在发送队列后面;
+	// pong也直接发送,这样对方一定先收到pong,然后才收到我们接着发出的请求
+	if _, ok := data.(*pongResp); ok || isHandshake(data) {
+		s.write(msg)
+		return
+	}
+	s.Write(msg)
+}
+
+func (s *sp2p) SendTo(ctx context.Context, target NodeID, data IPacket) error {
+	return s.sendTo(ctx, target.Hash(), data)
+}
+
+func (s *sp2p) RequestTo(ctx context.Context, target NodeID, data IPacket) (*KMsg, error) {
+	return s.requestTo(ctx, target.Hash(), data)
+}
+
+func (s *sp2p) Protocols() []string {
+	return s.protocols()
+}
+
+func (s *sp2p) PeerProtocols(id NodeID) []string {
+	return s.peerProtocols(id.String())
+}
+
+func (s *sp2p) UseInbound(mws ...Middleware) {
+	s.inbound.use(mws...)
+}
+
+func (s *sp2p) UseOutbound(mws ...Middleware) {
+	s.outbound.use(mws...)
+}
+
+func (s *sp2p) Bans() []Ban {
+	return s.limit.list()
+}
+
+func (s *sp2p) Unban(b Ban) bool {
+	return s.limit.unban(b)
+}
+
+func (s *sp2p) Close() error {
+	return s.close()
+}
+
+func (s *sp2p) Request(ctx context.Context, msg *KMsg) (*KMsg, error) {
+	return s.request(ctx, msg)
+}
+
+func (s *sp2p) Lookup(ctx context.Context, target NodeID) ([]Node, error) {
+	nodes, err := s.lookup(ctx, target.Hash())
+	return publicNodes(nodes), err
+}
+
+func (s *sp2p) Put(ctx context.Context, key, value []byte) error {
+	return s.put(ctx, key, value)
+}
+
+func (s *sp2p) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return s.get(ctx, key)
+}
+
+func (s *sp2p) Bootstrap() error {
+	return s.bootstrap()
+}
+
+func (s *sp2p) GetBootstrapStatus() BootstrapStatus {
+	return s.bs.get()
+}
+
+func (s *sp2p) PingNode(ctx context.Context, n Node) (time.Duration, error) {
+	return s.ping(ctx, n.node())
+}
+
+func (s *sp2p) Self() Node {
+	return s.tab.selfNode.public()
+}
+
+func (s *sp2p) Nodes() []Node {
+	return publicNodes(s.tab.getAllNodes())
 }
 
 func (s *sp2p) TableSize() int {
 	return s.tab.size()
 }
 
-func (s *sp2p) UpdateNode(rawUrl string) error {
-	n, err := NodeParse(rawUrl)
+func (s *sp2p) AddPeer(n Node) error {
+	nd, err := s.checkPeer(n)
 	if err != nil {
 		return err
 	}
-	s.tab.updateNode(n)
+	s.tab.addNode(nd)
 	return nil
 }
-func (s *sp2p) DeleteNode(id string) error {
-	n, err := HexToHash(id)
+
+func (s *sp2p) UpdatePeer(n Node) error {
+	nd, err := s.checkPeer(n)
 	if err != nil {
 		return err
 	}
-	s.tab.deleteNode(n)
+	s.tab.updateNode(nd)
+	return nil
+}
+
+func (s *sp2p) RemovePeer(id NodeID) error {
+	if id.Hash() == s.tab.selfNode.ID {
+		return errSelfNode
+	}
+	s.tab.deleteNode(id.Hash())
 	return nil
 }
 
+func (s *sp2p) ClosestNodes(target NodeID, n int) ([]Node, error) {
+	if n <= 0 {
+		return nil, errors.New(f("node number %d must be positive", n))
+	}
+	return publicNodes(s.tab.findMinDisNodes(target.Hash(), n)), nil
+}
+
+func (s *sp2p) RandomNodes(n int) ([]Node, error) {
+	if n <= 0 {
+		return nil, errors.New(f("node number %d must be positive", n))
+	}
+	return publicNodes(s.tab.findRandomNodes(n)), nil
+}
+
+func (s *sp2p) CloserNodes(target, measure NodeID) []Node {
+	return publicNodes(s.tab.findNodeWithTarget(target.Hash(), measure.Hash()))
+}
+
+func (s *sp2p) Ping(ctx context.Context, rawUrl string) (time.Duration, error) {
+	n, err := ParseNode(rawUrl)
+	if err != nil {
+		return 0, err
+	}
+	return s.PingNode(ctx, n)
+}
+
+func (s *sp2p) GetSelfNode() string {
+	return s.Self().String()
+}
+
+func (s *sp2p) GetNodes() []string {
+	return nodeStrings(s.Nodes())
+}
+
+func (s *sp2p) UpdateNode(rawUrl string) error {
+	n, err := ParseNode(rawUrl)
+	if err != nil {
+		return err
+	}
+	return s.UpdatePeer(n)
+}
+
+func (s *sp2p) DeleteNode(id string) error {
+	n, err := ParseNodeID(id)
+	if err != nil {
+		return err
+	}
+	return s.RemovePeer(n)
+}
+
 func (s *sp2p) AddNode(rawUrl string) error {
-	n, err := NodeParse(rawUrl)
+	n, err := ParseNode(rawUrl)
 	if err != nil {
 		return err
 	}
-	s.tab.addNode(n)
-	return nil
+	return s.AddPeer(n)
 }
 
 func (s *sp2p) FindMinDisNodes(targetID string, n int) (nodes []string, err error) {
-	h, err := HexToHash(targetID)
+	h, err := ParseNodeID(targetID)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, n := range s.tab.findMinDisNodes(h, n) {
-		nodes = append(nodes, n.string())
+	ns, err := s.ClosestNodes(h, n)
+	if err != nil {
+		return nil, err
 	}
-	return nodes, nil
+	return nodeStrings(ns), nil
 }
 
 func (s *sp2p) FindRandomNodes(n int) (nodes []string) {
-	for _, n := range s.tab.findRandomNodes(n) {
-		nodes = append(nodes, n.string())
-	}
-	return
+	ns, _ := s.RandomNodes(n)
+	return nodeStrings(ns)
 }
 
 func (s *sp2p) FindNodeWithTargetBySelf(d string) (nodes []string) {
-	for _, n := range s.tab.findNodeWithTargetBySelf(StringToHash(d)) {
-		nodes = append(nodes, n.string())
-	}
-	return
+	return s.FindNodeWithTarget(d, s.Self().ID.String())
 }
 
 func (s *sp2p) FindNodeWithTarget(targetId string, measure string) (nodes []string) {
-	for _, n := range s.tab.findNodeWithTarget(StringToHash(targetId), StringToHash(measure)) {
-		nodes = append(nodes, n.string())
+	t, err := ParseNodeID(targetId)
+	if err != nil {
+		s.l.Error("target node id error", "err", err)
+		return nil
+	}
+	m, err := ParseNodeID(measure)
+	if err != nil {
+		s.l.Error("measure node id error", "err", err)
+		return nil
 	}
-	return
+	return nodeStrings(s.CloserNodes(t, m))
 }
 
 func (s *sp2p) PingN() {
-	go s.pingN()
+	s.spawn(s.pingN)
 }
 
 func (s *sp2p) FindN() {
-	go s.findN()
+	s.spawn(s.findN)
+}
+
+func (s *sp2p) Broadcast(msg *KMsg) (string, error) {
+	return s.broadcast(msg)
+}
+
+func (s *sp2p) BroadcastStats(id string) (BroadcastStats, bool) {
+	return s.broadcastStats(id)
+}
+
+func (s *sp2p) Subscribe(topic string) (<-chan Message, func()) {
+	return s.subscribe(topic)
+}
+
+func (s *sp2p) Publish(topic string, payload []byte) error {
+	return s.publish(topic, payload)
+}
+
+func (s *sp2p) GetMetrics() map[string]uint64 {
+	m := s.metrics.dump()
+	s.inQ.dump("inbound", m)
+	s.outQ.dump("outbound", m)
+	return m
+}
+
+var errSelfNode = errors.New("node is self")
+
+// checkPeer 只有完整的、不是自己的节点才能加到路由表
+func (s *sp2p) checkPeer(n Node) (*node, error) {
+	if n.ID.Hash() == s.tab.selfNode.ID {
+		return nil, errSelfNode
+	}
+	nd := n.node()
+	if err := nd.validateComplete(); err != nil {
+		return nil, err
+	}
+	return nd, nil
 }
 
-func (s *sp2p) Broadcast(msg *KMsg) {
-	for _, n := range s.tab.getAllNodes() {
-		msg.TAddr = n.addrString()
-		msg.TID = n.ID.Hex()
-		s.writeTx(msg)
+func nodeStrings(nodes []Node) []string {
+	ns := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		ns = append(ns, n.String())
 	}
+	return ns
 }
@@ -0,0 +1,139 @@
+package sp2p
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errNoSeeds = errors.New("bootstrap has no seed")
+
+// BootstrapStatus 引导的进度和结果
+type BootstrapStatus struct {
+	// 是否正在引导
+	Running bool `json:"running"`
+	// 已经引导的次数
+	Rounds    int       `json:"rounds"`
+	StartAt   time.Time `json:"start_at"`
+	EndAt     time.Time `json:"end_at"`
+	Seeds     int       `json:"seeds"`
+	SeedsLive int       `json:"seeds_live"`
+	TableSize int       `json:"table_size"`
+	Err       string    `json:"err,omitempty"`
+}
+
+type bootstrapState struct {
+	sync.RWMutex
+	status BootstrapStatus
+}
+
+func (b *bootstrapState) get() BootstrapStatus {
+	b.RLock()
+	defer b.RUnlock()
+	return b.status
+}
+
+// start 标记开始引导,已经在引导中返回false
+func (b *bootstrapState) start() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.status.Running {
+		return false
+	}
+	b.status = BootstrapStatus{Running: true, Rounds: b.status.Rounds + 1, StartAt: time.Now()}
+	return true
+}
+
+func (b *bootstrapState) update(fn func(s *BootstrapStatus)) {
+	b.Lock()
+	defer b.Unlock()
+	fn(&b.status)
+}
+
+// bootstrap 从种子节点加入网络
+// ping所有种子节点,把回复了的节点加到路由表,然后查找离自己最近的节点来填充路由表
+func (s *sp2p) bootstrap() error {
+	if !s.bs.start() {
+		return errors.New("bootstrap is running")
+	}
+
+	logger := s.l
+	err := s.doBootstrap()
+
+	s.bs.update(func(st *BootstrapStatus) {
+		st.Running = false
+		st.EndAt = time.Now()
+		st.TableSize = s.tab.size()
+		if err != nil {
+			st.Err = err.Error()
+		}
+	})
+
+	switch {
+	case err == errNoSeeds:
+		logger.Debug("bootstrap skipped", "err", err)
+	case err != nil:
+		logger.Error("bootstrap error", "err", err)
+	default:
+		logger.Info("bootstrap done", "table_size", s.tab.size())
+	}
+	return err
+}
+
+func (s *sp2p) doBootstrap() error {
+	logger := s.l
+
+	seeds := make([]*node, 0, len(s.cfg.Seeds))
+	for _, raw := range s.cfg.Seeds {
+		sn, err := ParseNode(raw)
+		if err != nil {
+			logger.Error("seed parse error", "seed", raw, "err", err)
+			continue
+		}
+		if n := sn.node(); n.ID != s.tab.selfNode.ID {
+			seeds = append(seeds, n)
+		}
+	}
+	s.bs.update(func(st *BootstrapStatus) { st.Seeds = len(seeds) })
+
+	// 没有种子节点也没有恢复出来的节点,只能等别的节点连过来
+	if len(seeds) == 0 && s.tab.size() == 0 {
+		return errNoSeeds
+	}
+
+	var wg sync.WaitGroup
+	for _, n := range seeds {
+		n := n
+		wg.Add(1)
+		ok := s.spawn(func() {
+			defer wg.Done()
+
+			if _, err := s.ping(s.ctx, n); err != nil {
+				logger.Warn("seed ping error", "seed", n.string(), "err", err)
+				return
+			}
+			s.tab.addNode(n)
+			s.bs.update(func(st *BootstrapStatus) { st.SeedsLive++ })
+		})
+		if !ok {
+			wg.Done()
+		}
+	}
+	wg.Wait()
+
+	if s.tab.size() == 0 {
+		return errors.New("bootstrap error: no live seed")
+	}
+
+	return s.refreshBuckets(s.ctx)
+}
+
+// checkBootstrap 路由表的节点少于MinNodeSize的时候重新引导
+func (s *sp2p) checkBootstrap() {
+	if s.tab.size() >= s.cfg.MinNodeSize {
+		return
+	}
+	s.l.Debug("table size is less than MinNodeSize, rebootstrap", "size", s.tab.size())
+	s.bootstrap()
+}
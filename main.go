@@ -1,67 +1,261 @@
 package sp2p
 
 import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
 	"net"
-	"time"
 	"strings"
-	"io"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/patrickmn/go-cache"
 	"github.com/satori/go.uuid"
 )
 
-func newSP2p() ISP2P {
-	logger := getLog()
+// New 创建一个独立的sp2p节点
+// 节点拥有自己的配置、日志、数据库、缓存、消息注册表和连接,同一个进程中可以运行多个节点
+func New(c *Config) (ISP2P, error) {
+	if c.l == nil {
+		c.InitLog()
+	}
+	if c.db == nil {
+		return nil, errors.New("please init sp2p db")
+	}
+	if c.MTU <= fragmentHeaderLen || c.MTU > c.MaxBufLen {
+		return nil, errors.New(f("MTU must be in (%d, MaxBufLen]", fragmentHeaderLen))
+	}
+	if c.HandleWorkers <= 0 || c.WriteWorkers <= 0 || c.QueueSize <= 0 {
+		return nil, errors.New("HandleWorkers, WriteWorkers and QueueSize must be positive")
+	}
+	if c.HighWorkers < 0 {
+		return nil, errors.New("HighWorkers must not be negative")
+	}
+	if c.PingInterval <= 0 || c.FindNodeInterval <= 0 || c.NtpInterval <= 0 || c.BootstrapInterval <= 0 || c.TopicInterval <= 0 || c.RepublishInterval <= 0 {
+		return nil, errors.New("PingInterval, FindNodeInterval, NtpInterval, BootstrapInterval, TopicInterval and RepublishInterval must be positive")
+	}
+	// 重新复制的时候写入时间不变,值要在过期之前至少复制一次
+	if c.ValueExpiration <= c.RepublishInterval {
+		return nil, errors.New("ValueExpiration must be longer than RepublishInterval")
+	}
+	if c.StoreByteLimit.Rate > 0 && c.StoreByteLimit.Burst < c.MaxValueSize {
+		return nil, errors.New("StoreByteLimit.Burst must not be less than MaxValueSize")
+	}
+	// 种子节点必须包含地址,否则没有办法ping
+	for _, raw := range c.Seeds {
+		if _, err := ParseNode(raw); err != nil {
+			return nil, errors.New(errs("invalid seed "+raw, err.Error()))
+		}
+	}
+
+	if err := c.claimDb(); err != nil {
+		return nil, err
+	}
+
+	logger := c.l
 
 	p2p := &sp2p{
-		txRC:      make(chan *KMsg, 10000),
-		txWC:      make(chan *KMsg, 10000),
-		localAddr: &net.UDPAddr{Port: cfg.Port, IP: net.ParseIP(cfg.Host)},
+		cfg:        c,
+		l:          logger,
+		hm:         GetHManager().clone(),
+		pending:    make(map[string]*pendingReq),
+		localAddr:  &net.UDPAddr{Port: c.Port, IP: net.ParseIP(c.Host)},
+		frag:       newReassembler(c),
+		limit:      newLimiter(c),
+		sess:       newSessions(c),
+		bstats:     cache.New(time.Hour, 10*time.Minute),
+		peerProtos: cache.New(c.BondExpiration, 10*time.Minute),
+		topics:     newTopics(),
+		routeSem:   make(chan struct{}, c.MaxRouteForwards),
+		uuidC:      make(chan string, 500),
+		cache:      cache.New(dedupWindow, 3*dedupWindow),
 	}
+	p2p.ctx, p2p.cancel = context.WithCancel(context.Background())
+	// Recover总是在入站链和出站链的最外层,用户的中间件panic也不会让处理协程和发送协程退出
+	p2p.inbound = newChain(p2p.dispatch, append([]Middleware{Recover()}, c.Inbound...)...)
+	p2p.outbound = newChain(p2p.send, append([]Middleware{Recover()}, c.Outbound...)...)
 
-	if cfg.AdvertiseAddr == nil {
+	if c.AdvertiseAddr == nil && c.Transport != nil {
+		c.AdvertiseAddr = c.Transport.LocalAddr()
+	}
+	if c.AdvertiseAddr == nil {
 		logger.Error("没有设置AdvertiseAddr")
-		cfg.AdvertiseAddr = &net.UDPAddr{Port: cfg.Port, IP: net.ParseIP("127.0.0.1")}
-		logger.Warn("默认AdvertiseAddr", "addr", cfg.AdvertiseAddr.String())
+		c.AdvertiseAddr = &net.UDPAddr{Port: c.Port, IP: net.ParseIP("127.0.0.1")}
+		logger.Warn("默认AdvertiseAddr", "addr", c.AdvertiseAddr.String())
 	}
 
-	logger.Debug("ListenUDP", "addr", p2p.localAddr.String())
+	if c.PrivKey != "" {
+		priv, err := HexNodeKey(c.PrivKey)
+		if err != nil {
+			c.releaseDb()
+			return nil, errors.New(errs("node private key error", err.Error()))
+		}
+		c.priv = priv
+	} else {
+		c.priv = c.loadNodeKey()
+	}
 
-	if conn, err := net.ListenUDP("udp", p2p.localAddr); err != nil {
-		panic(errs(f("udp %s listen error", p2p.localAddr), err.Error()))
+	if c.Transport != nil {
+		p2p.conn = c.Transport
+		p2p.localAddr = c.Transport.LocalAddr()
 	} else {
+		logger.Debug("ListenUDP", "addr", p2p.localAddr.String())
+
+		conn, err := ListenUDP(p2p.localAddr)
+		if err != nil {
+			c.releaseDb()
+			return nil, errors.New(errs(f("udp %s listen error", p2p.localAddr), err.Error()))
+		}
 		p2p.conn = conn
 	}
 
-	nodeId := MustHexID(cond(cfg.NodeId == "", GenNodeID(), cfg.NodeId).(string))
+	nodeId := PubkeyID(c.priv.Public().(ed25519.PublicKey))
 	logger.Debug("node id", "id", nodeId)
 
 	logger.Debug("create table", "table")
-	p2p.tab = newTable(nodeId, cfg.AdvertiseAddr)
+	p2p.tab = newTable(c, nodeId, c.AdvertiseAddr)
+	p2p.tab.ping = func(n *node) (time.Duration, error) {
+		rtt, err := p2p.ping(p2p.ctx, n)
+		// 关闭的时候ping失败不代表节点不在线
+		if err != nil && p2p.ctx.Err() != nil {
+			return 0, errClosed
+		}
+		return rtt, err
+	}
+	p2p.tab.spawn = p2p.spawn
+	p2p.sess.bonded = func(id Hash) bool {
+		_, ok := p2p.tab.bondAddr(id)
+		return ok
+	}
+
+	p2p.inQ = newWorkerPool(c.HandleWorkers, c.HighWorkers, c.QueueSize, c.InboundDropPolicy, p2p.handle)
+	p2p.outQ = newWorkerPool(c.WriteWorkers, 0, c.QueueSize, c.OutboundDropPolicy, func(msg *KMsg) { p2p.write(msg) })
 
-	go p2p.accept()
-	go p2p.loop()
-	go p2p.genUUID()
+	restored := p2p.tab.restore()
 
-	return p2p
+	p2p.pingTick = time.NewTicker(c.PingInterval)
+	p2p.findNodeTick = time.NewTicker(c.FindNodeInterval)
+	p2p.ntpTick = time.NewTicker(c.NtpInterval)
+	p2p.bootstrapTick = time.NewTicker(c.BootstrapInterval)
+	p2p.topicTick = time.NewTicker(c.TopicInterval)
+	p2p.republishTick = time.NewTicker(c.RepublishInterval)
+
+	p2p.spawn(p2p.accept)
+	p2p.spawn(p2p.loop)
+	p2p.spawn(p2p.genUUID)
+	// 恢复的节点ping通以后才加到路由表中,然后和种子节点一起引导
+	p2p.spawn(func() {
+		p2p.tab.revalidate(restored)
+		p2p.bootstrap()
+	})
+
+	return p2p, nil
 }
 
 type sp2p struct {
 	ISP2P
 
+	cfg       *Config
+	l         log15.Logger
+	hm        *Protocol
 	tab       *table
-	txRC      chan *KMsg
-	txWC      chan *KMsg
-	conn      *net.UDPConn
+	conn      Transport
 	localAddr *net.UDPAddr
 	laddr     string
+	metrics   metrics
+	bs        bootstrapState
+	frag      *reassembler
+	limit     *limiter
+	sess      *sessions
+	// 自己发起的广播的统计
+	bstats *cache.Cache
+	topics *topics
+	// 正在转发的路由消息
+	routeSem chan struct{}
+	// 节点在ping/pong中声明的协议
+	peerProtos *cache.Cache
+	// 消息ID的队列
+	uuidC chan string
+	// 收到的消息、广播、主题消息和路由消息的去重缓存
+	cache *cache.Cache
+	// 定时任务,Close的时候停止
+	pingTick      *time.Ticker
+	findNodeTick  *time.Ticker
+	ntpTick       *time.Ticker
+	bootstrapTick *time.Ticker
+	topicTick     *time.Ticker
+	republishTick *time.Ticker
+	// 正在重新复制保存的值
+	republishing int32
+	// 入站和出站消息的中间件链
+	inbound  *chain
+	outbound *chain
+	// 收到的消息和待发送的消息队列
+	inQ  *workerPool
+	outQ *workerPool
+
+	// 等待回复的请求
+	pending   map[string]*pendingReq
+	pendingMu sync.Mutex
+
+	// 关闭的时候取消ctx,然后等待所有协程退出
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	spawnMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+var errClosed = errors.New("sp2p is closed")
+
+type pendingReq struct {
+	tid string
+	c   chan *KMsg
+}
+
+// spawn 启动一个协程,Close的时候会等待它退出,已经关闭的时候不启动并返回false
+func (s *sp2p) spawn(fn func()) bool {
+	s.spawnMu.Lock()
+	defer s.spawnMu.Unlock()
+
+	if s.ctx.Err() != nil {
+		return false
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+	return true
 }
 
 // 生成uuid的队列
 func (s *sp2p) genUUID() {
 	for {
 		uid, err := uuid.NewV4()
-		if err == nil {
-			cfg.uuidC <- uid.String()
+		if err != nil {
+			continue
 		}
+
+		select {
+		case s.uuidC <- uid.String():
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// nextID 从uuid队列中取一个消息ID,关闭以后直接生成
+func (s *sp2p) nextID() string {
+	select {
+	case id := <-s.uuidC:
+		return id
+	case <-s.ctx.Done():
+		uid, _ := uuid.NewV4()
+		return uid.String()
 	}
 }
 
@@ -75,80 +269,422 @@ func (s *sp2p) GetAddr() string {
 func (s *sp2p) loop() {
 	for {
 		select {
-		case <-cfg.FindNodeTick.C:
-			go s.findN()
-		case <-cfg.PingTick.C:
-			go s.pingN()
-		case <-cfg.NtpTick.C:
-			go checkClockDrift()
-		case tx := <-s.txRC:
-			go tx.Data.OnHandle(s, tx)
-		case tx := <-s.txWC:
-			go s.write(tx)
+		case <-s.ctx.Done():
+			return
+		case <-s.findNodeTick.C:
+			s.spawn(s.findN)
+		case <-s.pingTick.C:
+			s.spawn(s.pingN)
+		case <-s.ntpTick.C:
+			s.spawn(func() { checkClockDrift(s.cfg) })
+		case <-s.bootstrapTick.C:
+			s.spawn(s.checkBootstrap)
+		case <-s.topicTick.C:
+			s.spawn(s.refreshTopics)
+		case <-s.republishTick.C:
+			s.spawn(s.republish)
 		}
 	}
 }
 
-func (s *sp2p) writeTx(msg *KMsg) {
-	s.txWC <- msg
+// writeTx 把消息放到发送队列,队列满了按照OutboundDropPolicy处理
+func (s *sp2p) writeTx(msg *KMsg) error {
+	if err := s.outQ.push(msg, priorityOf(msg.Data)); err != nil {
+		if err == errPoolClosed {
+			return errClosed
+		}
+		s.l.Debug("kmsg write queue error", "err", err, "type", msg.Data.String(), "node", msg.TID)
+		return err
+	}
+	return nil
 }
 
-func (s *sp2p) write(msg *KMsg) {
+// close 停止所有协程,关闭订阅,把还没发送的消息发出去,保存路由表,最后关闭连接
+func (s *sp2p) close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		// 加锁保证cancel以后不会再有wg.Add
+		s.spawnMu.Lock()
+		s.cancel()
+		s.spawnMu.Unlock()
+
+		s.pingTick.Stop()
+		s.findNodeTick.Stop()
+		s.ntpTick.Stop()
+		s.bootstrapTick.Stop()
+		s.topicTick.Stop()
+		s.republishTick.Stop()
+
+		s.inQ.close(false)
+		s.outQ.close(true)
+		err = s.conn.Close()
+		s.wg.Wait()
+
+		s.topics.close()
+		s.tab.flush()
+		s.cfg.releaseDb()
+	})
+	return err
+}
+
+func (s *sp2p) write(msg *KMsg) error {
 	if msg.FAddr == "" {
-		msg.FAddr = s.GetAddr()
+		msg.FAddr = s.tab.selfNode.addrString()
 	}
 	if msg.FID == "" {
 		msg.FID = s.tab.selfNode.ID.Hex()
 	}
 	if msg.ID == "" {
-		msg.ID = <-cfg.uuidC
+		msg.ID = s.nextID()
 	}
 	if msg.Version == "" {
-		msg.Version = cfg.Version
+		msg.Version = s.cfg.Version
 	}
 	if msg.TAddr == "" {
-		getLog().Error("target node addr is nonexistent")
-		return
+		s.l.Error("target node addr is nonexistent")
+		return errors.New("target node addr is nonexistent")
 	}
 	if msg.TID == "" {
-		getLog().Error("target node id is nonexistent")
-		return
+		s.l.Error("target node id is nonexistent")
+		return errors.New("target node id is nonexistent")
+	}
+	if msg.Proto == "" {
+		msg.Proto = s.hm.protoOf(msg.Data)
+	}
+
+	err := s.outbound.handle(s, msg)
+	switch {
+	case errors.Is(err, ErrPeerDenied):
+		s.metrics.incr(&s.metrics.deniedMsg)
+	case errors.Is(err, ErrHandlerPanic):
+		s.metrics.incr(&s.metrics.handlerPanic)
+	}
+	return err
+}
+
+// send 出站链的最后一步,编码、加密、分片以后发送
+func (s *sp2p) send(_ ISP2P, msg *KMsg) error {
+	if err := s.checkProto(msg); err != nil {
+		s.l.Debug("kmsg protocol error", "err", err, "proto", msg.Proto, "node", msg.TID)
+		return err
 	}
 
 	addr, err := net.ResolveUDPAddr("udp", msg.TAddr)
 	if err != nil {
-		getLog().Error("ResolveUDPAddr error", "err", err)
+		s.l.Error("ResolveUDPAddr error", "err", err)
+		return err
+	}
+
+	b, err := msg.Encode(s.cfg.Codec, s.cfg.priv)
+	if err != nil {
+		s.l.Error("kmsg encode error", "err", err)
+		return err
+	}
+
+	if s.cfg.Encrypt && !isHandshake(msg.Data) {
+		id, err := HexID(msg.TID)
+		if err != nil {
+			s.l.Error("target node id error", "err", err)
+			return err
+		}
+		if err := s.sealTo(id, addr, b); err != nil {
+			s.l.Debug("session error", "err", err, "node", msg.TID)
+			return err
+		}
+		return nil
+	}
+	return s.writeFrames(b, addr)
+}
+
+// writeFrames 超过MTU的数据报分片以后发送
+func (s *sp2p) writeFrames(b []byte, addr *net.UDPAddr) error {
+	frames, err := fragment(b, s.cfg.MTU, s.cfg.MaxFragments)
+	if err != nil {
+		s.l.Error("kmsg fragment error", "err", err, "len", len(b))
+		return err
+	}
+
+	for _, frame := range frames {
+		if _, err := s.conn.WriteTo(frame, addr); err != nil {
+			s.l.Error("WriteTo error", "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// request 发送请求,阻塞直到收到回复、ctx被取消或者超时
+func (s *sp2p) request(ctx context.Context, msg *KMsg) (*KMsg, error) {
+	return s.roundTrip(ctx, msg, s.writeTx)
+}
+
+// roundTrip 用send发送请求并等待回复
+func (s *sp2p) roundTrip(ctx context.Context, msg *KMsg, send func(*KMsg) error) (*KMsg, error) {
+	if msg.TID == "" {
+		return nil, errors.New("target node id is nonexistent")
+	}
+	if msg.ID == "" {
+		msg.ID = s.nextID()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+
+	c := s.addPending(msg.ID, msg.TID)
+	defer s.delPending(msg.ID)
+
+	if err := send(msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-c:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, errClosed
+	}
+}
+
+// addPending 登记等待tid回复的消息
+func (s *sp2p) addPending(id, tid string) chan *KMsg {
+	c := make(chan *KMsg, 1)
+	s.pendingMu.Lock()
+	s.pending[id] = &pendingReq{tid: tid, c: c}
+	s.pendingMu.Unlock()
+	return c
+}
+
+func (s *sp2p) delPending(id string) {
+	s.pendingMu.Lock()
+	delete(s.pending, id)
+	s.pendingMu.Unlock()
+}
+
+// limited 记录被限速或者封禁而丢弃的消息
+func (s *sp2p) limited(err error, ctx ...interface{}) {
+	if err == errBanned {
+		s.metrics.incr(&s.metrics.bannedMsg)
+	} else {
+		s.metrics.incr(&s.metrics.rateLimitedMsg)
+	}
+	s.l.Debug("drop kmsg", append([]interface{}{"err", err}, ctx...)...)
+}
+
+// isPending 是否是等待中的请求的回复
+func (s *sp2p) isPending(msg *KMsg) bool {
+	if msg.RID == "" {
+		return false
+	}
+
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	_, ok := s.pending[pendingKey(msg)]
+	return ok
+}
+
+// pendingKey 回复对应的等待key,确认对应的是可靠消息的ackKey
+func pendingKey(msg *KMsg) string {
+	if _, ok := msg.Data.(*ackResp); ok {
+		return ackKey(msg.RID)
+	}
+	return msg.RID
+}
+
+// reply 把回复交给等待中的请求,只接受请求目标节点发来的回复,tid为空的时候接受任何节点的回复
+func (s *sp2p) reply(msg *KMsg) {
+	if msg.RID == "" {
+		return
+	}
+
+	s.pendingMu.Lock()
+	p, ok := s.pending[pendingKey(msg)]
+	s.pendingMu.Unlock()
+	if !ok || (p.tid != "" && p.tid != msg.FID) {
+		return
+	}
+
+	select {
+	case p.c <- msg:
+	default:
+	}
+}
+
+// bondPong 收到了等待中的ping的pong,说明节点确实在这个地址上
+// 在接收协程中直接记录,这样对方发出pong以后马上发来的请求一定能看到bond
+func (s *sp2p) bondPong(msg *KMsg) {
+	if _, ok := msg.Data.(*pongResp); !ok || msg.RID == "" {
 		return
 	}
 
-	if _, err := s.conn.WriteToUDP(msg.Dumps(), addr); err != nil {
-		getLog().Error("WriteToUDP error", "err", err)
+	s.pendingMu.Lock()
+	p, ok := s.pending[msg.RID]
+	s.pendingMu.Unlock()
+	if !ok || p.tid != msg.FID {
+		return
+	}
+	if id, err := HexID(msg.FID); err == nil {
+		s.tab.bond(id, msg.SrcAddr())
+	}
+}
+
+// ping 发送ping并等待pong,返回往返时间
+func (s *sp2p) ping(ctx context.Context, n *node) (time.Duration, error) {
+	start := time.Now()
+	if _, err := s.request(ctx, &KMsg{TAddr: n.addrString(), TID: n.ID.Hex(), Data: &pingReq{Protos: s.protocols()}}); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// bond ping节点,节点回复以后才会加到路由表中
+func (s *sp2p) bond(n *node) bool {
+	if _, err := s.ping(s.ctx, n); err != nil {
+		s.l.Debug("bond error", "node", n.string(), "err", err)
+		return false
+	}
+	s.tab.updateNode(n)
+	return true
+}
+
+func (s *sp2p) bonded(id Hash, addr string) bool {
+	return s.tab.bonded(id, addr)
+}
+
+// bondNodes 别的节点返回的节点都是没有验证过的,在后台ping通了才加到路由表中
+func (s *sp2p) bondNodes(nodes []*node) {
+	for _, n := range nodes {
+		if n.ID == s.tab.selfNode.ID {
+			continue
+		}
+		if s.bonded(n.ID, n.addrString()) {
+			s.tab.updateNode(n)
+			continue
+		}
+		n := n
+		s.spawn(func() { s.bond(n) })
+	}
+}
+
+// whenBonded 只回复验证过地址的节点的请求: 验证过的直接执行fn,
+// 没有验证过的先在后台ping它,对方从同一个地址回复了pong以后再执行fn,
+// 请求比pong先到的时候请求者也不需要等到超时再重发
+func (s *sp2p) whenBonded(msg *KMsg, fn func(n *node)) {
+	n, err := nodeFromKMsg(msg)
+	if err != nil {
+		s.l.Error("NodeFromKMsg error", "err", err)
 		return
 	}
+	if s.bonded(n.ID, msg.SrcAddr()) {
+		fn(n)
+		return
+	}
+	s.spawn(func() {
+		if s.bond(n) && s.bonded(n.ID, msg.SrcAddr()) {
+			fn(n)
+		}
+	})
+}
+
+// ensureBond 对方只回复验证过地址的节点的请求,没有验证过的时候对方丢弃请求并且在后台ping我们,
+// 所以对方最近没有ping过我们的时候先ping它,再最多等待BondWait让它反向ping我们
+func (s *sp2p) ensureBond(ctx context.Context, n *node) error {
+	if s.tab.peerBonded(n.ID, n.addrString()) {
+		return nil
+	}
+
+	c := s.tab.waitPeerBond(n.ID)
+	if _, err := s.ping(ctx, n); err != nil {
+		return err
+	}
+
+	t := time.NewTimer(s.cfg.BondWait)
+	defer t.Stop()
+	select {
+	case <-c:
+	case <-t.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// bondedRequest 发送只回复验证过地址的节点的请求,对方回复了说明它已经验证过我们
+func (s *sp2p) bondedRequest(ctx context.Context, n *node, data IPacket) (*KMsg, error) {
+	if err := s.ensureBond(ctx, n); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.request(ctx, &KMsg{TAddr: n.addrString(), TID: n.ID.Hex(), Data: data})
+	if err != nil {
+		return nil, err
+	}
+	s.tab.peerBond(n.ID, n.addrString())
+	return resp, nil
 }
 
 func (s *sp2p) pingN() {
-	for _, n := range s.tab.findRandomNodes(cfg.PingNodeNum) {
-		s.writeTx(&KMsg{TAddr: n.addrString(), FID: s.tab.selfNode.ID.Hex(), Data: &pingReq{}})
+	s.tab.expireBonds()
+	s.sess.expire()
+	for _, n := range s.tab.findRandomNodes(s.cfg.PingNodeNum) {
+		n := n
+		s.spawn(func() {
+			rtt, err := s.ping(s.ctx, n)
+			s.tab.pingResult(n, rtt, err)
+			if err != nil {
+				s.l.Warn("ping node error", "node", n.string(), "err", err)
+				return
+			}
+			s.l.Debug("ping node", "node", n.string(), "rtt", rtt)
+		})
 	}
 }
 
+// findN 刷新路由表
 func (s *sp2p) findN() {
-	for _, b := range s.tab.buckets {
-		if b == nil || b.size() == 0 {
+	if err := s.refreshBuckets(s.ctx); err != nil {
+		s.l.Warn("findN lookup error", "err", err)
+	}
+}
+
+// refreshBuckets 先查找自己,再在比最近的节点更远的空桶中各查找一个随机目标,
+// 只查找自己的时候离自己远的桶只能碰巧遇到节点,桶是空的话查找那边的目标时可能找不到路
+func (s *sp2p) refreshBuckets(ctx context.Context) error {
+	self := s.tab.selfNode.ID
+	if _, err := s.lookup(ctx, self); err != nil {
+		return err
+	}
+
+	nearest := s.tab.findMinDisNodes(self, 1)
+	if len(nearest) == 0 {
+		return nil
+	}
+	for d := logdist(self, nearest[0].ID) + 1; d < nBuckets; d++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if s.tab.buckets[d].size() != 0 {
 			continue
 		}
-		s.writeTx(&KMsg{TAddr: b.random().addrString(), Data: &findNodeReq{N: cfg.FindNodeNUm}, FID: s.tab.selfNode.ID.Hex()})
+		target := hashAtDistance(self, d)
+		if _, err := s.lookup(ctx, target); err != nil {
+			s.l.Debug("refresh bucket error", "target", target.Hex(), "err", err)
+		}
 	}
+	return nil
 }
 
+// accept 接收数据报,一个数据报就是一个完整的消息或者一个分片
 func (s *sp2p) accept() {
-	kb := newKBuffer()
-	logger := getLog()
+	logger := s.l
 	for {
-		buf := make([]byte, cfg.MaxBufLen)
-		n, addr, err := s.conn.ReadFromUDP(buf)
+		buf := make([]byte, s.cfg.MaxBufLen)
+		n, addr, err := s.conn.ReadFrom(buf)
 		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
 			if strings.Contains(err.Error(), "timeout") {
 				logger.Error("timeout", "err", err)
 			} else if err == io.EOF {
@@ -160,31 +696,128 @@ func (s *sp2p) accept() {
 			time.Sleep(time.Second * 2)
 			continue
 		}
-		logger.Debug("udp message", "addr", addr.String())
-		logger.Debug(string(buf))
-		messages := kb.Next(buf[:n])
-		if messages == nil {
+		logger.Debug("udp message", "addr", addr.String(), "len", n)
+
+		// 解码之前先按照源IP限速
+		if err := s.limit.allowIP(addr.IP.String()); err != nil {
+			s.limited(err, "addr", addr.String())
 			continue
 		}
 
-		for _, m := range messages {
-			if m == nil || len(m) == 0 {
+		frame := buf[:n]
+		if n > 0 && frame[0] == fragmentV {
+			frame, err = s.frag.add(addr, frame)
+			if err != nil {
+				s.metrics.incr(&s.metrics.droppedFragment)
+				logger.Debug("drop fragment", "err", err, "addr", addr.String())
 				continue
 			}
-
-			msg := &KMsg{}
-			if err := msg.Decode(m); err != nil {
-				logger.Error("kmsg decode error", "err", err.Error(), "method", "sp2p.accept")
+			// 分片还没有收齐
+			if frame == nil {
 				continue
 			}
+		}
+		s.acceptFrame(addr, frame)
+	}
+}
 
-			// 检查该ID是否已经存在过,防止数据重复发送
-			if _, b := getCfg().cache.Get(msg.ID); b {
-				continue
-			} else {
-				getCfg().cache.SetDefault(msg.ID, true)
-				s.txRC <- msg
-			}
+// acceptFrame 解密、解码并且验证一个完整的数据报,然后交给处理队列
+func (s *sp2p) acceptFrame(addr *net.UDPAddr, frame []byte) {
+	logger := s.l
+	ip := addr.IP.String()
+
+	var (
+		peer Hash
+		err  error
+	)
+	sealed := len(frame) > 0 && frame[0] == sealedV
+	if sealed {
+		frame, peer, err = s.open(addr, frame)
+		if err == errSessionPending {
+			return
+		}
+		if err != nil {
+			s.metrics.incr(&s.metrics.undecryptableMsg)
+			logger.Debug("kmsg decrypt error", "err", err, "addr", addr.String(), "node", peer.Hex())
+			return
+		}
+	}
+
+	// 解密以后的会话节点是可信的,解码之前先按照节点限速
+	if sealed {
+		if err := s.limit.allowNode(peer); err != nil {
+			s.limited(err, "addr", addr.String(), "node", peer.Hex())
+			return
 		}
 	}
+
+	msg := &KMsg{addr: addr}
+	if err := msg.Decode(s.hm, frame); err != nil {
+		switch err {
+		case errUnsignedMsg:
+			s.metrics.incr(&s.metrics.unsignedMsg)
+		case errInvalidSig:
+			s.metrics.incr(&s.metrics.invalidSigMsg)
+		case errUnknownVersion:
+			s.metrics.incr(&s.metrics.unknownVersionMsg)
+		}
+		logger.Error("kmsg decode error", "err", err.Error(), "addr", addr.String(), "method", "sp2p.accept")
+		return
+	}
+
+	// 会话只能传递会话节点自己签名的消息
+	if sealed && msg.FID != peer.Hex() {
+		s.metrics.incr(&s.metrics.invalidSigMsg)
+		logger.Error("kmsg sender mismatch session", "fid", msg.FID, "node", peer.Hex())
+		return
+	}
+	if !sealed && s.cfg.Encrypt && !isHandshake(msg.Data) {
+		s.metrics.incr(&s.metrics.plaintextMsg)
+		logger.Debug("drop plaintext kmsg", "err", errPlaintextMsg, "addr", addr.String())
+		return
+	}
+
+	// 消息类型要解码以后才知道属于哪个子协议,所以按照类型限速放在解码以后;
+	// 明文消息验证了签名以后再按照发送者限速,只有验证过身份的节点会被封禁
+	mt := msgType(msg.Proto, msg.Data.T())
+	if !sealed {
+		if err := s.limit.allowIPType(ip, mt); err != nil {
+			s.limited(err, "addr", addr.String(), "type", mt.Type, "proto", mt.Proto)
+			return
+		}
+		if peer, err = HexID(msg.FID); err != nil {
+			return
+		}
+		if err := s.limit.allowNode(peer); err != nil {
+			s.limited(err, "addr", addr.String(), "node", msg.FID)
+			return
+		}
+	}
+	if err := s.limit.allowNodeType(peer, mt); err != nil {
+		s.limited(err, "addr", addr.String(), "node", peer.Hex(), "type", mt.Type, "proto", mt.Proto)
+		return
+	}
+
+	// 检查该发送者的消息ID是否已经存在过,防止数据重复发送;
+	// 重复的可靠消息如果已经确认过就再确认一次,因为之前的确认可能丢了
+	key := msg.FID + msg.ID
+	if _, b := s.cache.Get(key); b {
+		if _, acked := s.cache.Get(ackKey(key)); msg.Reliable && acked {
+			s.Reply(msg, &ackResp{})
+		}
+		return
+	}
+	s.cache.SetDefault(key, true)
+
+	s.bondPong(msg)
+
+	// 等待中的请求的回复不排队,防止处理函数都在等待回复的时候队列中的回复没有协程处理,
+	// 这样的协程数量不会超过自己发出的请求数量
+	if s.isPending(msg) {
+		s.spawn(func() { s.handle(msg) })
+		return
+	}
+	if err := s.inQ.push(msg, priorityOf(msg.Data)); err != nil {
+		logger.Debug("kmsg handle queue error", "err", err, "type", msg.Data.String(), "from", msg.FID)
+	}
 }
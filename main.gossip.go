@@ -0,0 +1,230 @@
+package sp2p
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const gossipPrefix = "gossip:"
+
+// dedupWindow 消息ID在去重缓存中保存的时间,广播和主题消息超过这个时间以后ID可能已经被忘掉,
+// 所以更旧的消息直接丢弃,不能重放
+const dedupWindow = 10 * time.Minute
+
+var (
+	errMsgStale  = errors.New("message is too old")
+	errMsgFuture = errors.New("message is from the future")
+)
+
+// BroadcastStats 一次广播的覆盖情况,只有开启BroadcastReceipt的时候Reached和Hops才有数据
+type BroadcastStats struct {
+	ID      string
+	StartAt time.Time
+	// 发起者直接发送的节点数量
+	Fanout int
+	// 回复了回执的节点数量
+	Reached int
+	// 最远的跳数
+	MaxHops int
+	// 每个跳数上到达的节点数量
+	Hops map[int]int
+	// 最后一个回执的时间
+	LastAt time.Time
+}
+
+type broadcastStats struct {
+	sync.Mutex
+
+	stats BroadcastStats
+	seen  map[string]bool
+}
+
+// broadcast 发起一次全网广播,返回广播ID
+func (s *sp2p) broadcast(msg *KMsg) (string, error) {
+	if msg.Data == nil {
+		return "", errors.New("broadcast data is nonexistent")
+	}
+	if msg.Proto == "" {
+		msg.Proto = s.hm.protoOf(msg.Data)
+	}
+	if isCoreType(msg.Proto, msg.Data.T()) {
+		return "", errors.New("broadcast data can not be a core packet")
+	}
+
+	data, err := marshalData(msg.Data)
+	if err != nil {
+		return "", err
+	}
+
+	g := &gossipReq{
+		ID:         s.nextID(),
+		Origin:     s.tab.selfNode.ID.Hex(),
+		OriginAddr: s.tab.selfNode.addrString(),
+		Time:       uint64(time.Now().UnixNano()),
+		TTL:        s.cfg.BroadcastTTL,
+		Receipt:    s.cfg.BroadcastReceipt,
+		Proto:      msg.Proto,
+		DT:         msg.Data.T(),
+		Data:       data,
+	}
+	g.Sig = sign(s.cfg.priv, g.signData())
+
+	// 自己发起的广播转回来的时候直接丢弃
+	s.cache.SetDefault(gossipPrefix+g.ID, true)
+
+	bs := &broadcastStats{
+		stats: BroadcastStats{ID: g.ID, StartAt: time.Now(), Hops: make(map[int]int)},
+		seen:  make(map[string]bool),
+	}
+	bs.stats.Fanout = s.forward(g, EmptyHash)
+	s.bstats.SetDefault(g.ID, bs)
+	return g.ID, nil
+}
+
+// forward 把广播转发给NodeBroadcastNumber个随机节点,不发给上一跳和发起者
+func (s *sp2p) forward(g *gossipReq, from Hash) int {
+	if g.TTL <= 0 {
+		return 0
+	}
+
+	fg := *g
+	fg.TTL--
+	fg.Hops++
+
+	sent := 0
+	for _, n := range s.tab.findRandomNodes(s.cfg.NodeBroadcastNumber + 2) {
+		if sent >= s.cfg.NodeBroadcastNumber {
+			break
+		}
+		if n.ID == from || n.ID.Hex() == g.Origin {
+			continue
+		}
+		s.writeTx(&KMsg{TID: n.ID.Hex(), TAddr: n.addrString(), Data: &fg})
+		sent++
+	}
+	return sent
+}
+
+// gossip 处理收到的广播,第一次收到的时候交给广播消息的处理函数并继续转发
+func (s *sp2p) gossip(msg *KMsg, g *gossipReq) {
+	key := gossipPrefix + g.ID
+	if _, ok := s.cache.Get(key); ok {
+		s.metrics.incr(&s.metrics.gossipDupMsg)
+		return
+	}
+
+	origin, err := HexID(g.Origin)
+	if err != nil || verify(origin, g.signData(), g.Sig) != nil {
+		s.metrics.incr(&s.metrics.invalidSigMsg)
+		s.l.Error("gossip signature error", "origin", g.Origin, "from", msg.FID)
+		return
+	}
+	if err := s.fresh(g.Time); err != nil {
+		s.metrics.incr(&s.metrics.staleGossipMsg)
+		s.l.Debug("drop gossip", "err", err, "id", g.ID, "origin", g.Origin)
+		return
+	}
+	s.cache.SetDefault(key, true)
+
+	// 核心消息只能由对方直接发送,不能借广播伪装成发起者发的
+	if isCoreType(g.Proto, g.DT) {
+		s.l.Error("gossip data can not be a core packet", "type", g.DT, "origin", g.Origin)
+		return
+	}
+	data, err := s.hm.newPacket(g.Proto, g.DT)
+	if err != nil {
+		s.l.Error("gossip type error", "err", err, "proto", g.Proto, "origin", g.Origin)
+		return
+	}
+	// TTL不在签名范围内,不能超过自己的BroadcastTTL
+	if g.TTL > s.cfg.BroadcastTTL {
+		g.TTL = s.cfg.BroadcastTTL
+	}
+	if err := unmarshalData(g.Data, data); err != nil {
+		s.l.Error("gossip data decode error", "err", err, "origin", g.Origin)
+		return
+	}
+
+	from, _ := HexID(msg.FID)
+	s.forward(g, from)
+
+	if g.Receipt {
+		s.receipt(g, origin)
+	}
+
+	// 广播的消息看起来是发起者直接发过来的
+	s.handle(&KMsg{Version: msg.Version, ID: g.ID, FID: g.Origin, FAddr: g.OriginAddr, Proto: g.Proto, Data: data})
+}
+
+// receipt 给发起者回复回执,OriginAddr由发起者自己填写,只有和我们完成过ping/pong的地址才回复,
+// 否则一次广播就能让全网向任意地址发送回执,每个发起者的回执还有速率限制
+func (s *sp2p) receipt(g *gossipReq, origin Hash) {
+	if !s.bonded(origin, g.OriginAddr) {
+		s.l.Debug("drop gossip receipt", "err", "origin is not bonded", "id", g.ID, "origin", g.Origin)
+		return
+	}
+	if err := s.limit.allowReceipt(origin); err != nil {
+		s.l.Debug("drop gossip receipt", "err", err, "id", g.ID, "origin", g.Origin)
+		return
+	}
+	s.Write(&KMsg{TID: g.Origin, TAddr: g.OriginAddr, Data: &gossipAck{ID: g.ID, Hops: g.Hops}})
+}
+
+// fresh 广播和主题消息签名的发送时间(纳秒)要在去重窗口之内,留出MaxClockSkew的时钟误差,
+// 这样还能转发的消息的ID一定还在去重缓存中
+func (s *sp2p) fresh(ts uint64) error {
+	if int64(ts) < 0 {
+		return errMsgStale
+	}
+	d := time.Since(time.Unix(0, int64(ts)))
+	if d > dedupWindow-s.cfg.MaxClockSkew {
+		return errMsgStale
+	}
+	if d < -s.cfg.MaxClockSkew {
+		return errMsgFuture
+	}
+	return nil
+}
+
+// gossipReceipt 统计自己发起的广播的回执
+func (s *sp2p) gossipReceipt(msg *KMsg, a *gossipAck) {
+	v, ok := s.bstats.Get(a.ID)
+	if !ok {
+		return
+	}
+
+	bs := v.(*broadcastStats)
+	bs.Lock()
+	defer bs.Unlock()
+
+	if bs.seen[msg.FID] {
+		return
+	}
+	bs.seen[msg.FID] = true
+	bs.stats.Reached++
+	bs.stats.Hops[a.Hops]++
+	if a.Hops > bs.stats.MaxHops {
+		bs.stats.MaxHops = a.Hops
+	}
+	bs.stats.LastAt = time.Now()
+}
+
+// broadcastStats 返回广播统计的一份拷贝
+func (s *sp2p) broadcastStats(id string) (BroadcastStats, bool) {
+	v, ok := s.bstats.Get(id)
+	if !ok {
+		return BroadcastStats{}, false
+	}
+
+	bs := v.(*broadcastStats)
+	bs.Lock()
+	defer bs.Unlock()
+
+	stats := bs.stats
+	stats.Hops = make(map[int]int, len(bs.stats.Hops))
+	for k, v := range bs.stats.Hops {
+		stats.Hops[k] = v
+	}
+	return stats, true
+}
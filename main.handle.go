@@ -0,0 +1,92 @@
+package sp2p
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Peer 发送消息的节点,ID经过签名验证,Addr是接收时观察到的地址
+// 广播和路由过来的消息,Peer是发起者,Addr是发起者声明的地址
+type Peer struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+
+	s   *sp2p
+	msg *KMsg
+}
+
+// Reply 回复这条消息,路由过来的消息沿原路返回
+func (p Peer) Reply(data IPacket) error {
+	if p.s == nil || p.msg == nil {
+		return errors.New("peer has no message to reply")
+	}
+	p.s.Reply(p.msg, data)
+	return nil
+}
+
+type peerKey struct{}
+
+// PeerFromContext 返回处理函数的ctx中保存的发送者
+func PeerFromContext(ctx context.Context) (Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(Peer)
+	return p, ok
+}
+
+// handle 收到的消息经过入站链交给处理函数
+func (s *sp2p) handle(msg *KMsg) {
+	err := s.inbound.handle(s, msg)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrPeerDenied):
+		s.metrics.incr(&s.metrics.deniedMsg)
+		s.l.Debug("kmsg denied", "type", msg.Data.String(), "from", msg.FID)
+	case errors.Is(err, ErrHandlerPanic):
+		s.metrics.incr(&s.metrics.handlerPanic)
+	default:
+		s.l.Error("handle kmsg error", "type", msg.Data.String(), "proto", msg.Proto, "from", msg.FID, "err", err)
+	}
+}
+
+// dispatch 入站链的最后一步,确认可靠消息,回复交给等待中的请求,
+// IMessage自己处理,其它的交给Handle注册的函数
+func (s *sp2p) dispatch(_ ISP2P, msg *KMsg) error {
+	// 通过了入站链才确认可靠消息,被AllowDeny等中间件拒绝的消息不确认,发送者会当作对方不可达
+	if msg.Reliable {
+		s.Reply(msg, &ackResp{})
+		s.cache.SetDefault(ackKey(msg.FID+msg.ID), true)
+	}
+
+	s.reply(msg)
+
+	if m, ok := msg.Data.(IMessage); ok {
+		m.OnHandle(s, msg)
+		return nil
+	}
+
+	var fn HandlerFunc
+	if p := s.hm.protocol(msg.Proto); p != nil {
+		fn = p.handlerFunc(msg.Data.T())
+	}
+	if fn == nil {
+		return errors.New(f("kmsg type %d of %q has no handler", msg.Data.T(), msg.Proto))
+	}
+
+	id, err := HexID(msg.FID)
+	if err != nil {
+		return err
+	}
+	addr := msg.addr
+	if addr == nil {
+		addr, _ = parseUDPAddr(msg.FAddr)
+	}
+
+	peer := Peer{ID: NodeID(id), Addr: addr, s: s, msg: msg}
+	ctx := context.WithValue(s.ctx, peerKey{}, peer)
+	if s.cfg.HandlerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.HandlerTimeout)
+		defer cancel()
+	}
+	return fn(ctx, peer, msg.Data)
+}
@@ -0,0 +1,153 @@
+package sp2p
+
+import (
+	"context"
+	"errors"
+	"math"
+)
+
+// 一个节点查询失败以后还会再查询几次,丢包或者对方忙的时候一次超时不代表节点不在线
+const lookupRetries = 1
+
+var (
+	errTableEmpty = errors.New("lookup error: table is empty")
+	errNoAnswer   = errors.New("lookup error: no node answered")
+)
+
+type lookupReply struct {
+	n     *node
+	nodes []*node
+	done  bool
+	err   error
+}
+
+// lookupFunc 向节点n查询,返回更近的节点,done为true时结束查找
+type lookupFunc func(ctx context.Context, n *node) (nodes []*node, done bool, err error)
+
+// lookup 迭代查找离target最近的k个节点
+func (s *sp2p) lookup(ctx context.Context, target Hash) ([]*node, error) {
+	return s.iterate(ctx, target, func(ctx context.Context, n *node) ([]*node, bool, error) {
+		nodes, err := s.findNode(ctx, n, target)
+		return nodes, false, err
+	})
+}
+
+// iterate 迭代查找的主流程
+// 每轮向Alpha个距离最近且还没有查询过的节点发起查询,把返回的节点合并到候选列表,
+// 直到候选列表中最近的k个节点都已经回复,或者query返回done为止;
+// 查询失败的节点重试lookupRetries次以后移出候选列表,没有任何节点回复的时候返回errNoAnswer
+// 候选列表不限制长度,离得近的节点不在线被移出以后,之前排在后面的节点可以补上
+func (s *sp2p) iterate(ctx context.Context, target Hash, query lookupFunc) ([]*node, error) {
+	var (
+		k       = s.cfg.BucketSize
+		self    = s.tab.selfNode.ID
+		asked   = map[Hash]bool{self: true}
+		seen    = map[Hash]bool{self: true}
+		reply   = make(chan lookupReply, s.cfg.Alpha)
+		pending = 0
+		answers = 0
+		fails   = make(map[Hash]int)
+		result  = &nodesByDistance{target: target, maxElems: math.MaxInt32}
+	)
+	// closest 候选列表中最近的k个节点
+	closest := func() []*node {
+		if len(result.entries) > k {
+			return result.entries[:k]
+		}
+		return result.entries
+	}
+
+	for _, n := range s.tab.findMinDisNodes(target, nBuckets) {
+		seen[n.ID] = true
+		result.push(n)
+	}
+	if len(result.entries) == 0 {
+		return nil, errTableEmpty
+	}
+
+	for {
+		for i := 0; i < len(result.entries) && i < k && pending < s.cfg.Alpha; i++ {
+			n := result.entries[i]
+			if asked[n.ID] {
+				continue
+			}
+			asked[n.ID] = true
+			ok := s.spawn(func() {
+				nodes, done, err := query(ctx, n)
+				reply <- lookupReply{n: n, nodes: nodes, done: done, err: err}
+			})
+			if !ok {
+				return closest(), errClosed
+			}
+			pending++
+		}
+
+		// 最近的k个节点都已经查询过了
+		if pending == 0 {
+			if answers == 0 {
+				return closest(), errNoAnswer
+			}
+			return closest(), nil
+		}
+
+		select {
+		case r := <-reply:
+			pending--
+			if r.err != nil {
+				s.l.Debug("lookup find node error", "node", r.n.string(), "err", r.err)
+				if fails[r.n.ID]++; fails[r.n.ID] > lookupRetries {
+					result.remove(r.n.ID)
+				} else {
+					asked[r.n.ID] = false
+				}
+				continue
+			}
+			answers++
+			if r.done {
+				return closest(), nil
+			}
+			for _, n := range r.nodes {
+				if !seen[n.ID] {
+					seen[n.ID] = true
+					result.push(n)
+				}
+			}
+		case <-ctx.Done():
+			return closest(), ctx.Err()
+		}
+	}
+}
+
+// findNode 向节点n查询离target最近的节点,返回的节点在后台bond
+// 只有自己请求的回复才会去ping里面的节点,其它节点发来的findNodeResp直接忽略
+func (s *sp2p) findNode(ctx context.Context, n *node, target Hash) ([]*node, error) {
+	resp, err := s.bondedRequest(ctx, n, &findNodeReq{N: s.cfg.BucketSize, Target: target.Hex()})
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := resp.Data.(*findNodeResp)
+	if !ok {
+		return nil, errors.New(f("unexpected find node response %s", resp.Data.String()))
+	}
+
+	nodes := parseNodes(data.Nodes)
+	s.bondNodes(nodes)
+	return nodes, nil
+}
+
+// parseNodes 解析回复中的节点列表,忽略不完整的节点
+func parseNodes(rawNodes []string) []*node {
+	nodes := make([]*node, 0, len(rawNodes))
+	for _, raw := range rawNodes {
+		n, err := NodeParse(raw)
+		if err != nil {
+			continue
+		}
+		if err := n.validateComplete(); err != nil {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
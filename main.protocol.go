@@ -0,0 +1,57 @@
+package sp2p
+
+// protocols 自己支持的协议,第一个是内置协议DiscProtocol
+func (s *sp2p) protocols() []string {
+	return s.hm.protocols()
+}
+
+// setPeerProtocols 保存验证过地址的节点在ping/pong中声明的协议,旧版本的节点不声明协议
+func (s *sp2p) setPeerProtocols(id Hash, protos []string) {
+	if len(protos) == 0 {
+		return
+	}
+	if err := checkProtocols(protos); err != nil {
+		s.l.Debug("peer protocols error", "err", err, "node", id.Hex())
+		return
+	}
+	s.peerProtos.SetDefault(id.Hex(), protos)
+}
+
+// checkProtocols 检查对方声明的协议数量和名称长度
+func checkProtocols(protos []string) error {
+	if len(protos) > maxProtocols {
+		return errProtocolList
+	}
+	for _, p := range protos {
+		if len(p) > maxProtocolNameLen {
+			return errProtocolList
+		}
+	}
+	return nil
+}
+
+// peerProtocols 对方声明的协议,没有收到过声明返回nil
+func (s *sp2p) peerProtocols(id string) []string {
+	if v, ok := s.peerProtos.Get(id); ok {
+		return v.([]string)
+	}
+	return nil
+}
+
+// checkProto 对方声明过协议列表并且不包含msg的协议的时候不发送
+func (s *sp2p) checkProto(msg *KMsg) error {
+	if msg.Proto == "" || msg.Proto == DiscProtocol {
+		return nil
+	}
+
+	protos := s.peerProtocols(msg.TID)
+	if protos == nil {
+		return nil
+	}
+	for _, p := range protos {
+		if p == msg.Proto {
+			return nil
+		}
+	}
+	return errUnsupportedProto
+}
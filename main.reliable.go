@@ -0,0 +1,83 @@
+package sp2p
+
+import (
+	"context"
+	"time"
+)
+
+// DeliveryResult 可靠消息的发送结果
+type DeliveryResult int
+
+const (
+	// Delivered 对方确认收到了消息
+	Delivered DeliveryResult = iota
+	// TimedOut ctx被取消或者节点关闭的时候还没有收到确认
+	TimedOut
+	// PeerUnreachable 重发了MaxRetransmits次仍然没有收到确认,或者地址不可用
+	PeerUnreachable
+)
+
+func (r DeliveryResult) String() string {
+	switch r {
+	case Delivered:
+		return "delivered"
+	case TimedOut:
+		return "timed out"
+	case PeerUnreachable:
+		return "peer unreachable"
+	}
+	return f("delivery result %d", int(r))
+}
+
+// ackKey 等待确认的key,和等待回复的消息ID区分开
+func ackKey(id string) string {
+	return "ack:" + id
+}
+
+// writeReliable 发送消息并等待对方确认,没有确认的时候按照指数退避重发
+// 重发的消息使用相同的ID,接收方根据ID去重,但是每次都会回复确认
+func (s *sp2p) writeReliable(ctx context.Context, msg *KMsg) DeliveryResult {
+	if msg.TID == "" || msg.TAddr == "" {
+		return PeerUnreachable
+	}
+	if msg.ID == "" {
+		msg.ID = s.nextID()
+	}
+	msg.Reliable = true
+
+	// 确认使用单独的key等待,这样可靠的请求收到确认以后还能等到真正的回复
+	c := s.addPending(ackKey(msg.ID), msg.TID)
+	defer s.delPending(ackKey(msg.ID))
+
+	timeout := s.cfg.RetransmitTimeout
+	for i := 0; i <= s.cfg.MaxRetransmits; i++ {
+		if err := s.write(msg); err != nil {
+			return PeerUnreachable
+		}
+
+		t := time.NewTimer(timeout)
+		select {
+		case <-c:
+			t.Stop()
+			return Delivered
+		case <-ctx.Done():
+			t.Stop()
+			return TimedOut
+		case <-s.ctx.Done():
+			t.Stop()
+			return TimedOut
+		case <-t.C:
+		}
+
+		s.l.Debug("retransmit kmsg", "id", msg.ID, "to", msg.TAddr, "attempt", i+1)
+		timeout *= 2
+
+		// 对方重启过的时候旧的会话已经无法解密,对方也不会向没有验证过的地址握手,由自己重新握手
+		if s.cfg.Encrypt && !isHandshake(msg.Data) {
+			if id, err := HexID(msg.TID); err == nil {
+				s.rehandshake(id, msg.TAddr)
+			}
+		}
+	}
+	return PeerUnreachable
+}
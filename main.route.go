@@ -0,0 +1,286 @@
+package sp2p
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	routePrefix     = "route:"
+	routePrevPrefix = "route_prev:"
+)
+
+var (
+	errHopLimit  = errors.New("route hop limit exceeded")
+	errNoRoute   = errors.New("route has no reachable next hop")
+	errRouteCore = errors.New("route data can not be a core packet")
+)
+
+// sendTo 把data路由到离target最近的节点,第一跳确认收到以后返回
+func (s *sp2p) sendTo(ctx context.Context, target Hash, data IPacket) error {
+	rm, err := s.newRouteMsg(target, data)
+	if err != nil {
+		return err
+	}
+	return s.route(ctx, rm, true)
+}
+
+// requestTo 路由一个请求,等待目标节点沿原路返回的回复
+// 只接受目标节点自己签名的回复,目标节点不存在的时候离它最近的节点的回复会被丢弃,请求超时
+func (s *sp2p) requestTo(ctx context.Context, target Hash, data IPacket) (*KMsg, error) {
+	rm, err := s.newRouteMsg(target, data)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+
+	c := s.addPending(rm.ID, target.Hex())
+	defer s.delPending(rm.ID)
+
+	if err := s.route(ctx, rm, true); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-c:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, errClosed
+	}
+}
+
+// routeReply 把回复沿请求经过的节点返回给请求者
+func (s *sp2p) routeReply(req *routeMsg, data IPacket) {
+	origin, err := HexID(req.Origin)
+	if err != nil {
+		s.l.Error("route reply origin error", "err", err)
+		return
+	}
+
+	rm, err := s.newRouteMsg(origin, data)
+	if err != nil {
+		s.l.Error("route reply error", "err", err)
+		return
+	}
+	rm.Reply = true
+	rm.RID = req.ID
+	rm.Sig = sign(s.cfg.priv, rm.signData())
+
+	if err := s.route(s.ctx, rm, true); err != nil {
+		s.l.Debug("route reply error", "err", err, "origin", req.Origin)
+	}
+}
+
+func (s *sp2p) newRouteMsg(target Hash, data IPacket) (*routeMsg, error) {
+	if data == nil {
+		return nil, errors.New("route data is nonexistent")
+	}
+
+	proto := s.hm.protoOf(data)
+	if isCoreType(proto, data.T()) {
+		return nil, errRouteCore
+	}
+	b, err := marshalData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rm := &routeMsg{
+		ID:         s.nextID(),
+		Origin:     s.tab.selfNode.ID.Hex(),
+		OriginAddr: s.tab.selfNode.addrString(),
+		Target:     target.Hex(),
+		TTL:        s.cfg.MaxRouteHops,
+		Proto:      proto,
+		DT:         data.T(),
+		Data:       b,
+	}
+	rm.Sig = sign(s.cfg.priv, rm.signData())
+	s.cache.SetDefault(routePrefix+rm.ID, true)
+	return rm, nil
+}
+
+// route 转发路由消息,origin表示自己是发起者
+// 到了目标节点,或者没有比自己离目标更近的活节点的时候在本地处理;
+// 回复消息先按照原路返回,原路上的节点不可达的时候改用贪心路由
+func (s *sp2p) route(ctx context.Context, rm *routeMsg, origin bool) error {
+	self := s.tab.selfNode
+	target, err := HexID(rm.Target)
+	if err != nil {
+		return err
+	}
+	if target == self.ID {
+		return s.routeLocal(rm)
+	}
+	if rm.TTL <= 0 {
+		return errHopLimit
+	}
+
+	if rm.Reply {
+		if prev := s.routePrev(rm); prev != nil && s.routeHop(ctx, rm, prev) {
+			return nil
+		}
+	}
+
+	visited := map[Hash]bool{self.ID: true}
+	if !rm.Reply {
+		for _, n := range parseNodes(rm.Path) {
+			visited[n.ID] = true
+		}
+	}
+
+	if s.routeCloser(ctx, rm, target, visited, s.tab.findNodeWithTargetBySelf(target)) {
+		return nil
+	}
+
+	// 路由表中没有更近的活节点,发起者查找一次再试,避免停在局部最近的节点上;
+	// 转发的节点不查找,否则每一跳都要做一次完整的迭代查找
+	if origin && s.limit.allowRouteLookup() == nil {
+		nodes, _ := s.lookup(ctx, target)
+		if s.routeCloser(ctx, rm, target, visited, nodes) {
+			return nil
+		}
+	}
+
+	// 回复找不到更近的节点就没有办法送到请求者
+	if rm.Reply {
+		return errNoRoute
+	}
+	return s.routeLocal(rm)
+}
+
+// routeCloser 依次尝试比自己离target更近的节点,直到有一个确认收到
+func (s *sp2p) routeCloser(ctx context.Context, rm *routeMsg, target Hash, visited map[Hash]bool, nodes []*node) bool {
+	for _, n := range nodes {
+		if visited[n.ID] || distCmp(target, n.ID, s.tab.selfNode.ID) >= 0 {
+			continue
+		}
+		visited[n.ID] = true
+		if s.routeHop(ctx, rm, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// routePrev 返回回复消息原路上的上一个节点
+// 上一跳是收到请求的时候记录的发送者和它的源地址,不使用请求路径中的地址;
+// 没有验证过的上一跳先ping一次,ping不通返回nil,改用贪心路由
+func (s *sp2p) routePrev(rm *routeMsg) *node {
+	v, ok := s.cache.Get(routePrevPrefix + rm.RID)
+	if !ok {
+		return nil
+	}
+	n := v.(*node)
+	if s.bonded(n.ID, n.addrString()) || s.bond(n) {
+		return n
+	}
+	return nil
+}
+
+// routeHop 可靠发送给下一跳,不可达的时候返回false
+func (s *sp2p) routeHop(ctx context.Context, rm *routeMsg, n *node) bool {
+	fm := *rm
+	fm.TTL--
+	if !rm.Reply {
+		fm.Path = append(append([]string(nil), rm.Path...), s.tab.selfNode.string())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+
+	res := s.writeReliable(ctx, &KMsg{TID: n.ID.Hex(), TAddr: n.addrString(), Data: &fm})
+	if res != Delivered {
+		s.l.Debug("route next hop error", "node", n.string(), "result", res, "target", rm.Target)
+		return false
+	}
+	return true
+}
+
+// routeLocal 在本地处理路由消息,回复交给等待中的请求
+func (s *sp2p) routeLocal(rm *routeMsg) error {
+	// 核心消息只能由对方直接发送
+	if isCoreType(rm.Proto, rm.DT) {
+		return errRouteCore
+	}
+	data, err := s.hm.newPacket(rm.Proto, rm.DT)
+	if err != nil {
+		return err
+	}
+	if err := unmarshalData(rm.Data, data); err != nil {
+		return err
+	}
+
+	// OriginAddr是发起者自己声明的,只使用验证过的地址
+	msg := &KMsg{ID: rm.ID, FID: rm.Origin, Proto: rm.Proto, Data: data}
+	if origin, err := HexID(rm.Origin); err == nil {
+		msg.FAddr, _ = s.tab.bondAddr(origin)
+	}
+	if rm.Reply {
+		// 经过入站链以后交给等待中的请求
+		msg.RID = rm.RID
+	} else {
+		msg.route = rm
+	}
+
+	// 和直接收到的消息一样,等待中的请求的回复直接处理,其它的排队由处理协程处理
+	if s.isPending(msg) {
+		s.handle(msg)
+		return nil
+	}
+	return s.inQ.push(msg, priorityOf(data))
+}
+
+// routed 处理收到的路由消息
+func (s *sp2p) routed(msg *KMsg, rm *routeMsg) {
+	key := routePrefix + rm.ID
+	if _, ok := s.cache.Get(key); ok {
+		s.metrics.incr(&s.metrics.routeLoopMsg)
+		return
+	}
+
+	origin, err := HexID(rm.Origin)
+	if err != nil || verify(origin, rm.signData(), rm.Sig) != nil {
+		s.metrics.incr(&s.metrics.invalidSigMsg)
+		s.l.Error("route signature error", "origin", rm.Origin, "from", msg.FID)
+		return
+	}
+	s.cache.SetDefault(key, true)
+
+	// 记录请求的上一跳,回复按照原路返回
+	if !rm.Reply {
+		if prev, err := nodeFromKMsg(msg); err == nil {
+			s.cache.SetDefault(routePrevPrefix+rm.ID, prev)
+		}
+	}
+
+	// TTL和请求的路径不在签名范围内,经过的跳数加上剩下的跳数不能超过MaxRouteHops
+	if len(rm.Path) > s.cfg.MaxRouteHops {
+		s.l.Debug("route path is too long", "id", rm.ID, "len", len(rm.Path))
+		return
+	}
+	if max := s.cfg.MaxRouteHops - len(rm.Path); rm.TTL > max {
+		rm.TTL = max
+	}
+
+	// 转发会可靠发送和重试,不能占用处理消息的协程
+	select {
+	case s.routeSem <- struct{}{}:
+	default:
+		s.l.Debug("route forward queue is full", "id", rm.ID, "target", rm.Target)
+		return
+	}
+	ok := s.spawn(func() {
+		defer func() { <-s.routeSem }()
+		if err := s.route(s.ctx, rm, false); err != nil {
+			s.l.Debug("route error", "err", err, "id", rm.ID, "target", rm.Target)
+		}
+	})
+	if !ok {
+		<-s.routeSem
+	}
+}
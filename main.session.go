@@ -0,0 +1,574 @@
+package sp2p
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 加密的数据报格式: sealedV(1) + sender id(32) + session id(8) + counter(8) + ciphertext
+// 密文是一个完整的签名数据报,数据报头部作为AEAD的附加数据,
+// 每个方向使用自己的密钥,nonce是4个0字节加上发送者的计数器
+const (
+	sealedV         = byte(0xf1)
+	sessionIDLen    = 8
+	sealedHeaderLen = 1 + len(EmptyHash) + sessionIDLen + 8
+	// 接收的时候记住最近replayWindow个计数器,更旧的数据报直接丢弃
+	replayWindow = 64
+	// 握手cookie的长度
+	cookieLen = 16
+)
+
+var (
+	errNoSession       = errors.New("session is nonexistent")
+	errSessionPending  = errors.New("session is pending")
+	errSessionReplay   = errors.New("sealed frame is replayed")
+	errPlaintextMsg    = errors.New("kmsg is not encrypted")
+	errTooManySessions = errors.New("too many sessions")
+	errHandshakeCookie = errors.New("handshake cookie is required")
+	errHandshakeStale  = errors.New("handshake timestamp is out of range")
+	errHandshakeReplay = errors.New("handshake is replayed")
+)
+
+type sessionID [sessionIDLen]byte
+
+// session 和一个节点之间的对称密钥,由握手双方的临时X25519密钥和节点ID用HKDF推导出来,
+// 发送和接收使用不同的密钥,发送者的计数器作为nonce,接收者用滑动窗口拒绝重放的数据报
+type session struct {
+	peer    Hash
+	id      sessionID
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	created time.Time
+
+	// 已经发送的数据报数量
+	sent uint64
+	// 最近一次加密或者解密的时间(纳秒),会话满了的时候淘汰最久没有使用的
+	used int64
+
+	mu sync.Mutex
+	// 收到的最大计数器,bitmap的第i位表示max-i已经收到过
+	max    uint64
+	bitmap uint64
+}
+
+// newSession initiator表示自己是发起握手的一方
+func newSession(peer Hash, shared, initEph, respEph []byte, initID, respID Hash, initiator bool) (*session, error) {
+	salt := append(append([]byte(nil), initEph...), respEph...)
+	prk, err := hkdf.Extract(sha256.New, shared, salt)
+	if err != nil {
+		return nil, err
+	}
+	ids := string(initID[:]) + string(respID[:])
+
+	sid, err := hkdf.Expand(sha256.New, prk, "sp2p session id"+ids, sessionIDLen)
+	if err != nil {
+		return nil, err
+	}
+	initKey, err := sessionAEAD(prk, "sp2p initiator key"+ids)
+	if err != nil {
+		return nil, err
+	}
+	respKey, err := sessionAEAD(prk, "sp2p responder key"+ids)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	t := &session{peer: peer, send: initKey, recv: respKey, created: now, used: now.UnixNano()}
+	if !initiator {
+		t.send, t.recv = respKey, initKey
+	}
+	copy(t.id[:], sid)
+	return t, nil
+}
+
+func sessionAEAD(prk []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Expand(sha256.New, prk, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sessionNonce(ctr uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], ctr)
+	return nonce
+}
+
+func (t *session) seal(self Hash, frame []byte) []byte {
+	ctr := atomic.AddUint64(&t.sent, 1)
+	atomic.StoreInt64(&t.used, time.Now().UnixNano())
+
+	b := make([]byte, sealedHeaderLen, sealedHeaderLen+len(frame)+t.send.Overhead())
+	b[0] = sealedV
+	copy(b[1:], self[:])
+	copy(b[1+len(self):], t.id[:])
+	binary.BigEndian.PutUint64(b[sealedHeaderLen-8:], ctr)
+	return t.send.Seal(b, sessionNonce(ctr), frame, b[:sealedHeaderLen])
+}
+
+// open 解密数据报,解密成功以后才记录计数器,伪造的数据报不会影响窗口
+func (t *session) open(b []byte) ([]byte, error) {
+	if len(b) < sealedHeaderLen {
+		return nil, errShortFrame
+	}
+	ctr := binary.BigEndian.Uint64(b[sealedHeaderLen-8 : sealedHeaderLen])
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ctr == 0 || !t.fresh(ctr) {
+		return nil, errSessionReplay
+	}
+	frame, err := t.recv.Open(nil, sessionNonce(ctr), b[sealedHeaderLen:], b[:sealedHeaderLen])
+	if err != nil {
+		return nil, err
+	}
+	t.mark(ctr)
+	atomic.StoreInt64(&t.used, time.Now().UnixNano())
+	return frame, nil
+}
+
+// fresh 计数器是否在窗口之内并且没有收到过
+func (t *session) fresh(ctr uint64) bool {
+	if ctr > t.max {
+		return true
+	}
+	d := t.max - ctr
+	return d < replayWindow && t.bitmap&(1<<d) == 0
+}
+
+func (t *session) mark(ctr uint64) {
+	if ctr > t.max {
+		if d := ctr - t.max; d < replayWindow {
+			t.bitmap <<= d
+		} else {
+			t.bitmap = 0
+		}
+		t.max = ctr
+	}
+	t.bitmap |= 1 << (t.max - ctr)
+}
+
+// sessions 发送使用每个节点最新的会话,接收按照会话ID查找,
+// 所以重新握手以后旧的会话在过期之前仍然可以解密,每个节点最多保留两个会话
+// 会话满了以后先淘汰没有完成ping/pong的节点,再淘汰最久没有使用的会话
+type sessions struct {
+	mu sync.Mutex
+
+	cfg *Config
+	// 节点最近是否完成过ping/pong
+	bonded func(id Hash) bool
+	// 生成握手cookie的密钥,只保存在内存中
+	secret []byte
+	peers  map[Hash]*session
+	// 重新握手之前的会话,下一次握手以后删除
+	prev map[Hash]*session
+	ids  map[sessionID]*session
+	// 正在进行的握手,同一个节点同时只有一个
+	dialing map[Hash]*dial
+	// 最近一次因为无法解密而重新握手的时间
+	resets map[Hash]time.Time
+	// 每个节点最近一次接受的握手请求的时间戳,防止重放
+	stamps map[Hash]int64
+}
+
+// dial 正在进行的握手和等待会话的数据报
+type dial struct {
+	parked []parked
+	// 对方收到握手请求以后就可以用新的会话发送,这些数据报可能比握手回复先被读到,
+	// 握手完成以后再解密
+	inbound []parked
+}
+
+type parked struct {
+	addr *net.UDPAddr
+	b    []byte
+}
+
+func newSessions(c *Config) *sessions {
+	secret := make([]byte, 32)
+	if _, err := crand.Read(secret); err != nil {
+		panic(errs("session secret error", err.Error()))
+	}
+	return &sessions{
+		cfg:     c,
+		bonded:  func(Hash) bool { return false },
+		secret:  secret,
+		peers:   make(map[Hash]*session),
+		prev:    make(map[Hash]*session),
+		ids:     make(map[sessionID]*session),
+		dialing: make(map[Hash]*dial),
+		resets:  make(map[Hash]time.Time),
+		stamps:  make(map[Hash]int64),
+	}
+}
+
+// add 保存新的会话,会话数量达到MaxSessions的时候淘汰一个旧的会话
+func (ss *sessions) add(t *session) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if _, ok := ss.peers[t.peer]; !ok && len(ss.peers) >= ss.cfg.MaxSessions {
+		ss.expireLocked()
+		if len(ss.peers) >= ss.cfg.MaxSessions {
+			ss.evictLocked()
+		}
+	}
+
+	if old, ok := ss.prev[t.peer]; ok {
+		delete(ss.ids, old.id)
+		delete(ss.prev, t.peer)
+	}
+	if cur, ok := ss.peers[t.peer]; ok {
+		ss.prev[t.peer] = cur
+	}
+	ss.peers[t.peer] = t
+	ss.ids[t.id] = t
+}
+
+// evictLocked 删除一个节点的所有会话,优先淘汰没有完成ping/pong的节点,其次是最久没有使用的
+func (ss *sessions) evictLocked() {
+	var (
+		victim     Hash
+		victimUsed int64
+		victimBond bool
+		found      bool
+	)
+	for id, t := range ss.peers {
+		used, bonded := atomic.LoadInt64(&t.used), ss.bonded(id)
+		if !found || (victimBond && !bonded) || (victimBond == bonded && used < victimUsed) {
+			victim, victimUsed, victimBond, found = id, used, bonded, true
+		}
+	}
+	if !found {
+		return
+	}
+
+	if t, ok := ss.prev[victim]; ok {
+		delete(ss.ids, t.id)
+		delete(ss.prev, victim)
+	}
+	delete(ss.ids, ss.peers[victim].id)
+	delete(ss.peers, victim)
+	ss.cfg.l.Debug("evict session", "node", victim.Hex(), "bonded", victimBond)
+}
+
+// cookie 握手cookie证明对方能在addr收到我们的数据报,epoch是HandshakeMaxAge的序号
+func (ss *sessions) cookie(id Hash, addr string, epoch int64) []byte {
+	m := hmac.New(sha256.New, ss.secret)
+	m.Write(id[:])
+	m.Write([]byte(addr))
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(epoch))
+	m.Write(b[:])
+	return m.Sum(nil)[:cookieLen]
+}
+
+func (ss *sessions) cookieEpoch() int64 {
+	return time.Now().UnixNano() / int64(ss.cfg.HandshakeMaxAge)
+}
+
+// validCookie 接受当前和上一个epoch的cookie
+func (ss *sessions) validCookie(id Hash, addr string, c []byte) bool {
+	if len(c) != cookieLen {
+		return false
+	}
+	epoch := ss.cookieEpoch()
+	return hmac.Equal(c, ss.cookie(id, addr, epoch)) || hmac.Equal(c, ss.cookie(id, addr, epoch-1))
+}
+
+// stamp 检查握手请求的时间戳,太旧或者不比上一次接受的新的请求是重放
+func (ss *sessions) stamp(peer Hash, ts int64) error {
+	now := time.Now()
+	if d := now.Sub(time.Unix(0, ts)); d > ss.cfg.HandshakeMaxAge || d < -ss.cfg.HandshakeMaxAge {
+		return errHandshakeStale
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	last, ok := ss.stamps[peer]
+	if ok && ts <= last {
+		return errHandshakeReplay
+	}
+	if !ok && len(ss.stamps) >= ss.cfg.MaxSessions {
+		ss.expireLocked()
+		if len(ss.stamps) >= ss.cfg.MaxSessions {
+			// 淘汰最旧的时间戳,它最快过期
+			var oldest Hash
+			min := int64(-1)
+			for id, at := range ss.stamps {
+				if min < 0 || at < min {
+					oldest, min = id, at
+				}
+			}
+			delete(ss.stamps, oldest)
+		}
+	}
+	ss.stamps[peer] = ts
+	return nil
+}
+
+// expire 发送的会话超过SessionTTL就不再使用,接收的会话再保留一个SessionTTL
+func (ss *sessions) expire() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.expireLocked()
+}
+
+func (ss *sessions) expireLocked() {
+	ttl := ss.cfg.SessionTTL
+	for id, t := range ss.peers {
+		if time.Since(t.created) > ttl {
+			delete(ss.peers, id)
+		}
+	}
+	for id, t := range ss.prev {
+		if time.Since(t.created) > 2*ttl {
+			delete(ss.prev, id)
+		}
+	}
+	for id, t := range ss.ids {
+		if time.Since(t.created) > 2*ttl {
+			delete(ss.ids, id)
+		}
+	}
+	for id, at := range ss.resets {
+		if time.Since(at) > ss.cfg.RehandshakeCooldown {
+			delete(ss.resets, id)
+		}
+	}
+	// 超过HandshakeMaxAge的时间戳不需要再记录,更旧的请求会因为太旧被拒绝
+	for id, ts := range ss.stamps {
+		if time.Since(time.Unix(0, ts)) > ss.cfg.HandshakeMaxAge {
+			delete(ss.stamps, id)
+		}
+	}
+}
+
+// sealTo 用和节点的会话加密数据报并发送,还没有会话的时候先暂存,后台握手成功以后再发送,
+// 这样发送协程不会因为等待握手而阻塞
+func (s *sp2p) sealTo(id Hash, addr *net.UDPAddr, b []byte) error {
+	ss := s.sess
+
+	ss.mu.Lock()
+	if t, ok := ss.peers[id]; ok && time.Since(t.created) < s.cfg.SessionTTL {
+		ss.mu.Unlock()
+		return s.writeFrames(t.seal(s.tab.selfNode.ID, b), addr)
+	}
+	defer ss.mu.Unlock()
+
+	d, ok := ss.dialing[id]
+	if !ok && len(ss.dialing) >= s.cfg.MaxSessions {
+		return errTooManySessions
+	}
+	if ok && len(d.parked) >= s.cfg.MaxParkedMsgs {
+		return ErrQueueFull
+	}
+	if !ok {
+		d = s.dialLocked(id, addr.String())
+		if _, ok := ss.dialing[id]; !ok {
+			return errClosed
+		}
+	}
+	d.parked = append(d.parked, parked{addr: addr, b: b})
+	return nil
+}
+
+// dialLocked 在后台和节点握手,已经在握手的时候返回正在进行的握手,调用者需要持有ss.mu
+func (s *sp2p) dialLocked(id Hash, addr string) *dial {
+	ss := s.sess
+	if d, ok := ss.dialing[id]; ok {
+		return d
+	}
+
+	d := &dial{}
+	ss.dialing[id] = d
+	ok := s.spawn(func() {
+		err := s.handshake(id, addr)
+
+		ss.mu.Lock()
+		delete(ss.dialing, id)
+		msgs, inbound := d.parked, d.inbound
+		d.parked, d.inbound = nil, nil
+		t := ss.peers[id]
+		ss.mu.Unlock()
+
+		if err != nil || t == nil {
+			if len(msgs)+len(inbound) != 0 {
+				s.l.Debug("drop kmsgs waiting for handshake", "node", id.Hex(), "num", len(msgs)+len(inbound), "err", err)
+			}
+			return
+		}
+		for _, m := range inbound {
+			s.acceptFrame(m.addr, m.b)
+		}
+		for _, m := range msgs {
+			if err := s.writeFrames(t.seal(s.tab.selfNode.ID, m.b), m.addr); err != nil {
+				s.l.Debug("write parked kmsg error", "node", id.Hex(), "err", err)
+			}
+		}
+	})
+	if !ok {
+		delete(ss.dialing, id)
+	}
+	return d
+}
+
+// handshake 向节点发送临时公钥,收到对方的临时公钥以后建立会话
+func (s *sp2p) handshake(id Hash, addr string) error {
+	priv, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		return err
+	}
+	eph := priv.PublicKey().Bytes()
+
+	// 握手直接发送,不排在发送队列后面
+	// 对方没有验证过我们的地址的时候只回复cookie,带上cookie再发一次
+	var data *handshakeResp
+	var cookie []byte
+	for i := 0; i < 2; i++ {
+		req := &handshakeReq{Eph: eph, Time: uint64(time.Now().UnixNano()), Cookie: cookie}
+		resp, err := s.roundTrip(s.ctx, &KMsg{TID: id.Hex(), TAddr: addr, Data: req}, s.write)
+		if err != nil {
+			return errors.New(errs("handshake error", err.Error()))
+		}
+		var ok bool
+		if data, ok = resp.Data.(*handshakeResp); !ok {
+			return errors.New("handshake response type error")
+		}
+		if len(data.Eph) != 0 || len(data.Cookie) == 0 {
+			break
+		}
+		cookie = data.Cookie
+	}
+	if len(data.Eph) == 0 {
+		return errHandshakeCookie
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(data.Eph)
+	if err != nil {
+		return err
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return err
+	}
+
+	t, err := newSession(id, shared, eph, data.Eph, s.tab.selfNode.ID, id, true)
+	if err != nil {
+		return err
+	}
+	s.sess.add(t)
+	s.l.Debug("session established", "node", id.Hex(), "addr", addr)
+	return nil
+}
+
+// acceptHandshake 响应握手,建立会话并返回自己的临时公钥
+// 对方的地址没有完成过ping/pong,也没有带上有效的cookie的时候不建立会话,返回cookie让对方重发,
+// 这样伪造源地址或者只发不收的节点不能占用会话
+func (s *sp2p) acceptHandshake(msg *KMsg, req *handshakeReq) (*handshakeResp, error) {
+	id, err := HexID(msg.FID)
+	if err != nil {
+		return nil, err
+	}
+	addr := msg.SrcAddr()
+	if !s.bonded(id, addr) && !s.sess.validCookie(id, addr, req.Cookie) {
+		return &handshakeResp{Cookie: s.sess.cookie(id, addr, s.sess.cookieEpoch())}, nil
+	}
+	if err := s.sess.stamp(id, int64(req.Time)); err != nil {
+		return nil, err
+	}
+
+	eph := req.Eph
+	pub, err := ecdh.X25519().NewPublicKey(eph)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	own := priv.PublicKey().Bytes()
+	t, err := newSession(id, shared, eph, own, id, s.tab.selfNode.ID, false)
+	if err != nil {
+		return nil, err
+	}
+	s.sess.add(t)
+	return &handshakeResp{Eph: own}, nil
+}
+
+// open 解密数据报,返回里面的签名数据报和发送者ID
+// 正在和对方握手的时候暂存数据报,握手完成以后再解密;
+// 否则找不到会话说明对方或者自己重启过,向验证过的地址重新握手,
+// 数据报头部没有认证,所以这里不能删除已有的会话
+func (s *sp2p) open(addr *net.UDPAddr, b []byte) ([]byte, Hash, error) {
+	if len(b) < sealedHeaderLen {
+		return nil, EmptyHash, errShortFrame
+	}
+
+	peer := BytesToHash(b[1 : 1+len(EmptyHash)])
+	var sid sessionID
+	copy(sid[:], b[1+len(EmptyHash):sealedHeaderLen])
+
+	ss := s.sess
+	ss.mu.Lock()
+	t, ok := ss.ids[sid]
+	if d, dialing := ss.dialing[peer]; !ok && dialing && len(d.inbound) < s.cfg.MaxParkedMsgs {
+		d.inbound = append(d.inbound, parked{addr: addr, b: b})
+		ss.mu.Unlock()
+		return nil, peer, errSessionPending
+	}
+	ss.mu.Unlock()
+	if !ok || t.peer != peer {
+		if s.bonded(peer, addr.String()) {
+			s.rehandshake(peer, addr.String())
+		}
+		return nil, peer, errNoSession
+	}
+
+	frame, err := t.open(b)
+	return frame, peer, err
+}
+
+// rehandshake 和节点重新握手,成功以后新的会话替换旧的,RehandshakeCooldown内最多一次
+func (s *sp2p) rehandshake(peer Hash, addr string) {
+	ss := s.sess
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if at, ok := ss.resets[peer]; ok && time.Since(at) < s.cfg.RehandshakeCooldown {
+		return
+	}
+	if len(ss.resets) >= s.cfg.MaxSessions {
+		ss.expireLocked()
+		if len(ss.resets) >= s.cfg.MaxSessions {
+			return
+		}
+	}
+	ss.resets[peer] = time.Now()
+	s.dialLocked(peer, addr)
+}
@@ -0,0 +1,286 @@
+package sp2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kooksee/kdb"
+)
+
+var (
+	errNotFound      = errors.New("value not found")
+	errValueTooLarge = errors.New("value exceeds MaxValueSize")
+	errValueStale    = errors.New("value is older than the stored value")
+	errValueFuture   = errors.New("value time is too far in the future")
+	errValueExpired  = errors.New("value is expired")
+	errValueEmpty    = errors.New("value is empty")
+)
+
+// kvKey 数据在DHT中的位置是key的sha256
+func kvKey(key []byte) Hash {
+	return Hash(sha256.Sum256(key))
+}
+
+// newerValue 写入时间新的值覆盖旧的值,时间相同的时候字节序大的覆盖小的,
+// 这样所有节点收到同样的写入以后保留的值相同
+func newerValue(v []byte, ts uint64, old []byte, oldTs uint64) bool {
+	if ts != oldTs {
+		return ts > oldTs
+	}
+	return bytes.Compare(v, old) > 0
+}
+
+// kvExpired 值在写入ValueExpiration以后过期,转发和重新复制都不会改变写入时间
+func (t *Config) kvExpired(ts uint64) bool {
+	return time.Since(time.Unix(0, int64(ts))) > t.ValueExpiration
+}
+
+func (t *Config) kvHash() *kdb.KHash {
+	return t.db.KHash(t.dbPrefix([]byte(t.KVPrefix)))
+}
+
+// kvGet 返回保存的值和它的写入时间(纳秒),kdb中保存的是8个字节的写入时间加上值,过期的值当作不存在
+func (t *Config) kvGet(k Hash) ([]byte, uint64, error) {
+	b, err := t.kvHash().Get(k.Bytes())
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(b) <= 8 {
+		return nil, 0, errNotFound
+	}
+	ts := binary.BigEndian.Uint64(b)
+	if t.kvExpired(ts) {
+		return nil, 0, errNotFound
+	}
+	return b[8:], ts, nil
+}
+
+type kvRecord struct {
+	key   Hash
+	value []byte
+	ts    uint64
+}
+
+// kvLive 返回所有没有过期的值,同时删除已经过期的值
+func (t *Config) kvLive() []kvRecord {
+	t.kvMu.Lock()
+	defer t.kvMu.Unlock()
+
+	h := t.kvHash()
+	live := make([]kvRecord, 0)
+	expired := make([][]byte, 0)
+	if err := h.Range(func(key, value []byte) error {
+		if len(key) != len(EmptyHash) || len(value) <= 8 || t.kvExpired(binary.BigEndian.Uint64(value)) {
+			expired = append(expired, append([]byte(nil), key...))
+			return nil
+		}
+		live = append(live, kvRecord{
+			key:   BytesToHash(key),
+			value: append([]byte(nil), value[8:]...),
+			ts:    binary.BigEndian.Uint64(value),
+		})
+		return nil
+	}); err != nil {
+		t.l.Error("range kv error", "err", err)
+	}
+
+	if len(expired) != 0 {
+		if err := h.MDel(expired...); err != nil {
+			t.l.Error("delete expired kv error", "err", err)
+		}
+	}
+	return live
+}
+
+// kvSet 保存数据,已经保存的值比它新的时候返回errValueStale,相同的值重复写入不是错误
+// 空值不能保存,查询的时候空值和不存在没有办法区分
+func (t *Config) kvSet(k Hash, value []byte, ts uint64) error {
+	if len(value) == 0 {
+		return errValueEmpty
+	}
+	if len(value) > t.MaxValueSize {
+		return errValueTooLarge
+	}
+	if int64(ts) < 0 || time.Until(time.Unix(0, int64(ts))) > t.MaxClockSkew {
+		return errValueFuture
+	}
+	if t.kvExpired(ts) {
+		return errValueExpired
+	}
+
+	t.kvMu.Lock()
+	defer t.kvMu.Unlock()
+
+	if old, oldTs, err := t.kvGet(k); err == nil {
+		if oldTs == ts && bytes.Equal(old, value) {
+			return nil
+		}
+		if !newerValue(value, ts, old, oldTs) {
+			return errValueStale
+		}
+	}
+
+	b := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(b, ts)
+	return t.kvHash().Set(k.Bytes(), append(b, value...))
+}
+
+// responsible 路由表中比自己离k近的节点不到BucketSize个的时候,自己是离k最近的BucketSize个节点之一
+func (s *sp2p) responsible(k Hash) bool {
+	closer := 0
+	for _, n := range s.tab.findMinDisNodes(k, s.cfg.BucketSize) {
+		if distCmp(k, n.ID, s.tab.selfNode.ID) < 0 {
+			closer++
+		}
+	}
+	return closer < s.cfg.BucketSize
+}
+
+// put 把数据复制到离key最近的BucketSize个节点,至少StoreAckNum个节点确认以后才返回
+// 写入时间是本地时间,同一个key最后写入的值覆盖之前的值,已经有更新的值的节点不会确认;
+// 值在写入ValueExpiration以后过期,需要继续保存的时候在过期之前重新put
+func (s *sp2p) put(ctx context.Context, key, value []byte) error {
+	k := kvKey(key)
+	ts := uint64(time.Now().UnixNano())
+
+	if err := s.cfg.kvSet(k, value, ts); err != nil {
+		return err
+	}
+
+	nodes, err := s.lookup(ctx, k)
+	if len(nodes) == 0 {
+		if err == nil {
+			err = errors.New("put error: no node to store")
+		}
+		return err
+	}
+	if len(nodes) > s.cfg.BucketSize {
+		nodes = nodes[:s.cfg.BucketSize]
+	}
+
+	acks := make(chan error, len(nodes))
+	for _, n := range nodes {
+		n := n
+		if !s.spawn(func() {
+			_, err := s.bondedRequest(ctx, n, &storeReq{Key: k.Hex(), Value: value, Time: ts})
+			acks <- err
+		}) {
+			acks <- errClosed
+		}
+	}
+
+	ackN := 0
+	for range nodes {
+		if err := <-acks; err != nil {
+			s.l.Debug("store ack error", "key", k.Hex(), "err", err)
+			continue
+		}
+		if ackN++; ackN >= s.cfg.StoreAckNum {
+			return nil
+		}
+	}
+	return errors.New(f("put error: %d acks, want %d", ackN, s.cfg.StoreAckNum))
+}
+
+// get 向离key越来越近的节点发送findValueReq,收到StoreAckNum个值以后返回其中最新的值,
+// 本地保存的值也算一个,查找结束的时候不够StoreAckNum个就返回已经收到的最新的值
+func (s *sp2p) get(ctx context.Context, key []byte) ([]byte, error) {
+	k := kvKey(key)
+
+	var (
+		value []byte
+		ts    uint64
+		found int
+		mu    sync.Mutex
+	)
+	// add 记录收到的值,够StoreAckNum个的时候返回true
+	add := func(v []byte, t uint64) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if value == nil || newerValue(v, t, value, ts) {
+			value, ts = v, t
+		}
+		found++
+		return found >= s.cfg.StoreAckNum
+	}
+
+	if v, t, err := s.cfg.kvGet(k); err == nil && len(v) != 0 && add(v, t) {
+		return v, nil
+	}
+
+	_, err := s.iterate(ctx, k, func(ctx context.Context, n *node) ([]*node, bool, error) {
+		resp, err := s.bondedRequest(ctx, n, &findValueReq{Key: k.Hex()})
+		if err != nil {
+			return nil, false, err
+		}
+
+		data, ok := resp.Data.(*findValueResp)
+		if !ok {
+			return nil, false, errors.New(f("unexpected find value response %s", resp.Data.String()))
+		}
+		if len(data.Value) != 0 {
+			return nil, add(data.Value, data.Time), nil
+		}
+		return parseNodes(data.Nodes), false, nil
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if value != nil {
+		return value, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, errNotFound
+}
+
+// republish 把本地保存的没有过期的值重新复制到现在离key最近的BucketSize个节点,
+// 节点上下线以后值还在离key最近的节点上;写入时间不变,所以值还是在写入ValueExpiration以后过期
+func (s *sp2p) republish() {
+	// 值很多的时候一次复制可能超过RepublishInterval,上一次没有结束的时候跳过
+	if !atomic.CompareAndSwapInt32(&s.republishing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.republishing, 0)
+
+	for _, r := range s.cfg.kvLive() {
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		nodes, err := s.lookup(s.ctx, r.key)
+		if len(nodes) == 0 {
+			s.l.Debug("republish lookup error", "key", r.key.Hex(), "err", err)
+			continue
+		}
+		if len(nodes) > s.cfg.BucketSize {
+			nodes = nodes[:s.cfg.BucketSize]
+		}
+
+		var wg sync.WaitGroup
+		for _, n := range nodes {
+			if n.ID == s.tab.selfNode.ID {
+				continue
+			}
+			n, r := n, r
+			wg.Add(1)
+			if !s.spawn(func() {
+				defer wg.Done()
+				if _, err := s.bondedRequest(s.ctx, n, &storeReq{Key: r.key.Hex(), Value: r.value, Time: r.ts}); err != nil {
+					s.l.Debug("republish error", "key", r.key.Hex(), "node", n.string(), "err", err)
+				}
+			}) {
+				wg.Done()
+			}
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,473 @@
+package sp2p
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+const topicPrefix = "topic:"
+
+var (
+	errNoSubscriber = errors.New("topic has no subscriber")
+	errTopicName    = errors.New("topic name is too long")
+)
+
+// Message 订阅的主题上收到的消息
+type Message struct {
+	ID    string
+	Topic string
+	// 发布者的节点ID
+	From    NodeID
+	Payload []byte
+}
+
+// topicKey 主题的汇合点是离hash(topic)最近的节点
+func topicKey(topic string) Hash {
+	return Hash(sha256.Sum256([]byte(topicPrefix + topic)))
+}
+
+// subscription 本地对一个主题的订阅,mesh是转发消息的订阅者
+type subscription struct {
+	chans map[int]chan Message
+	next  int
+	mesh  map[Hash]*node
+}
+
+type member struct {
+	n      *node
+	expire time.Time
+}
+
+type topics struct {
+	sync.Mutex
+
+	// 本地的订阅
+	subs map[string]*subscription
+	// 作为汇合点保存的订阅者,以及每个节点注册的主题数量
+	members map[string]map[Hash]*member
+	joined  map[Hash]int
+}
+
+func newTopics() *topics {
+	return &topics{
+		subs:    make(map[string]*subscription),
+		members: make(map[string]map[Hash]*member),
+		joined:  make(map[Hash]int),
+	}
+}
+
+// addMember 记录主题的订阅者,超过主题数量、每个主题的订阅者数量或者节点的主题数量的时候返回false
+func (tp *topics) addMember(c *Config, topic string, n *node) bool {
+	expire := time.Now().Add(c.TopicExpiration)
+	ms, ok := tp.members[topic]
+	if ok {
+		if m, ok := ms[n.ID]; ok {
+			m.n, m.expire = n, expire
+			return true
+		}
+	} else if len(tp.members) >= c.MaxTopics {
+		return false
+	}
+	if len(ms) >= c.MaxTopicMembers || tp.joined[n.ID] >= c.MaxTopicsPerNode {
+		return false
+	}
+
+	if !ok {
+		ms = make(map[Hash]*member)
+		tp.members[topic] = ms
+	}
+	ms[n.ID] = &member{n: n, expire: expire}
+	tp.joined[n.ID]++
+	return true
+}
+
+// delMember 删除主题的订阅者,主题没有订阅者以后一起删除
+func (tp *topics) delMember(topic string, id Hash) {
+	ms, ok := tp.members[topic]
+	if !ok {
+		return
+	}
+	if _, ok := ms[id]; ok {
+		delete(ms, id)
+		if tp.joined[id]--; tp.joined[id] <= 0 {
+			delete(tp.joined, id)
+		}
+	}
+	if len(ms) == 0 {
+		delete(tp.members, topic)
+	}
+}
+
+// subscribe 订阅主题,第一次订阅的时候向汇合点注册并建立mesh
+func (s *sp2p) subscribe(topic string) (<-chan Message, func()) {
+	tp := s.topics
+	c := make(chan Message, s.cfg.TopicBufferSize)
+
+	tp.Lock()
+	sub, ok := tp.subs[topic]
+	if !ok {
+		sub = &subscription{chans: make(map[int]chan Message), mesh: make(map[Hash]*node)}
+		tp.subs[topic] = sub
+	}
+	id := sub.next
+	sub.next++
+	sub.chans[id] = c
+	tp.Unlock()
+
+	if !ok {
+		s.spawn(func() { s.joinTopic(topic) })
+	}
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() { s.unsubscribe(topic, id) })
+	}
+}
+
+// unsubscribe 关闭订阅的channel,最后一个订阅取消以后离开主题
+func (s *sp2p) unsubscribe(topic string, id int) {
+	tp := s.topics
+
+	tp.Lock()
+	sub, ok := tp.subs[topic]
+	if !ok {
+		tp.Unlock()
+		return
+	}
+	if c, ok := sub.chans[id]; ok {
+		delete(sub.chans, id)
+		close(c)
+	}
+	if len(sub.chans) != 0 {
+		tp.Unlock()
+		return
+	}
+	delete(tp.subs, topic)
+	tp.Unlock()
+
+	for _, n := range sub.mesh {
+		s.writeTx(&KMsg{TID: n.ID.Hex(), TAddr: n.addrString(), Data: &topicGraft{Topic: topic, Prune: true}})
+	}
+	s.spawn(func() { s.topicRendezvous(topic, topicLeave) })
+}
+
+// topicRendezvous 向主题的汇合点发送topicReq,返回所有汇合点知道的订阅者
+func (s *sp2p) topicRendezvous(topic string, op byte) ([]*node, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, 3*s.cfg.RequestTimeout)
+	defer cancel()
+
+	nodes, err := s.lookup(ctx, topicKey(topic))
+	if len(nodes) == 0 {
+		return nil, err
+	}
+	if len(nodes) > s.cfg.NodePartitionNumber {
+		nodes = nodes[:s.cfg.NodePartitionNumber]
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		peers = make(map[Hash]*node)
+	)
+	for _, n := range nodes {
+		n := n
+		wg.Add(1)
+		ok := s.spawn(func() {
+			defer wg.Done()
+
+			resp, err := s.bondedRequest(ctx, n, &topicReq{Topic: topic, Op: op})
+			if err != nil {
+				s.l.Debug("topic request error", "topic", topic, "node", n.string(), "err", err)
+				return
+			}
+			data, ok := resp.Data.(*topicResp)
+			if !ok {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, p := range parseNodes(data.Peers) {
+				if p.ID != s.tab.selfNode.ID {
+					peers[p.ID] = p
+				}
+			}
+		})
+		if !ok {
+			wg.Done()
+		}
+	}
+	wg.Wait()
+
+	res := make([]*node, 0, len(peers))
+	for _, p := range peers {
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+// joinTopic 向汇合点注册,用返回的订阅者补充mesh,并且丢掉已经不在订阅者列表中的节点
+func (s *sp2p) joinTopic(topic string) {
+	peers, err := s.topicRendezvous(topic, topicJoin)
+	if err != nil {
+		s.l.Warn("join topic error", "topic", topic, "err", err)
+		return
+	}
+
+	known := make(map[Hash]bool, len(peers))
+	for _, p := range peers {
+		known[p.ID] = true
+	}
+
+	tp := s.topics
+	tp.Lock()
+	sub, ok := tp.subs[topic]
+	if !ok {
+		tp.Unlock()
+		return
+	}
+	for id := range sub.mesh {
+		if !known[id] {
+			delete(sub.mesh, id)
+		}
+	}
+
+	grafts := make([]*node, 0)
+	for _, i := range randPerm(len(peers)) {
+		if len(sub.mesh) >= s.cfg.TopicMeshSize {
+			break
+		}
+		if p := peers[i]; sub.mesh[p.ID] == nil {
+			sub.mesh[p.ID] = p
+			grafts = append(grafts, p)
+		}
+	}
+	tp.Unlock()
+
+	for _, n := range grafts {
+		s.writeTx(&KMsg{TID: n.ID.Hex(), TAddr: n.addrString(), Data: &topicGraft{Topic: topic}})
+	}
+}
+
+// refreshTopics 在汇合点过期之前重新注册所有订阅的主题,同时清理过期的订阅者
+func (s *sp2p) refreshTopics() {
+	tp := s.topics
+
+	tp.Lock()
+	now := time.Now()
+	for topic, ms := range tp.members {
+		for id, m := range ms {
+			if now.After(m.expire) {
+				tp.delMember(topic, id)
+			}
+		}
+	}
+
+	topics := make([]string, 0, len(tp.subs))
+	for topic := range tp.subs {
+		topics = append(topics, topic)
+	}
+	tp.Unlock()
+
+	for _, topic := range topics {
+		s.joinTopic(topic)
+	}
+}
+
+// topicMembers 作为汇合点处理topicReq,返回最多16个其它订阅者
+func (s *sp2p) topicMembers(n *node, req *topicReq) []string {
+	if len(req.Topic) > s.cfg.MaxTopicNameLen {
+		return nil
+	}
+
+	tp := s.topics
+	tp.Lock()
+	defer tp.Unlock()
+
+	switch req.Op {
+	case topicJoin:
+		tp.addMember(s.cfg, req.Topic, n)
+	case topicLeave:
+		tp.delMember(req.Topic, n.ID)
+		return nil
+	}
+	ms := tp.members[req.Topic]
+
+	peers := make([]string, 0)
+	now := time.Now()
+	for _, m := range ms {
+		if len(peers) >= 16 {
+			break
+		}
+		if m.n.ID != n.ID && now.Before(m.expire) {
+			peers = append(peers, m.n.string())
+		}
+	}
+	return peers
+}
+
+// topicGraft 订阅了这个主题的时候才把对方加到mesh中,调用者需要先验证对方的地址
+func (s *sp2p) topicGraft(n *node, g *topicGraft) {
+	tp := s.topics
+	tp.Lock()
+	defer tp.Unlock()
+
+	sub, ok := tp.subs[g.Topic]
+	if !ok {
+		return
+	}
+	if g.Prune {
+		delete(sub.mesh, n.ID)
+		return
+	}
+	// 被动加入的节点最多是TopicMeshSize的两倍
+	if len(sub.mesh) < 2*s.cfg.TopicMeshSize {
+		sub.mesh[n.ID] = n
+	}
+}
+
+// publish 把消息发布到主题,自己订阅了就发给mesh,否则通过汇合点找到订阅者
+func (s *sp2p) publish(topic string, payload []byte) error {
+	if len(topic) > s.cfg.MaxTopicNameLen {
+		return errTopicName
+	}
+
+	m := &topicMsg{
+		ID:         s.nextID(),
+		Topic:      topic,
+		Origin:     s.tab.selfNode.ID.Hex(),
+		OriginAddr: s.tab.selfNode.addrString(),
+		Time:       uint64(time.Now().UnixNano()),
+		TTL:        s.cfg.BroadcastTTL,
+		Payload:    payload,
+	}
+	m.Sig = sign(s.cfg.priv, m.signData())
+	s.cache.SetDefault(topicPrefix+m.ID, true)
+
+	local := s.topicLocal(m)
+	targets := s.topicMesh(topic)
+	if targets == nil {
+		peers, err := s.topicRendezvous(topic, topicPeers)
+		if err != nil && !local {
+			return err
+		}
+		for _, i := range randPerm(len(peers)) {
+			if len(targets) >= s.cfg.TopicMeshSize {
+				break
+			}
+			targets = append(targets, peers[i])
+		}
+	}
+	if len(targets) == 0 && !local {
+		return errNoSubscriber
+	}
+
+	s.topicForward(m, targets, EmptyHash)
+	return nil
+}
+
+// topicMesh 返回主题的mesh,没有订阅的时候返回nil
+func (s *sp2p) topicMesh(topic string) []*node {
+	tp := s.topics
+	tp.Lock()
+	defer tp.Unlock()
+
+	sub, ok := tp.subs[topic]
+	if !ok {
+		return nil
+	}
+	nodes := make([]*node, 0, len(sub.mesh))
+	for _, n := range sub.mesh {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// topicLocal 交给本地的订阅者,channel满了就丢弃
+func (s *sp2p) topicLocal(m *topicMsg) bool {
+	tp := s.topics
+	tp.Lock()
+	defer tp.Unlock()
+
+	sub, ok := tp.subs[m.Topic]
+	if !ok {
+		return false
+	}
+
+	from, _ := HexID(m.Origin)
+	msg := Message{ID: m.ID, Topic: m.Topic, From: NodeID(from), Payload: m.Payload}
+	for _, c := range sub.chans {
+		select {
+		case c <- msg:
+		default:
+			s.metrics.incr(&s.metrics.droppedTopicMsg)
+		}
+	}
+	return true
+}
+
+func (s *sp2p) topicForward(m *topicMsg, nodes []*node, from Hash) {
+	if m.TTL <= 0 {
+		return
+	}
+
+	fm := *m
+	fm.TTL--
+	for _, n := range nodes {
+		if n.ID == from || n.ID.Hex() == m.Origin {
+			continue
+		}
+		s.writeTx(&KMsg{TID: n.ID.Hex(), TAddr: n.addrString(), Data: &fm})
+	}
+}
+
+// topicDeliver 处理mesh中转发过来的消息
+func (s *sp2p) topicDeliver(msg *KMsg, m *topicMsg) {
+	key := topicPrefix + m.ID
+	if _, ok := s.cache.Get(key); ok {
+		return
+	}
+
+	origin, err := HexID(m.Origin)
+	if err != nil || verify(origin, m.signData(), m.Sig) != nil {
+		s.metrics.incr(&s.metrics.invalidSigMsg)
+		s.l.Error("topic message signature error", "origin", m.Origin, "from", msg.FID)
+		return
+	}
+	if err := s.fresh(m.Time); err != nil {
+		s.metrics.incr(&s.metrics.staleTopicMsg)
+		s.l.Debug("drop topic message", "err", err, "id", m.ID, "origin", m.Origin)
+		return
+	}
+	s.cache.SetDefault(key, true)
+
+	// TTL不在签名范围内,不能超过自己的BroadcastTTL
+	if m.TTL > s.cfg.BroadcastTTL {
+		m.TTL = s.cfg.BroadcastTTL
+	}
+
+	// 已经不订阅了,让对方把自己从mesh中去掉
+	if !s.topicLocal(m) {
+		s.Reply(msg, &topicGraft{Topic: m.Topic, Prune: true})
+		return
+	}
+
+	from, _ := HexID(msg.FID)
+	s.topicForward(m, s.topicMesh(m.Topic), from)
+}
+
+// close 关闭所有订阅的channel
+func (tp *topics) close() {
+	tp.Lock()
+	defer tp.Unlock()
+
+	for topic, sub := range tp.subs {
+		for _, c := range sub.chans {
+			close(c)
+		}
+		delete(tp.subs, topic)
+	}
+}
@@ -0,0 +1,207 @@
+package sp2p
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kooksee/kdb"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "sp2p-test")
+	if err != nil {
+		panic(err)
+	}
+	kdb.InitKdb(dir)
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testNodes 创建过的测试节点数量,用来区分同一个测试多次运行时的Namespace
+var testNodes int64
+
+// newTestNode 在模拟网络上创建一个节点,所有测试节点共享一个kdb,每个节点使用自己的Namespace,
+// 不会恢复别的节点保存的路由表
+// opts在默认配置上修改,比如设置种子节点
+func newTestNode(t testing.TB, sn *SimNetwork, addr *net.UDPAddr, opts ...func(c *Config)) *sp2p {
+	t.Helper()
+
+	tr, err := sn.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := log15.New()
+	l.SetHandler(log15.DiscardHandler())
+
+	c := NewConfig()
+	c.InitLog(l)
+	c.InitDb(kdb.GetKdb())
+	c.Namespace = f("%s/%d/", addr, atomic.AddInt64(&testNodes, 1))
+	c.Transport = tr
+	c.MinNodeSize = 0
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	p, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p.(*sp2p)
+}
+
+func testAddr(i int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 8080}
+}
+
+// hasNode 节点id是否在s的路由表中
+func hasNode(s *sp2p, id Hash) bool {
+	for _, n := range s.tab.getAllNodes() {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// waitFor 等待cond成立,超时以后测试失败
+func waitFor(t testing.TB, timeout time.Duration, msg string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitBootstrap 等待节点启动时的引导结束,之后手动加到路由表的节点不会被引导查找打乱
+func waitBootstrap(t testing.TB, s *sp2p) {
+	t.Helper()
+
+	waitFor(t, 5*time.Second, "bootstrap did not finish", func() bool {
+		st := s.GetBootstrapStatus()
+		return st.Rounds > 0 && !st.Running
+	})
+}
+
+// settle 等待模拟网络安静下来: 没有在路上的数据报并且所有节点都读完了接收队列,
+// 连续多次检查都安静才返回,这样节点处理收到的消息时发出的数据报也已经投递完了
+func settle(t testing.TB, sn *SimNetwork) {
+	t.Helper()
+
+	quiet := 0
+	waitFor(t, 30*time.Second, "sim network did not settle", func() bool {
+		if sn.Idle() {
+			quiet++
+		} else {
+			quiet = 0
+		}
+		return quiet >= 5
+	})
+}
+
+func TestPingAndFindNode(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1))
+	b := newTestNode(t, sn, testAddr(2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rtt, err := a.PingNode(ctx, b.Self())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("rtt = %v, want > 0", rtt)
+	}
+
+	// b收到ping以后会反向ping a,完成以后双方互相加到路由表中
+	aid, bid := a.tab.selfNode.ID, b.tab.selfNode.ID
+	waitFor(t, 5*time.Second, "nodes did not bond", func() bool {
+		return hasNode(a, bid) && hasNode(b, aid)
+	})
+
+	// b的路由表中只有a,查找离a最近的节点应该返回a
+	nodes, err := a.findNode(ctx, b.tab.selfNode, aid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].ID != aid {
+		t.Fatalf("findNode returned %d nodes, want a", len(nodes))
+	}
+
+	if _, err := a.Lookup(ctx, NodeID(bid)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Lookup(ctx, NodeID(aid)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !hasNode(a, bid) {
+		t.Fatal("b is not in a's table")
+	}
+	if !hasNode(b, aid) {
+		t.Fatal("a is not in b's table")
+	}
+}
+
+// testMsg 和 testReply 测试用的应用消息,使用json编码
+type testMsg struct {
+	Text string `json:"text"`
+}
+
+func (t *testMsg) T() byte        { return 0x40 }
+func (t *testMsg) String() string { return "testMsg" }
+
+type testReply struct {
+	Text string `json:"text"`
+}
+
+func (t *testReply) T() byte        { return 0x41 }
+func (t *testReply) String() string { return "testReply" }
+
+// Close以后用同一个Config创建的节点有自己的定时器和去重缓存
+func TestConfigReuse(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	var c *Config
+	a := newTestNode(t, sn, testAddr(1), func(cfg *Config) {
+		cfg.MinNodeSize = 1
+		cfg.BootstrapInterval = 20 * time.Millisecond
+		c = cfg
+	})
+	a.cache.SetDefault("seen", true)
+	a.Close()
+
+	tr, err := sn.Listen(testAddr(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Transport = tr
+	p, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	b := p.(*sp2p)
+
+	if _, ok := b.cache.Get("seen"); ok {
+		t.Fatal("dedup cache is shared with the closed node")
+	}
+	// 表中没有节点,BootstrapInterval到了以后重新引导
+	waitFor(t, 5*time.Second, "bootstrap ticker stopped", func() bool {
+		return b.GetBootstrapStatus().Rounds >= 2
+	})
+}
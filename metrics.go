@@ -0,0 +1,63 @@
+package sp2p
+
+import (
+	"sync/atomic"
+)
+
+// metrics 节点运行时的统计计数
+type metrics struct {
+	// 没有签名的消息
+	unsignedMsg uint64
+	// 签名校验失败的消息
+	invalidSigMsg uint64
+	// 协议版本不认识的消息
+	unknownVersionMsg uint64
+	// 因为格式错误或者超过内存限制被丢弃的分片
+	droppedFragment uint64
+	// 开启加密以后收到的明文消息
+	plaintextMsg uint64
+	// 找不到会话或者解密失败的消息
+	undecryptableMsg uint64
+	// 重复收到的广播
+	gossipDupMsg uint64
+	// 超过去重窗口或者时间在未来的广播
+	staleGossipMsg uint64
+	// 超过去重窗口或者时间在未来的主题消息
+	staleTopicMsg uint64
+	// 订阅的channel满了丢弃的消息
+	droppedTopicMsg uint64
+	// 重复经过本节点的路由消息
+	routeLoopMsg uint64
+	// 处理和发送消息时发生panic的次数
+	handlerPanic uint64
+	// 被AllowDeny拒绝的消息
+	deniedMsg uint64
+	// 超过速率限制的消息
+	rateLimitedMsg uint64
+	// 被封禁的IP或者节点发来的消息
+	bannedMsg uint64
+}
+
+func (m *metrics) incr(c *uint64) {
+	atomic.AddUint64(c, 1)
+}
+
+func (m *metrics) dump() map[string]uint64 {
+	return map[string]uint64{
+		"unsigned_msg":        atomic.LoadUint64(&m.unsignedMsg),
+		"invalid_sig_msg":     atomic.LoadUint64(&m.invalidSigMsg),
+		"unknown_version_msg": atomic.LoadUint64(&m.unknownVersionMsg),
+		"dropped_fragment":    atomic.LoadUint64(&m.droppedFragment),
+		"plaintext_msg":       atomic.LoadUint64(&m.plaintextMsg),
+		"undecryptable_msg":   atomic.LoadUint64(&m.undecryptableMsg),
+		"gossip_dup_msg":      atomic.LoadUint64(&m.gossipDupMsg),
+		"stale_gossip_msg":    atomic.LoadUint64(&m.staleGossipMsg),
+		"stale_topic_msg":     atomic.LoadUint64(&m.staleTopicMsg),
+		"dropped_topic_msg":   atomic.LoadUint64(&m.droppedTopicMsg),
+		"route_loop_msg":      atomic.LoadUint64(&m.routeLoopMsg),
+		"handler_panic":       atomic.LoadUint64(&m.handlerPanic),
+		"denied_msg":          atomic.LoadUint64(&m.deniedMsg),
+		"rate_limited_msg":    atomic.LoadUint64(&m.rateLimitedMsg),
+		"banned_msg":          atomic.LoadUint64(&m.bannedMsg),
+	}
+}
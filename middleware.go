@@ -0,0 +1,190 @@
+package sp2p
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrHandlerPanic 处理消息的时候发生了panic,被Recover捕获
+	ErrHandlerPanic = errors.New("kmsg handler panic")
+	// ErrPeerDenied 对方节点被AllowDeny拒绝
+	ErrPeerDenied = errors.New("peer is denied")
+)
+
+// Handler 处理一个消息,入站链的最后是消息的处理函数,出站链的最后是发送
+type Handler func(p ISP2P, msg *KMsg) error
+
+// Middleware 包装Handler,可以在调用next前后做日志、统计、鉴权等,不调用next就会丢弃消息
+type Middleware func(next Handler) Handler
+
+// chain 按照添加的顺序组合中间件,第一个中间件在最外层
+type chain struct {
+	mu    sync.RWMutex
+	mws   []Middleware
+	final Handler
+	h     Handler
+}
+
+func newChain(final Handler, mws ...Middleware) *chain {
+	c := &chain{final: final}
+	c.use(mws...)
+	return c
+}
+
+func (c *chain) use(mws ...Middleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mws = append(c.mws, mws...)
+	h := c.final
+	for i := len(c.mws) - 1; i >= 0; i-- {
+		h = c.mws[i](h)
+	}
+	c.h = h
+}
+
+func (c *chain) handle(p ISP2P, msg *KMsg) error {
+	c.mu.RLock()
+	h := c.h
+	c.mu.RUnlock()
+	return h(p, msg)
+}
+
+// remotePeer 消息对方的节点ID,入站消息是发送者,出站消息是接收者
+func remotePeer(p ISP2P, msg *KMsg) string {
+	if msg.FID == "" || msg.FID == p.Self().ID.String() {
+		return msg.TID
+	}
+	return msg.FID
+}
+
+// Recover 捕获处理消息时的panic,记录堆栈并返回ErrHandlerPanic,New总是把它放在入站链和出站链的最外层
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(p ISP2P, msg *KMsg) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					p.GetLogger().Error("kmsg handler panic", "type", msg.Data.String(), "from", msg.FID, "panic", r, "stack", string(debug.Stack()))
+					err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+				}
+			}()
+			return next(p, msg)
+		}
+	}
+}
+
+// AllowDeny 检查对方节点,deny中的节点总是被拒绝,allow不为空的时候只允许allow中的节点
+func AllowDeny(allow, deny []NodeID) Middleware {
+	toSet := func(ids []NodeID) map[string]bool {
+		set := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			set[id.String()] = true
+		}
+		return set
+	}
+	allowed, denied := toSet(allow), toSet(deny)
+
+	return func(next Handler) Handler {
+		return func(p ISP2P, msg *KMsg) error {
+			id := remotePeer(p, msg)
+			if denied[id] || (len(allowed) != 0 && !allowed[id]) {
+				return ErrPeerDenied
+			}
+			return next(p, msg)
+		}
+	}
+}
+
+// Logging 记录每个消息的类型、协议、收发节点、耗时和错误,出错的时候使用Warn级别
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return func(p ISP2P, msg *KMsg) error {
+			start := time.Now()
+			err := next(p, msg)
+
+			ctx := []interface{}{"type", msg.Data.String(), "proto", msg.Proto, "id", msg.ID, "from", msg.FID, "to", msg.TID, "dur", time.Since(start)}
+			if err != nil {
+				p.GetLogger().Warn("kmsg", append(ctx, "err", err)...)
+			} else {
+				p.GetLogger().Debug("kmsg", ctx...)
+			}
+			return err
+		}
+	}
+}
+
+// TypeTiming 一种消息的处理耗时统计
+type TypeTiming struct {
+	Count  uint64
+	Errors uint64
+	Total  time.Duration
+	Max    time.Duration
+}
+
+// Avg 平均耗时
+func (t TypeTiming) Avg() time.Duration {
+	if t.Count == 0 {
+		return 0
+	}
+	return t.Total / time.Duration(t.Count)
+}
+
+// Timing 按照协议和消息类型统计处理耗时
+//
+//	t := sp2p.NewTiming()
+//	p.UseInbound(t.Middleware)
+type Timing struct {
+	mu    sync.Mutex
+	stats map[string]*TypeTiming
+}
+
+func NewTiming() *Timing {
+	return &Timing{stats: make(map[string]*TypeTiming)}
+}
+
+func (t *Timing) Middleware(next Handler) Handler {
+	return func(p ISP2P, msg *KMsg) error {
+		start := time.Now()
+		err := next(p, msg)
+		dur := time.Since(start)
+
+		proto := msg.Proto
+		if proto == "" {
+			proto = DiscProtocol
+		}
+		key := proto + ":" + msg.Data.String()
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		s, ok := t.stats[key]
+		if !ok {
+			s = &TypeTiming{}
+			t.stats[key] = s
+		}
+		s.Count++
+		s.Total += dur
+		if dur > s.Max {
+			s.Max = dur
+		}
+		if err != nil {
+			s.Errors++
+		}
+		return err
+	}
+}
+
+// Stats 返回统计的副本,key是 "协议:消息类型",例如 "disc/1:ping req"
+func (t *Timing) Stats() map[string]TypeTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := make(map[string]TypeTiming, len(t.stats))
+	for k, v := range t.stats {
+		res[k] = *v
+	}
+	return res
+}
@@ -0,0 +1,182 @@
+package sp2p
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 中间件按照添加的顺序从外到内执行,Config.Inbound在UseInbound之前,Recover总是在最外层
+func TestMiddlewareOrder(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(p ISP2P, msg *KMsg) error {
+				if _, ok := msg.Data.(*testMsg); !ok {
+					return next(p, msg)
+				}
+				mu.Lock()
+				calls = append(calls, name)
+				mu.Unlock()
+				err := next(p, msg)
+				mu.Lock()
+				calls = append(calls, name+"'")
+				mu.Unlock()
+				return err
+			}
+		}
+	}
+	panics := func(next Handler) Handler {
+		return func(p ISP2P, msg *KMsg) error {
+			if m, ok := msg.Data.(*testMsg); ok && m.Text == "panic" {
+				panic("middleware panic")
+			}
+			return next(p, msg)
+		}
+	}
+
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1))
+	b := newTestNode(t, sn, testAddr(2), func(c *Config) { c.Inbound = []Middleware{record("1"), panics, record("2")} })
+	b.UseInbound(record("3"))
+
+	done := make(chan struct{}, 1)
+	if err := Handle(b.GetHManager(), func(ctx context.Context, peer Peer, m *testMsg) error {
+		mu.Lock()
+		calls = append(calls, "h")
+		mu.Unlock()
+		done <- struct{}{}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a.tab.addNode(b.tab.selfNode)
+	bid := NodeID(b.tab.selfNode.ID)
+
+	// 用户中间件的panic被Recover捕获,处理协程继续工作
+	if err := a.SendTo(ctx, bid, &testMsg{Text: "panic"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "panic was not recovered", func() bool {
+		return atomic.LoadUint64(&b.metrics.handlerPanic) == 1
+	})
+
+	if err := a.SendTo(ctx, bid, &testMsg{Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("handler was not called")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// panic跳过了外层中间件next之后的部分
+	want := []string{"1", "1", "2", "3", "h", "3'", "2'", "1'"}
+	if len(calls) != len(want) {
+		t.Fatalf("calls %v, want %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("calls %v, want %v", calls, want)
+		}
+	}
+}
+
+// 被AllowDeny拒绝的可靠消息不确认,通过的消息重发的时候再次确认
+func TestAckAfterAllowDeny(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	fast := func(c *Config) {
+		c.RetransmitTimeout = 50 * time.Millisecond
+		c.MaxRetransmits = 2
+	}
+	a := newTestNode(t, sn, testAddr(1), fast)
+	c := newTestNode(t, sn, testAddr(3), fast)
+	b := newTestNode(t, sn, testAddr(2), func(cfg *Config) {
+		cfg.Inbound = []Middleware{AllowDeny(nil, []NodeID{NodeID(a.tab.selfNode.ID)})}
+	})
+
+	var handled int32
+	if err := Handle(b.GetHManager(), func(ctx context.Context, peer Peer, m *testMsg) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	bn := b.tab.selfNode
+
+	if r := c.WriteReliable(ctx, &KMsg{TID: bn.ID.Hex(), TAddr: bn.addrString(), Data: &testMsg{Text: "c"}}); r != Delivered {
+		t.Fatalf("c: %s", r)
+	}
+	if r := a.WriteReliable(ctx, &KMsg{TID: bn.ID.Hex(), TAddr: bn.addrString(), Data: &testMsg{Text: "a"}}); r != PeerUnreachable {
+		t.Fatalf("a: %s", r)
+	}
+
+	// 确认丢了以后重发的消息不再处理,但是还会确认
+	msg := &KMsg{TID: bn.ID.Hex(), TAddr: bn.addrString(), Data: &testMsg{Text: "again"}}
+	if r := c.WriteReliable(ctx, msg); r != Delivered {
+		t.Fatalf("c: %s", r)
+	}
+	if r := c.WriteReliable(ctx, msg); r != Delivered {
+		t.Fatalf("c resend: %s", r)
+	}
+	settle(t, sn)
+	if n := atomic.LoadInt32(&handled); n != 2 {
+		t.Fatalf("b handled %d messages, want 2", n)
+	}
+}
+
+// 出站中间件panic以后消息被丢弃,发送协程继续发送后面的消息
+func TestOutboundRecover(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1), func(c *Config) {
+		c.WriteWorkers = 1
+		c.Outbound = []Middleware{func(next Handler) Handler {
+			return func(p ISP2P, msg *KMsg) error {
+				if m, ok := msg.Data.(*testMsg); ok && m.Text == "panic" {
+					panic("outbound")
+				}
+				return next(p, msg)
+			}
+		}}
+	})
+	b := newTestNode(t, sn, testAddr(2))
+
+	got := make(chan string, 2)
+	if err := Handle(b.GetHManager(), func(ctx context.Context, peer Peer, m *testMsg) error {
+		got <- m.Text
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	bn := b.tab.selfNode
+	for _, text := range []string{"panic", "hello"} {
+		if err := a.Write(&KMsg{TID: bn.ID.Hex(), TAddr: bn.addrString(), Data: &testMsg{Text: text}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case s := <-got:
+		if s != "hello" {
+			t.Fatalf("b got %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write worker stopped after an outbound panic")
+	}
+	if n := atomic.LoadUint64(&a.metrics.handlerPanic); n != 1 {
+		t.Fatalf("handler_panic = %d, want 1", n)
+	}
+}
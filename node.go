@@ -18,7 +18,11 @@ type node struct {
 	ID   Hash   // the node's public key
 
 	// Time when the node was added to the table.
-	updateAt   time.Time
+	updateAt time.Time
+	// 连续ping失败的次数
+	fails int
+	// 最近一次ping的往返时间
+	rtt        time.Duration
 	addr       string
 	udpAddr    *net.UDPAddr
 	nodeString string
@@ -152,6 +156,122 @@ func parseComplete(rawurl string) (*node, error) {
 	return newNode(id, ip, uint16(udpPort)), nil
 }
 
+// parseUDPAddr 解析对方提供的地址,只接受IP和数字端口,不做域名解析
+func parseUDPAddr(s string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %v", err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("invalid IP address")
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port")
+	}
+	return &net.UDPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// Node 节点的公开信息,文本和json格式是节点URL sp2p://<hex node id>@10.3.58.6:30303
+type Node struct {
+	ID   NodeID
+	IP   net.IP
+	Port uint16
+}
+
+// ParseNode 解析节点URL,必须包含IP和端口
+func ParseNode(rawUrl string) (Node, error) {
+	n, err := NodeParse(rawUrl)
+	if err != nil {
+		return Node{}, err
+	}
+	if err := n.validateComplete(); err != nil {
+		return Node{}, err
+	}
+	return n.public(), nil
+}
+
+func (n Node) String() string {
+	return n.node().string()
+}
+
+// UDPAddr 节点的UDP地址
+func (n Node) UDPAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: n.IP, Port: int(n.Port)}
+}
+
+func (n Node) MarshalText() ([]byte, error) {
+	return []byte(n.String()), nil
+}
+
+func (n *Node) UnmarshalText(b []byte) error {
+	p, err := ParseNode(string(b))
+	if err != nil {
+		return err
+	}
+	*n = p
+	return nil
+}
+
+func (n Node) node() *node {
+	return newNode(Hash(n.ID), n.IP, n.Port)
+}
+
+func (n *node) public() Node {
+	return Node{ID: NodeID(n.ID), IP: n.IP, Port: n.Port}
+}
+
+func publicNodes(ns []*node) []Node {
+	nodes := make([]Node, 0, len(ns))
+	for _, n := range ns {
+		nodes = append(nodes, n.public())
+	}
+	return nodes
+}
+
+// nodeRecord 备份到kdb中的节点信息
+type nodeRecord struct {
+	Node     string        `json:"node"`
+	UpdateAt time.Time     `json:"update_at"`
+	Fails    int           `json:"fails,omitempty"`
+	RTT      time.Duration `json:"rtt,omitempty"`
+}
+
+func (n *node) record() []byte {
+	d, _ := json.Marshal(&nodeRecord{Node: n.string(), UpdateAt: n.updateAt, Fails: n.fails, RTT: n.rtt})
+	return d
+}
+
+// nodeFromRecord 解析备份的节点信息,兼容以前只保存节点URL的格式
+func nodeFromRecord(d []byte) (*node, error) {
+	if len(d) == 0 || d[0] != '{' {
+		// 旧格式没有活动时间,当成刚刚活动过,交给revalidate的ping来验证
+		n, err := NodeParse(string(d))
+		if err != nil {
+			return nil, err
+		}
+		n.updateAt = time.Now()
+		return n, nil
+	}
+
+	r := &nodeRecord{}
+	if err := json.Unmarshal(d, r); err != nil {
+		return nil, err
+	}
+	n, err := NodeParse(r.Node)
+	if err != nil {
+		return nil, err
+	}
+	n.updateAt = r.UpdateAt
+	n.fails = r.Fails
+	n.rtt = r.RTT
+	return n, nil
+}
+
 // MustNodeParse parses a node URL. It panics if the URL is not valid.
 func MustNodeParse(rawUrl string) *node {
 	n, err := NodeParse(rawUrl)
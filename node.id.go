@@ -6,6 +6,37 @@ import (
 	"strings"
 )
 
+// NodeID 节点ID,也就是节点的ed25519公钥,文本和json格式是64个字符的hex
+type NodeID Hash
+
+// ParseNodeID 解析hex格式的节点ID,可以有0x前缀
+func ParseNodeID(in string) (NodeID, error) {
+	id, err := HexID(in)
+	return NodeID(id), err
+}
+
+// Hash 转换成路由表使用的Hash
+func (id NodeID) Hash() Hash {
+	return Hash(id)
+}
+
+func (id NodeID) String() string {
+	return Hash(id).Hex()
+}
+
+func (id NodeID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *NodeID) UnmarshalText(b []byte) error {
+	h, err := HexID(string(b))
+	if err != nil {
+		return err
+	}
+	*id = NodeID(h)
+	return nil
+}
+
 // BytesID converts a byte slice to a NodeID
 func BytesID(b []byte) (Hash, error) {
 	var id Hash
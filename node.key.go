@@ -0,0 +1,75 @@
+package sp2p
+
+import (
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var (
+	keyPrefix  = []byte("key")
+	nodeKeyKey = []byte("node")
+
+	errUnsignedMsg = errors.New("kmsg is unsigned")
+	errInvalidSig  = errors.New("kmsg signature is invalid")
+)
+
+// GenNodeKey 随机生成一个节点私钥
+func GenNodeKey() ed25519.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		panic(errs("generate node key error", err.Error()))
+	}
+	return priv
+}
+
+// HexNodeKey converts a hex encoded ed25519 seed to a private key.
+func HexNodeKey(in string) (ed25519.PrivateKey, error) {
+	seed, err := hex.DecodeString(in)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("wrong length, want %d hex chars", ed25519.SeedSize*2)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// PubkeyID 节点ID就是节点的ed25519公钥
+func PubkeyID(pub ed25519.PublicKey) Hash {
+	return MustBytesID(pub)
+}
+
+// Pubkey returns the ed25519 public key the node id stands for
+func (a Hash) Pubkey() ed25519.PublicKey {
+	return ed25519.PublicKey(a.Bytes())
+}
+
+// loadNodeKey 从kdb中加载节点私钥,如果不存在就生成一个新的并保存
+func (t *Config) loadNodeKey() ed25519.PrivateKey {
+	h := t.db.KHash(t.dbPrefix(keyPrefix))
+
+	seed, err := h.Get(nodeKeyKey)
+	if err == nil && len(seed) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(seed)
+	}
+
+	priv := GenNodeKey()
+	if err := h.Set(nodeKeyKey, priv.Seed()); err != nil {
+		t.l.Error("save node key error", "err", err)
+	}
+	return priv
+}
+
+func sign(priv ed25519.PrivateKey, data []byte) []byte {
+	return ed25519.Sign(priv, data)
+}
+
+func verify(id Hash, data, sig []byte) error {
+	if !ed25519.Verify(id.Pubkey(), data, sig) {
+		return errInvalidSig
+	}
+	return nil
+}
@@ -17,16 +17,16 @@ func (s durationSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 
 // checkClockDrift queries an NTP server for clock drifts and warns the user if
 // one large enough is detected.
-func checkClockDrift() {
-	drift, err := sntpDrift(cfg.NtpChecks)
+func checkClockDrift(cfg *Config) {
+	drift, err := sntpDrift(cfg, cfg.NtpChecks)
 	if err != nil {
 		return
 	}
 	if drift < -cfg.DriftThreshold || drift > cfg.DriftThreshold {
-		getLog().Warn(fmt.Sprintf("System clock seems off by %v, which can prevent network connectivity", drift))
-		getLog().Warn("Please enable network time synchronisation in system settings.")
+		cfg.l.Warn(fmt.Sprintf("System clock seems off by %v, which can prevent network connectivity", drift))
+		cfg.l.Warn("Please enable network time synchronisation in system settings.")
 	} else {
-		getLog().Debug("NTP sanity check done", "drift", drift)
+		cfg.l.Debug("NTP sanity check done", "drift", drift)
 	}
 }
 
@@ -36,7 +36,7 @@ func checkClockDrift() {
 //
 // Note, it executes two extra measurements compared to the number of requested
 // ones to be able to discard the two extremes as outliers.
-func sntpDrift(measurements int) (time.Duration, error) {
+func sntpDrift(cfg *Config, measurements int) (time.Duration, error) {
 	// Resolve the address of the NTP server
 	addr, err := net.ResolveUDPAddr("udp", cfg.NtpPool+":123")
 	if err != nil {
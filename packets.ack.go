@@ -0,0 +1,11 @@
+package sp2p
+
+// ackResp 确认收到了一条可靠消息,RID是被确认的消息ID
+type ackResp struct{}
+
+func (t *ackResp) T() byte                        { return ackRespT }
+func (t *ackResp) String() string                 { return ackRespS }
+func (t *ackResp) Priority() Priority             { return PriorityHigh }
+func (t *ackResp) MarshalBinary() ([]byte, error) { return nil, nil }
+func (t *ackResp) UnmarshalBinary([]byte) error   { return nil }
+func (t *ackResp) OnHandle(p ISP2P, msg *KMsg)    {}
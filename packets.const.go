@@ -9,4 +9,49 @@ const (
 
 	findNodeRespT = byte(0x3)
 	findNodeRespS = "find node resp"
+
+	pongRespT = byte(0x4)
+	pongRespS = "pong resp"
+
+	storeReqT = byte(0x5)
+	storeReqS = "store req"
+
+	storeRespT = byte(0x6)
+	storeRespS = "store resp"
+
+	findValueReqT = byte(0x7)
+	findValueReqS = "find value req"
+
+	findValueRespT = byte(0x8)
+	findValueRespS = "find value resp"
+
+	ackRespT = byte(0x9)
+	ackRespS = "ack resp"
+
+	handshakeReqT = byte(0xa)
+	handshakeReqS = "handshake req"
+
+	handshakeRespT = byte(0xb)
+	handshakeRespS = "handshake resp"
+
+	gossipReqT = byte(0xc)
+	gossipReqS = "gossip req"
+
+	gossipAckT = byte(0xd)
+	gossipAckS = "gossip ack"
+
+	topicReqT = byte(0xe)
+	topicReqS = "topic req"
+
+	topicRespT = byte(0xf)
+	topicRespS = "topic resp"
+
+	topicMsgT = byte(0x10)
+	topicMsgS = "topic msg"
+
+	topicGraftT = byte(0x11)
+	topicGraftS = "topic graft"
+
+	routeMsgT = byte(0x12)
+	routeMsgS = "route msg"
 )
@@ -2,30 +2,52 @@ package sp2p
 
 type findNodeReq struct {
 	N int `json:"n,omitempty"`
+	// 查找的目标节点ID,为空的时候查找离请求者最近的节点
+	Target string `json:"target,omitempty"`
 }
 
 func (t *findNodeReq) T() byte        { return findNodeReqT }
 func (t *findNodeReq) String() string { return findNodeReqS }
+
+func (t *findNodeReq) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.uvarint(uint64(t.N))
+	w.nodeID(t.Target)
+	return w.b, w.err
+}
+
+func (t *findNodeReq) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.N = int(r.uvarint())
+	t.Target = r.nodeID()
+	return r.err
+}
+
 func (t *findNodeReq) OnHandle(p ISP2P, msg *KMsg) {
-	node, err := nodeFromKMsg(msg)
-	if err != nil {
-		getLog().Error("NodeFromKMsg error", "err", err)
-		return
-	}
-	go p.UpdateNode(node.string())
+	s := p.(*sp2p)
+	// 没有验证过地址的节点先ping它,回复了pong以后才回复请求,防止伪造源地址的放大攻击
+	s.whenBonded(msg, func(node *node) { t.reply(s, msg, node) })
+}
 
-	ns := make([]string, 0)
+func (t *findNodeReq) reply(p ISP2P, msg *KMsg, node *node) {
+	p.UpdatePeer(node.public())
+
+	target := node.ID
+	if t.Target != "" {
+		var err error
+		if target, err = HexID(t.Target); err != nil {
+			p.GetLogger().Error("find node target error", "err", err)
+			return
+		}
+	}
 
 	// 最多不能超过16
 	if t.N > 16 {
 		t.N = 16
 	}
 
-	nodes, _ := p.FindMinDisNodes(node.ID.Hex(), t.N)
-	for _, n := range nodes {
-		ns = append(ns, n)
-	}
-	p.Write(&KMsg{TAddr: msg.FAddr, Data: &findNodeResp{Nodes: ns}})
+	nodes, _ := p.ClosestNodes(NodeID(target), t.N)
+	p.Reply(msg, &findNodeResp{Nodes: nodeStrings(nodes)})
 }
 
 type findNodeResp struct {
@@ -34,13 +56,18 @@ type findNodeResp struct {
 
 func (t *findNodeResp) T() byte        { return findNodeRespT }
 func (t *findNodeResp) String() string { return findNodeRespS }
-func (t *findNodeResp) OnHandle(p ISP2P, msg *KMsg) {
-	for _, n := range t.Nodes {
-		node, err := NodeParse(n)
-		if err != nil {
-			getLog().Error("parse node error", "err", err)
-			continue
-		}
-		p.UpdateNode(node.string())
-	}
+
+func (t *findNodeResp) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.nodes(t.Nodes)
+	return w.b, w.err
+}
+
+func (t *findNodeResp) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.Nodes = r.nodes()
+	return r.err
 }
+
+// OnHandle 回复由findNode处理,没有对应请求的回复不会去ping里面的节点
+func (t *findNodeResp) OnHandle(p ISP2P, msg *KMsg) {}
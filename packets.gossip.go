@@ -0,0 +1,111 @@
+package sp2p
+
+// gossipReq 全网广播的消息,每个节点转发给NodeBroadcastNumber个随机节点,
+// 按照广播ID去重,TTL减到0以后或者超过去重窗口以后不再转发
+type gossipReq struct {
+	// 广播ID,转发的时候保持不变
+	ID         string `json:"id"`
+	Origin     string `json:"origin"`
+	OriginAddr string `json:"origin_addr"`
+	// 发起广播的时间(纳秒),在签名范围内,超过去重窗口的广播被丢弃
+	Time uint64 `json:"time"`
+	// 还可以转发的跳数
+	TTL int `json:"ttl"`
+	// 已经经过的跳数
+	Hops int `json:"hops"`
+	// 收到以后是否给发起者回复gossipAck,用来统计覆盖率
+	Receipt bool `json:"receipt,omitempty"`
+	// 广播的消息所属的子协议、消息类型和编码以后的消息
+	Proto string `json:"proto,omitempty"`
+	DT    byte   `json:"dt"`
+	Data  []byte `json:"data"`
+	// 发起者对广播内容的签名,TTL和Hops转发的时候会变,不在签名范围内
+	Sig []byte `json:"sig"`
+}
+
+func (t *gossipReq) T() byte            { return gossipReqT }
+func (t *gossipReq) String() string     { return gossipReqS }
+func (t *gossipReq) Priority() Priority { return PriorityLow }
+
+func (t *gossipReq) signData() []byte {
+	w := &wbuf{}
+	w.msgID(t.ID)
+	w.nodeID(t.Origin)
+	w.addr(t.OriginAddr)
+	w.uvarint(t.Time)
+	w.byte(boolByte(t.Receipt))
+	w.str(t.Proto)
+	w.byte(t.DT)
+	w.bytes(t.Data)
+	return w.b
+}
+
+func (t *gossipReq) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.msgID(t.ID)
+	w.nodeID(t.Origin)
+	w.addr(t.OriginAddr)
+	w.uvarint(t.Time)
+	w.uvarint(uint64(t.TTL))
+	w.uvarint(uint64(t.Hops))
+	w.byte(boolByte(t.Receipt))
+	w.str(t.Proto)
+	w.byte(t.DT)
+	w.bytes(t.Data)
+	w.bytes(t.Sig)
+	return w.b, w.err
+}
+
+func (t *gossipReq) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.ID = r.msgID()
+	t.Origin = r.nodeID()
+	t.OriginAddr = r.addr()
+	t.Time = r.uvarint()
+	t.TTL = int(r.uvarint())
+	t.Hops = int(r.uvarint())
+	t.Receipt = r.byte() != 0
+	t.Proto = r.str()
+	t.DT = r.byte()
+	t.Data = r.bytes()
+	t.Sig = r.bytes()
+	return r.err
+}
+
+func (t *gossipReq) OnHandle(p ISP2P, msg *KMsg) {
+	p.(*sp2p).gossip(msg, t)
+}
+
+// gossipAck 收到广播的节点回复给发起者
+type gossipAck struct {
+	ID   string `json:"id"`
+	Hops int    `json:"hops"`
+}
+
+func (t *gossipAck) T() byte        { return gossipAckT }
+func (t *gossipAck) String() string { return gossipAckS }
+
+func (t *gossipAck) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.msgID(t.ID)
+	w.uvarint(uint64(t.Hops))
+	return w.b, w.err
+}
+
+func (t *gossipAck) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.ID = r.msgID()
+	t.Hops = int(r.uvarint())
+	return r.err
+}
+
+func (t *gossipAck) OnHandle(p ISP2P, msg *KMsg) {
+	p.(*sp2p).gossipReceipt(msg, t)
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
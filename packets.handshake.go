@@ -0,0 +1,74 @@
+package sp2p
+
+// handshakeReq 发起握手,Eph是本次握手的X25519临时公钥,Time是发起握手的时间(纳秒)
+// 握手消息本身不加密,由节点身份签名保证临时公钥确实来自对方,Time防止重放,
+// Cookie是对方上一次回复的cookie,证明我们能在这个地址收到数据报
+type handshakeReq struct {
+	Eph    []byte `json:"eph"`
+	Time   uint64 `json:"time"`
+	Cookie []byte `json:"cookie,omitempty"`
+}
+
+func (t *handshakeReq) T() byte            { return handshakeReqT }
+func (t *handshakeReq) String() string     { return handshakeReqS }
+func (t *handshakeReq) Priority() Priority { return PriorityHigh }
+
+func (t *handshakeReq) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.bytes(t.Eph)
+	w.uvarint(t.Time)
+	w.bytes(t.Cookie)
+	return w.b, w.err
+}
+
+func (t *handshakeReq) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.Eph = r.bytes()
+	t.Time = r.uvarint()
+	t.Cookie = r.bytes()
+	return r.err
+}
+
+func (t *handshakeReq) OnHandle(p ISP2P, msg *KMsg) {
+	resp, err := p.(*sp2p).acceptHandshake(msg, t)
+	if err != nil {
+		p.GetLogger().Error("handshake error", "err", err, "addr", msg.SrcAddr())
+		return
+	}
+	p.Reply(msg, resp)
+}
+
+// handshakeResp 回复自己的临时公钥,没有验证过对方地址的时候Eph为空,只回复Cookie
+type handshakeResp struct {
+	Eph    []byte `json:"eph,omitempty"`
+	Cookie []byte `json:"cookie,omitempty"`
+}
+
+func (t *handshakeResp) T() byte            { return handshakeRespT }
+func (t *handshakeResp) String() string     { return handshakeRespS }
+func (t *handshakeResp) Priority() Priority { return PriorityHigh }
+
+func (t *handshakeResp) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.bytes(t.Eph)
+	w.bytes(t.Cookie)
+	return w.b, w.err
+}
+
+func (t *handshakeResp) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.Eph = r.bytes()
+	t.Cookie = r.bytes()
+	return r.err
+}
+
+func (t *handshakeResp) OnHandle(p ISP2P, msg *KMsg) {}
+
+// isHandshake 握手消息在会话建立之前发送,只能使用明文
+func isHandshake(m IPacket) bool {
+	switch m.(type) {
+	case *handshakeReq, *handshakeResp:
+		return true
+	}
+	return false
+}
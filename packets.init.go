@@ -1,9 +1,24 @@
 package sp2p
 
 func init() {
-	GetHManager().Registry(
-		pingReq{},
-		findNodeReq{},
-		findNodeResp{},
+	GetHManager().registerCore(
+		&pingReq{},
+		&pongResp{},
+		&findNodeReq{},
+		&findNodeResp{},
+		&storeReq{},
+		&storeResp{},
+		&findValueReq{},
+		&findValueResp{},
+		&ackResp{},
+		&handshakeReq{},
+		&handshakeResp{},
+		&gossipReq{},
+		&gossipAck{},
+		&topicReq{},
+		&topicResp{},
+		&topicMsg{},
+		&topicGraft{},
+		&routeMsg{},
 	)
 }
@@ -1,14 +1,98 @@
 package sp2p
 
-type pingReq struct{}
+// pingReq 和 pongResp 中声明自己支持的协议,旧版本的节点发送空的消息体
+type pingReq struct {
+	Protos []string `json:"protos,omitempty"`
+}
 
-func (t *pingReq) T() byte        { return pingReqT }
-func (t *pingReq) String() string { return pingReqS }
+func (t *pingReq) T() byte                        { return pingReqT }
+func (t *pingReq) String() string                 { return pingReqS }
+func (t *pingReq) Priority() Priority             { return PriorityHigh }
+func (t *pingReq) MarshalBinary() ([]byte, error) { return marshalProtos(t.Protos) }
+func (t *pingReq) UnmarshalBinary(b []byte) (err error) {
+	t.Protos, err = unmarshalProtos(b)
+	return
+}
 func (t *pingReq) OnHandle(p ISP2P, msg *KMsg) {
+	s := p.(*sp2p)
+	node, err := nodeFromKMsg(msg)
+	if err != nil {
+		p.GetLogger().Error("NodeFromKMsg error", "err", err)
+		return
+	}
+	p.Reply(msg, &pongResp{Protos: s.protocols()})
+	// 对方收到pong以后就验证了我们的地址,等待对方验证的请求可以发送了
+	s.tab.peerBond(node.ID, msg.SrcAddr())
+
+	// 没有验证过的节点需要先回复我们的ping才能加到路由表中,协议列表也是验证以后才保存
+	protos := t.Protos
+	if s.bonded(node.ID, msg.SrcAddr()) {
+		s.setPeerProtocols(node.ID, protos)
+		p.UpdatePeer(node.public())
+	} else {
+		s.spawn(func() {
+			if s.bond(node) {
+				s.setPeerProtocols(node.ID, protos)
+			}
+		})
+	}
+}
+
+type pongResp struct {
+	Protos []string `json:"protos,omitempty"`
+}
+
+func (t *pongResp) T() byte                        { return pongRespT }
+func (t *pongResp) String() string                 { return pongRespS }
+func (t *pongResp) Priority() Priority             { return PriorityHigh }
+func (t *pongResp) MarshalBinary() ([]byte, error) { return marshalProtos(t.Protos) }
+func (t *pongResp) UnmarshalBinary(b []byte) (err error) {
+	t.Protos, err = unmarshalProtos(b)
+	return
+}
+func (t *pongResp) OnHandle(p ISP2P, msg *KMsg) {
+	s := p.(*sp2p)
 	node, err := nodeFromKMsg(msg)
 	if err != nil {
-		getLog().Error("NodeFromKMsg error", "err", err)
+		p.GetLogger().Error("NodeFromKMsg error", "err", err)
 		return
 	}
-	p.UpdateNode(node.string())
+	if s.bonded(node.ID, msg.SrcAddr()) {
+		s.setPeerProtocols(node.ID, t.Protos)
+		p.UpdatePeer(node.public())
+	}
+}
+
+func marshalProtos(protos []string) ([]byte, error) {
+	if len(protos) == 0 {
+		return nil, nil
+	}
+
+	w := &wbuf{}
+	w.uvarint(uint64(len(protos)))
+	for _, p := range protos {
+		w.str(p)
+	}
+	return w.b, w.err
+}
+
+func unmarshalProtos(b []byte) ([]string, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	r := &rbuf{b: b}
+	n := r.uvarint()
+	// 每个协议名称至少有1个字节的长度前缀
+	if n > uint64(len(r.b)) {
+		return nil, errShortBuf
+	}
+	if n > maxProtocols {
+		return nil, errProtocolList
+	}
+	protos := make([]string, 0, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		protos = append(protos, r.str())
+	}
+	return protos, r.err
 }
@@ -0,0 +1,81 @@
+package sp2p
+
+// routeMsg 逐跳路由到目标节点ID的消息,每一跳转发给路由表中比自己离目标更近的节点
+type routeMsg struct {
+	ID         string `json:"id"`
+	Origin     string `json:"origin"`
+	OriginAddr string `json:"origin_addr"`
+	Target     string `json:"target"`
+	// 还可以转发的跳数
+	TTL int `json:"ttl"`
+	// 请求经过的节点,用来检测环路;地址是转发的节点自己填写的,不会被用来发送消息
+	Path []string `json:"path,omitempty"`
+	// 回复消息,RID是被回复的路由消息ID
+	Reply bool   `json:"reply,omitempty"`
+	RID   string `json:"rid,omitempty"`
+	// 路由的消息所属的子协议、消息类型和编码以后的消息
+	Proto string `json:"proto,omitempty"`
+	DT    byte   `json:"dt"`
+	Data  []byte `json:"data"`
+	// 发起者的签名,请求的TTL和Path转发的时候会变,不在签名范围内,
+	// 回复不带Path,原路返回用的是每一跳自己记录的上一跳
+	Sig []byte `json:"sig"`
+}
+
+func (t *routeMsg) T() byte        { return routeMsgT }
+func (t *routeMsg) String() string { return routeMsgS }
+
+func (t *routeMsg) signData() []byte {
+	w := &wbuf{}
+	w.msgID(t.ID)
+	w.nodeID(t.Origin)
+	w.addr(t.OriginAddr)
+	w.nodeID(t.Target)
+	w.byte(boolByte(t.Reply))
+	w.msgID(t.RID)
+	w.str(t.Proto)
+	w.byte(t.DT)
+	w.bytes(t.Data)
+	if t.Reply {
+		w.nodes(t.Path)
+	}
+	return w.b
+}
+
+func (t *routeMsg) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.msgID(t.ID)
+	w.nodeID(t.Origin)
+	w.addr(t.OriginAddr)
+	w.nodeID(t.Target)
+	w.uvarint(uint64(t.TTL))
+	w.nodes(t.Path)
+	w.byte(boolByte(t.Reply))
+	w.msgID(t.RID)
+	w.str(t.Proto)
+	w.byte(t.DT)
+	w.bytes(t.Data)
+	w.bytes(t.Sig)
+	return w.b, w.err
+}
+
+func (t *routeMsg) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.ID = r.msgID()
+	t.Origin = r.nodeID()
+	t.OriginAddr = r.addr()
+	t.Target = r.nodeID()
+	t.TTL = int(r.uvarint())
+	t.Path = r.nodes()
+	t.Reply = r.byte() != 0
+	t.RID = r.msgID()
+	t.Proto = r.str()
+	t.DT = r.byte()
+	t.Data = r.bytes()
+	t.Sig = r.bytes()
+	return r.err
+}
+
+func (t *routeMsg) OnHandle(p ISP2P, msg *KMsg) {
+	p.(*sp2p).routed(msg, t)
+}
@@ -0,0 +1,140 @@
+package sp2p
+
+type storeReq struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	// 写入时间(纳秒),同一个key保留写入时间最新的值
+	Time uint64 `json:"time"`
+}
+
+func (t *storeReq) T() byte        { return storeReqT }
+func (t *storeReq) String() string { return storeReqS }
+
+func (t *storeReq) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.nodeID(t.Key)
+	w.bytes(t.Value)
+	w.uvarint(t.Time)
+	return w.b, w.err
+}
+
+func (t *storeReq) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.Key = r.nodeID()
+	t.Value = r.bytes()
+	t.Time = r.uvarint()
+	return r.err
+}
+
+func (t *storeReq) OnHandle(p ISP2P, msg *KMsg) {
+	s := p.(*sp2p)
+	k, err := HexID(t.Key)
+	if err != nil {
+		p.GetLogger().Error("store key error", "err", err)
+		return
+	}
+	if len(t.Value) > p.GetCfg().MaxValueSize {
+		p.GetLogger().Debug("store value error", "err", errValueTooLarge, "len", len(t.Value))
+		return
+	}
+
+	// 只保存验证过地址的节点的数据
+	s.whenBonded(msg, func(node *node) { t.store(s, msg, node, k) })
+}
+
+func (t *storeReq) store(s *sp2p, msg *KMsg, node *node, k Hash) {
+	// 路由表中已经有BucketSize个节点比自己离key近,这个值不应该保存在这里
+	if !s.responsible(k) {
+		s.l.Debug("store key is not close to self", "key", t.Key, "node", msg.FID)
+		return
+	}
+	// 每个节点写入的字节数有配额,防止一个节点写满存储
+	if err := s.limit.allowStoreBytes(node.ID, len(t.Value)); err != nil {
+		s.l.Debug("store quota error", "err", err, "node", msg.FID, "len", len(t.Value))
+		return
+	}
+
+	// 已经有更新的值的时候不确认
+	if err := s.cfg.kvSet(k, t.Value, t.Time); err != nil {
+		s.l.Debug("store value error", "err", err, "key", t.Key)
+		return
+	}
+	s.Reply(msg, &storeResp{})
+}
+
+type storeResp struct{}
+
+func (t *storeResp) T() byte                        { return storeRespT }
+func (t *storeResp) String() string                 { return storeRespS }
+func (t *storeResp) MarshalBinary() ([]byte, error) { return nil, nil }
+func (t *storeResp) UnmarshalBinary([]byte) error   { return nil }
+func (t *storeResp) OnHandle(p ISP2P, msg *KMsg)    {}
+
+type findValueReq struct {
+	Key string `json:"key"`
+}
+
+func (t *findValueReq) T() byte        { return findValueReqT }
+func (t *findValueReq) String() string { return findValueReqS }
+
+func (t *findValueReq) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.nodeID(t.Key)
+	return w.b, w.err
+}
+
+func (t *findValueReq) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.Key = r.nodeID()
+	return r.err
+}
+
+func (t *findValueReq) OnHandle(p ISP2P, msg *KMsg) {
+	s := p.(*sp2p)
+	k, err := HexID(t.Key)
+	if err != nil {
+		p.GetLogger().Error("find value key error", "err", err)
+		return
+	}
+
+	s.whenBonded(msg, func(*node) { t.reply(s, msg, k) })
+}
+
+// reply 本节点有这个值就直接返回,否则返回离key最近的节点
+func (t *findValueReq) reply(p ISP2P, msg *KMsg, k Hash) {
+	resp := &findValueResp{}
+	if v, ts, err := p.GetCfg().kvGet(k); err == nil && len(v) != 0 {
+		resp.Value, resp.Time = v, ts
+	} else {
+		nodes, _ := p.ClosestNodes(NodeID(k), p.GetCfg().BucketSize)
+		resp.Nodes = nodeStrings(nodes)
+	}
+	p.Reply(msg, resp)
+}
+
+type findValueResp struct {
+	Value []byte `json:"value,omitempty"`
+	// 值的写入时间(纳秒)
+	Time  uint64   `json:"time,omitempty"`
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+func (t *findValueResp) T() byte        { return findValueRespT }
+func (t *findValueResp) String() string { return findValueRespS }
+
+func (t *findValueResp) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.bytes(t.Value)
+	w.uvarint(t.Time)
+	w.nodes(t.Nodes)
+	return w.b, w.err
+}
+
+func (t *findValueResp) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.Value = r.bytes()
+	t.Time = r.uvarint()
+	t.Nodes = r.nodes()
+	return r.err
+}
+func (t *findValueResp) OnHandle(p ISP2P, msg *KMsg) {}
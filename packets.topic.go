@@ -0,0 +1,164 @@
+package sp2p
+
+// topicReq 的操作
+const (
+	// 只查询订阅者
+	topicPeers = byte(0x0)
+	// 订阅,汇合点在TopicExpiration内记住订阅者
+	topicJoin = byte(0x1)
+	// 取消订阅
+	topicLeave = byte(0x2)
+)
+
+// topicReq 发给离hash(topic)最近的节点,这些节点作为主题的汇合点保存订阅者列表
+type topicReq struct {
+	Topic string `json:"topic"`
+	Op    byte   `json:"op"`
+}
+
+func (t *topicReq) T() byte        { return topicReqT }
+func (t *topicReq) String() string { return topicReqS }
+
+func (t *topicReq) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.str(t.Topic)
+	w.byte(t.Op)
+	return w.b, w.err
+}
+
+func (t *topicReq) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.Topic = r.str()
+	t.Op = r.byte()
+	return r.err
+}
+
+func (t *topicReq) OnHandle(p ISP2P, msg *KMsg) {
+	s := p.(*sp2p)
+	// 和findNodeReq一样,返回订阅者列表之前先验证地址
+	s.whenBonded(msg, func(node *node) {
+		p.Reply(msg, &topicResp{Peers: s.topicMembers(node, t)})
+	})
+}
+
+type topicResp struct {
+	Peers []string `json:"peers,omitempty"`
+}
+
+func (t *topicResp) T() byte        { return topicRespT }
+func (t *topicResp) String() string { return topicRespS }
+
+func (t *topicResp) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.nodes(t.Peers)
+	return w.b, w.err
+}
+
+func (t *topicResp) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.Peers = r.nodes()
+	return r.err
+}
+
+func (t *topicResp) OnHandle(p ISP2P, msg *KMsg) {}
+
+// topicMsg 发布到主题的消息,在订阅者的mesh中转发
+type topicMsg struct {
+	ID         string `json:"id"`
+	Topic      string `json:"topic"`
+	Origin     string `json:"origin"`
+	OriginAddr string `json:"origin_addr"`
+	// 发布的时间(纳秒),在签名范围内,超过去重窗口的消息被丢弃
+	Time    uint64 `json:"time"`
+	TTL     int    `json:"ttl"`
+	Payload []byte `json:"payload"`
+	// 发布者的签名,TTL不在签名范围内
+	Sig []byte `json:"sig"`
+}
+
+func (t *topicMsg) T() byte            { return topicMsgT }
+func (t *topicMsg) String() string     { return topicMsgS }
+func (t *topicMsg) Priority() Priority { return PriorityLow }
+
+func (t *topicMsg) signData() []byte {
+	w := &wbuf{}
+	w.msgID(t.ID)
+	w.str(t.Topic)
+	w.nodeID(t.Origin)
+	w.addr(t.OriginAddr)
+	w.uvarint(t.Time)
+	w.bytes(t.Payload)
+	return w.b
+}
+
+func (t *topicMsg) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.msgID(t.ID)
+	w.str(t.Topic)
+	w.nodeID(t.Origin)
+	w.addr(t.OriginAddr)
+	w.uvarint(t.Time)
+	w.uvarint(uint64(t.TTL))
+	w.bytes(t.Payload)
+	w.bytes(t.Sig)
+	return w.b, w.err
+}
+
+func (t *topicMsg) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.ID = r.msgID()
+	t.Topic = r.str()
+	t.Origin = r.nodeID()
+	t.OriginAddr = r.addr()
+	t.Time = r.uvarint()
+	t.TTL = int(r.uvarint())
+	t.Payload = r.bytes()
+	t.Sig = r.bytes()
+	return r.err
+}
+
+func (t *topicMsg) OnHandle(p ISP2P, msg *KMsg) {
+	p.(*sp2p).topicDeliver(msg, t)
+}
+
+// topicGraft 把发送者加入或者移出接收者在这个主题上的mesh
+type topicGraft struct {
+	Topic string `json:"topic"`
+	Prune bool   `json:"prune,omitempty"`
+}
+
+func (t *topicGraft) T() byte        { return topicGraftT }
+func (t *topicGraft) String() string { return topicGraftS }
+
+func (t *topicGraft) MarshalBinary() ([]byte, error) {
+	w := &wbuf{}
+	w.str(t.Topic)
+	w.byte(boolByte(t.Prune))
+	return w.b, w.err
+}
+
+func (t *topicGraft) UnmarshalBinary(b []byte) error {
+	r := &rbuf{b: b}
+	t.Topic = r.str()
+	t.Prune = r.byte() != 0
+	return r.err
+}
+
+func (t *topicGraft) OnHandle(p ISP2P, msg *KMsg) {
+	node, err := nodeFromKMsg(msg)
+	if err != nil {
+		p.GetLogger().Error("NodeFromKMsg error", "err", err)
+		return
+	}
+	s := p.(*sp2p)
+	// 加入mesh以后会向对方转发消息,先验证地址,防止被用来向伪造的地址发送流量;离开不需要验证
+	if !t.Prune && !s.bonded(node.ID, msg.SrcAddr()) {
+		s.spawn(func() {
+			if s.bond(node) {
+				s.topicGraft(node, t)
+			}
+		})
+		return
+	}
+	s.topicGraft(node, t)
+}
@@ -0,0 +1,192 @@
+package sp2p
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Priority 消息处理的优先级,高优先级的队列不为空的时候不处理低优先级的消息
+type Priority int
+
+const (
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityLow
+
+	numPriorities = 3
+)
+
+// priorityOf 消息实现了 Priority() Priority 的使用它的优先级,否则是PriorityNormal
+func priorityOf(m IPacket) Priority {
+	if p, ok := m.(interface{ Priority() Priority }); ok {
+		if pr := p.Priority(); pr >= PriorityHigh && pr <= PriorityLow {
+			return pr
+		}
+	}
+	return PriorityNormal
+}
+
+// DropPolicy 队列满了以后怎么处理新的消息
+type DropPolicy int
+
+const (
+	// DropOldest 丢弃同一优先级队列中最旧的消息
+	DropOldest DropPolicy = iota
+	// DropNew 丢弃新的消息
+	DropNew
+	// Reject 丢弃新的消息并返回ErrQueueFull
+	Reject
+)
+
+var (
+	ErrQueueFull  = errors.New("message queue is full")
+	errPoolClosed = errors.New("worker pool is closed")
+)
+
+// workerPool 固定数量的协程处理按优先级排队的消息,每个优先级的队列长度有上限,
+// 其中reserved个协程只处理高优先级的消息,所有普通协程都被慢的处理函数占住的时候ping和ack也能及时处理
+type workerPool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// 只处理高优先级消息的协程在hcond上等待
+	hcond  *sync.Cond
+	queues [numPriorities][]*KMsg
+	size   int
+	policy DropPolicy
+	closed bool
+	// 关闭的时候是否处理完队列中剩下的消息
+	drain bool
+	fn    func(*KMsg)
+	wg    sync.WaitGroup
+
+	queued   uint64
+	dropped  uint64
+	rejected uint64
+}
+
+func newWorkerPool(workers, reserved, size int, policy DropPolicy, fn func(*KMsg)) *workerPool {
+	p := &workerPool{size: size, policy: policy, fn: fn}
+	p.cond = sync.NewCond(&p.mu)
+	p.hcond = sync.NewCond(&p.mu)
+	for i := 0; i < workers+reserved; i++ {
+		p.wg.Add(1)
+		go p.work(i >= workers)
+	}
+	return p
+}
+
+// push 把消息放到优先级pr的队列,队列满了按照policy处理
+func (p *workerPool) push(msg *KMsg, pr Priority) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errPoolClosed
+	}
+
+	q := p.queues[pr]
+	if len(q) >= p.size {
+		switch p.policy {
+		case DropOldest:
+			q[0] = nil
+			q = q[1:]
+			atomic.AddUint64(&p.dropped, 1)
+		case DropNew:
+			atomic.AddUint64(&p.dropped, 1)
+			return nil
+		default:
+			atomic.AddUint64(&p.rejected, 1)
+			return ErrQueueFull
+		}
+	}
+
+	p.queues[pr] = append(q, msg)
+	atomic.AddUint64(&p.queued, 1)
+	p.cond.Signal()
+	if pr == PriorityHigh {
+		p.hcond.Signal()
+	}
+	return nil
+}
+
+// pop 取出优先级最高的消息,high为true的时候只取高优先级的消息,
+// 队列为空的时候等待,关闭以后返回false
+func (p *workerPool) pop(high bool) (*KMsg, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if p.closed && !p.drain {
+			return nil, false
+		}
+		for i := range p.queues {
+			if high && Priority(i) != PriorityHigh {
+				break
+			}
+			if q := p.queues[i]; len(q) != 0 {
+				msg := q[0]
+				q[0] = nil
+				p.queues[i] = q[1:]
+				return msg, true
+			}
+		}
+		if p.closed {
+			return nil, false
+		}
+		if high {
+			p.hcond.Wait()
+		} else {
+			p.cond.Wait()
+		}
+	}
+}
+
+func (p *workerPool) work(high bool) {
+	defer p.wg.Done()
+	for {
+		msg, ok := p.pop(high)
+		if !ok {
+			return
+		}
+		p.fn(msg)
+	}
+}
+
+// len 队列中等待处理的消息数量
+func (p *workerPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for _, q := range p.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// close 停止接收新的消息,drain为true的时候处理完队列中的消息,然后等待所有协程退出
+func (p *workerPool) close(drain bool) {
+	p.mu.Lock()
+	p.closed = true
+	p.drain = drain
+	if !drain {
+		for i, q := range p.queues {
+			atomic.AddUint64(&p.dropped, uint64(len(q)))
+			p.queues[i] = nil
+		}
+	}
+	p.cond.Broadcast()
+	p.hcond.Broadcast()
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// dump 统计计数,name是统计项的前缀
+func (p *workerPool) dump(name string, m map[string]uint64) {
+	m[name+"_queued"] = atomic.LoadUint64(&p.queued)
+	m[name+"_dropped"] = atomic.LoadUint64(&p.dropped)
+	m[name+"_rejected"] = atomic.LoadUint64(&p.rejected)
+	m[name+"_queue_len"] = uint64(p.len())
+}
@@ -0,0 +1,87 @@
+package sp2p
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 所有普通处理协程都被慢的处理函数占住的时候,ping还能由保留的高优先级协程处理
+func TestSlowHandlerDoesNotStallPing(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1))
+	b := newTestNode(t, sn, testAddr(2), func(c *Config) {
+		c.HandleWorkers = 2
+		c.HighWorkers = 1
+	})
+
+	release := make(chan struct{})
+	defer close(release)
+	var blocked int32
+	if err := Handle(b.GetHManager(), func(ctx context.Context, peer Peer, m *testMsg) error {
+		atomic.AddInt32(&blocked, 1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// 两个消息占住所有普通处理协程,另外两个在队列中等待
+	bn := b.tab.selfNode
+	for i := 0; i < 4; i++ {
+		if err := a.Write(&KMsg{TID: bn.ID.Hex(), TAddr: bn.addrString(), Data: &testMsg{Text: f("slow %d", i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, 5*time.Second, "handlers did not block", func() bool {
+		return atomic.LoadInt32(&blocked) == 2
+	})
+
+	pctx, pcancel := context.WithTimeout(ctx, time.Second)
+	defer pcancel()
+	if _, err := a.PingNode(pctx, b.Self()); err != nil {
+		t.Fatalf("ping stalled behind slow handlers: %v", err)
+	}
+	if n := atomic.LoadInt32(&blocked); n != 2 {
+		t.Fatalf("%d slow handlers running, want 2", n)
+	}
+}
+
+// 处理函数的ctx在HandlerTimeout以后结束
+func TestHandlerTimeout(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1))
+	b := newTestNode(t, sn, testAddr(2), func(c *Config) { c.HandlerTimeout = 50 * time.Millisecond })
+
+	done := make(chan error, 1)
+	if err := Handle(b.GetHManager(), func(ctx context.Context, peer Peer, m *testMsg) error {
+		<-ctx.Done()
+		done <- ctx.Err()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a.tab.addNode(b.tab.selfNode)
+	if err := a.SendTo(ctx, NodeID(b.tab.selfNode.ID), &testMsg{Text: "slow"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("handler ctx ended with %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("handler ctx has no deadline")
+	}
+}
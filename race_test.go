@@ -0,0 +1,6 @@
+//go:build race
+
+package sp2p
+
+// raceEnabled 打开了race检测,运行速度会慢很多倍
+const raceEnabled = true
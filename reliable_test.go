@@ -0,0 +1,108 @@
+package sp2p
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dropFirst 出站中间件,丢弃前n个类型为t的消息,sent记录这个类型的消息发送了多少次
+func dropFirst(t byte, n int32, sent *int32) Middleware {
+	return func(next Handler) Handler {
+		return func(p ISP2P, msg *KMsg) error {
+			if msg.Data.T() != t {
+				return next(p, msg)
+			}
+			if atomic.AddInt32(sent, 1) <= n {
+				return nil
+			}
+			return next(p, msg)
+		}
+	}
+}
+
+// newReliablePair 创建两个节点,b处理的testMsg计数到handled中
+func newReliablePair(t *testing.T, aOut, bOut Middleware) (*sp2p, *sp2p, *int32) {
+	t.Helper()
+
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	fast := func(c *Config) {
+		c.RetransmitTimeout = 50 * time.Millisecond
+		c.MaxRetransmits = 3
+	}
+	a := newTestNode(t, sn, testAddr(1), fast, func(c *Config) { c.Outbound = []Middleware{aOut} })
+	b := newTestNode(t, sn, testAddr(2), fast, func(c *Config) { c.Outbound = []Middleware{bOut} })
+
+	handled := new(int32)
+	if err := Handle(b.GetHManager(), func(ctx context.Context, peer Peer, m *testMsg) error {
+		atomic.AddInt32(handled, 1)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return a, b, handled
+}
+
+// 消息丢了以后重发,对方收到以后确认
+func TestReliableRetransmit(t *testing.T) {
+	var sent, acks int32
+	a, b, handled := newReliablePair(t, dropFirst(0x40, 2, &sent), dropFirst(ackRespT, 0, &acks))
+
+	bn := b.tab.selfNode
+	if r := a.WriteReliable(context.Background(), &KMsg{TID: bn.ID.Hex(), TAddr: bn.addrString(), Data: &testMsg{Text: "hello"}}); r != Delivered {
+		t.Fatalf("result %s, want %s", r, Delivered)
+	}
+	if n := atomic.LoadInt32(&sent); n != 3 {
+		t.Fatalf("sent %d times, want 3", n)
+	}
+	if n := atomic.LoadInt32(handled); n != 1 {
+		t.Fatalf("handled %d times, want 1", n)
+	}
+	if n := atomic.LoadInt32(&acks); n != 1 {
+		t.Fatalf("acked %d times, want 1", n)
+	}
+}
+
+// 确认丢了以后重发的消息不再处理,但是还会确认
+func TestReliableLostAck(t *testing.T) {
+	var sent, acks int32
+	a, b, handled := newReliablePair(t, dropFirst(0x40, 0, &sent), dropFirst(ackRespT, 1, &acks))
+
+	bn := b.tab.selfNode
+	if r := a.WriteReliable(context.Background(), &KMsg{TID: bn.ID.Hex(), TAddr: bn.addrString(), Data: &testMsg{Text: "hello"}}); r != Delivered {
+		t.Fatalf("result %s, want %s", r, Delivered)
+	}
+	if n := atomic.LoadInt32(&sent); n != 2 {
+		t.Fatalf("sent %d times, want 2", n)
+	}
+	if n := atomic.LoadInt32(handled); n != 1 {
+		t.Fatalf("handled %d times, want 1", n)
+	}
+	if n := atomic.LoadInt32(&acks); n != 2 {
+		t.Fatalf("acked %d times, want 2", n)
+	}
+}
+
+// 重发MaxRetransmits次都没有确认返回PeerUnreachable,ctx结束返回TimedOut
+func TestReliableUnreachable(t *testing.T) {
+	var sent, acks int32
+	a, b, handled := newReliablePair(t, dropFirst(0x40, 100, &sent), dropFirst(ackRespT, 0, &acks))
+
+	bn := b.tab.selfNode
+	if r := a.WriteReliable(context.Background(), &KMsg{TID: bn.ID.Hex(), TAddr: bn.addrString(), Data: &testMsg{Text: "hello"}}); r != PeerUnreachable {
+		t.Fatalf("result %s, want %s", r, PeerUnreachable)
+	}
+	if n, want := atomic.LoadInt32(&sent), int32(a.cfg.MaxRetransmits+1); n != want {
+		t.Fatalf("sent %d times, want %d", n, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if r := a.WriteReliable(ctx, &KMsg{TID: bn.ID.Hex(), TAddr: bn.addrString(), Data: &testMsg{Text: "hello"}}); r != TimedOut {
+		t.Fatalf("result %s, want %s", r, TimedOut)
+	}
+	if n := atomic.LoadInt32(handled); n != 0 {
+		t.Fatalf("handled %d times, want 0", n)
+	}
+}
@@ -0,0 +1,120 @@
+package sp2p
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newRouteLine 创建三个节点,a只认识b,b只认识c,并且b比a离c更近,
+// 所以a发给c的路由消息要经过b转发
+func newRouteLine(t *testing.T, sn *SimNetwork) (a, b, c *sp2p) {
+	t.Helper()
+
+	var nodes []*sp2p
+	for i := 1; i <= 3; i++ {
+		s := newTestNode(t, sn, testAddr(i))
+		// 引导查找会让a认识c
+		waitBootstrap(t, s)
+		nodes = append(nodes, s)
+	}
+	c = nodes[2]
+	a, b = nodes[0], nodes[1]
+	if distCmp(c.tab.selfNode.ID, a.tab.selfNode.ID, b.tab.selfNode.ID) < 0 {
+		a, b = b, a
+	}
+
+	a.tab.addNode(b.tab.selfNode)
+	b.tab.addNode(c.tab.selfNode)
+	return a, b, c
+}
+
+func TestRouteMultiHop(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a, b, c := newRouteLine(t, sn)
+
+	var got int32
+	for _, s := range []*sp2p{a, b, c} {
+		s := s
+		if err := Handle(s.GetHManager(), func(ctx context.Context, peer Peer, m *testMsg) error {
+			if s == c {
+				atomic.AddInt32(&got, 1)
+			}
+			return peer.Reply(&testReply{Text: m.Text + " from " + s.tab.selfNode.ID.Hex()})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := Handle(s.GetHManager(), func(ctx context.Context, peer Peer, m *testReply) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cid := c.tab.selfNode.ID
+	resp, err := a.RequestTo(ctx, NodeID(cid), &testMsg{Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := resp.Data.(*testReply); !ok || r.Text != "hello from "+cid.Hex() {
+		t.Fatalf("unexpected reply %#v", resp.Data)
+	}
+	if resp.FID != cid.Hex() || atomic.LoadInt32(&got) != 1 {
+		t.Fatalf("reply from %s, c handled %d requests", resp.FID, got)
+	}
+
+	// a和c之间没有直接通信过,请求和回复都经过b
+	c.sess.mu.Lock()
+	_, direct := c.sess.peers[a.tab.selfNode.ID]
+	c.sess.mu.Unlock()
+	if direct {
+		t.Fatal("a talked to c directly")
+	}
+
+	// 目标不存在的时候离它最近的节点处理请求,它的回复不是目标的回复,请求超时
+	var missing Hash
+	copy(missing[:], cid[:])
+	missing[len(missing)-1] ^= 1
+	ctx2, cancel2 := context.WithTimeout(ctx, time.Second)
+	defer cancel2()
+	if _, err := a.RequestTo(ctx2, NodeID(missing), &testMsg{Text: "nobody"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("request to a missing node returned %v, want deadline exceeded", err)
+	}
+	if atomic.LoadInt32(&got) != 2 {
+		t.Fatalf("c handled %d requests, want 2", got)
+	}
+}
+
+// 回复的上一跳是收到请求的时候记录的发送者,请求路径中填写的地址不会被使用
+func TestRoutePrev(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a, b, c := newRouteLine(t, sn)
+
+	bid, baddr := b.tab.selfNode.ID, b.tab.selfNode.adds()
+	forged := newNode(bid, testAddr(9).IP, uint16(testAddr(9).Port))
+	rm := &routeMsg{
+		ID:         a.nextID(),
+		Origin:     a.tab.selfNode.ID.Hex(),
+		OriginAddr: a.tab.selfNode.addrString(),
+		Target:     a.tab.selfNode.ID.Hex(),
+		Path:       []string{forged.string()},
+		DT:         (&testMsg{}).T(),
+	}
+	rm.Sig = sign(a.cfg.priv, rm.signData())
+	// TTL是0,c只记录上一跳,不会再转发
+	c.routed(&KMsg{FID: bid.Hex(), addr: baddr}, rm)
+
+	reply := &routeMsg{Reply: true, RID: rm.ID, Path: []string{forged.string(), c.tab.selfNode.string()}}
+	n := c.routePrev(reply)
+	if n == nil || n.ID != bid || n.addrString() != baddr.String() {
+		t.Fatalf("previous hop is %v, want %s", n, b.tab.selfNode.string())
+	}
+
+	reply.RID = c.nextID()
+	if n := c.routePrev(reply); n != nil {
+		t.Fatalf("reply to an unknown request went to %s", n.string())
+	}
+}
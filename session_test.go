@@ -0,0 +1,228 @@
+package sp2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	crand "crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+// newSessionPair 模拟一次握手,返回发起者和响应者的会话
+func newSessionPair(t *testing.T) (init, resp *session, initID, respID Hash) {
+	t.Helper()
+
+	ip, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := ip.ECDH(rp.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initID, respID = Hash{1}, Hash{2}
+	ie, re := ip.PublicKey().Bytes(), rp.PublicKey().Bytes()
+	if init, err = newSession(respID, shared, ie, re, initID, respID, true); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = newSession(initID, shared, ie, re, initID, respID, false); err != nil {
+		t.Fatal(err)
+	}
+	return init, resp, initID, respID
+}
+
+func TestSessionHandshake(t *testing.T) {
+	init, resp, initID, respID := newSessionPair(t)
+	if init.id != resp.id {
+		t.Fatal("session ids differ")
+	}
+
+	frame := []byte("hello")
+	got, err := resp.open(init.seal(initID, frame))
+	if err != nil || !bytes.Equal(got, frame) {
+		t.Fatalf("responder open: %q %v", got, err)
+	}
+	got, err = init.open(resp.seal(respID, frame))
+	if err != nil || !bytes.Equal(got, frame) {
+		t.Fatalf("initiator open: %q %v", got, err)
+	}
+
+	// 每个方向的密钥不同,自己发出的数据报不能被反射回来
+	if _, err := init.open(init.seal(initID, frame)); err == nil {
+		t.Fatal("reflected frame opened")
+	}
+}
+
+func TestSessionTamper(t *testing.T) {
+	init, resp, initID, _ := newSessionPair(t)
+
+	// 头部和密文的任何一个字节被修改都不能解密
+	for _, i := range []int{1, 1 + len(initID), sealedHeaderLen - 1, sealedHeaderLen + 2} {
+		b := init.seal(initID, []byte("hello"))
+		b[i] ^= 0x80
+		if _, err := resp.open(b); err == nil {
+			t.Fatalf("frame tampered at %d opened", i)
+		}
+	}
+
+	// 伪造的数据报不会推进窗口,之后的正常数据报仍然可以解密
+	if _, err := resp.open(init.seal(initID, []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionReplay(t *testing.T) {
+	init, resp, initID, _ := newSessionPair(t)
+
+	var frames [][]byte
+	for i := 0; i < replayWindow+2; i++ {
+		frames = append(frames, init.seal(initID, []byte{byte(i)}))
+	}
+
+	if _, err := resp.open(frames[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.open(frames[1]); err != errSessionReplay {
+		t.Fatalf("replay: %v", err)
+	}
+	// 窗口之内乱序到达的数据报可以解密
+	if _, err := resp.open(frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.open(frames[replayWindow+1]); err != nil {
+		t.Fatal(err)
+	}
+	// frames[1]的计数器是2,已经在窗口之外
+	if _, err := resp.open(frames[1]); err != errSessionReplay {
+		t.Fatalf("old frame: %v", err)
+	}
+	if _, err := resp.open(frames[2]); err != nil {
+		t.Fatalf("frame at the edge of the window: %v", err)
+	}
+}
+
+// 两个节点握手以后使用同一个会话ID,加密的ping可以收到回复
+func TestSessionNodes(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1))
+	b := newTestNode(t, sn, testAddr(2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := a.PingNode(ctx, b.Self()); err != nil {
+		t.Fatal(err)
+	}
+
+	aid, bid := a.tab.selfNode.ID, b.tab.selfNode.ID
+	a.sess.mu.Lock()
+	as := a.sess.peers[bid]
+	a.sess.mu.Unlock()
+	if as == nil {
+		t.Fatal("a has no session with b")
+	}
+	b.sess.mu.Lock()
+	bs := b.sess.ids[as.id]
+	b.sess.mu.Unlock()
+	if bs == nil || bs.peer != aid {
+		t.Fatal("b has no session matching a")
+	}
+}
+
+// 没有完成ping/pong的地址要先拿到cookie,cookie和节点ID、地址绑定
+func TestSessionCookie(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	b := newTestNode(t, sn, testAddr(2))
+
+	id := Hash{9}
+	req := &handshakeReq{Time: uint64(time.Now().UnixNano())}
+	priv, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Eph = priv.PublicKey().Bytes()
+	msg := &KMsg{FID: id.Hex(), FAddr: testAddr(9).String(), Data: req}
+
+	resp, err := b.acceptHandshake(msg, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Eph) != 0 || len(resp.Cookie) != cookieLen {
+		t.Fatal("handshake without a cookie was accepted")
+	}
+
+	// 别的地址拿到的cookie不能用
+	other := &KMsg{FID: id.Hex(), FAddr: testAddr(8).String(), Data: req}
+	req.Cookie = resp.Cookie
+	if resp, err := b.acceptHandshake(other, req); err != nil || len(resp.Eph) != 0 {
+		t.Fatalf("cookie accepted from another address: %v", err)
+	}
+	b.sess.mu.Lock()
+	n := len(b.sess.peers)
+	b.sess.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d sessions created without an endpoint proof", n)
+	}
+
+	if resp, err = b.acceptHandshake(msg, req); err != nil || len(resp.Eph) == 0 {
+		t.Fatalf("handshake with a valid cookie: %v", err)
+	}
+	b.sess.mu.Lock()
+	_, ok := b.sess.peers[id]
+	b.sess.mu.Unlock()
+	if !ok {
+		t.Fatal("no session after a valid cookie")
+	}
+}
+
+// 会话满了以后淘汰没有完成ping/pong的节点,都完成了的时候淘汰最久没有使用的
+func TestSessionEvict(t *testing.T) {
+	c := NewConfig()
+	l := log15.New()
+	l.SetHandler(log15.DiscardHandler())
+	c.InitLog(l)
+	c.MaxSessions = 3
+
+	ss := newSessions(c)
+	bonded := map[Hash]bool{{1}: true, {3}: true, {4}: true}
+	ss.bonded = func(id Hash) bool { return bonded[id] }
+
+	add := func(peer Hash) *session {
+		init, _, _, _ := newSessionPair(t)
+		init.peer = peer
+		ss.add(init)
+		return init
+	}
+	has := func(peer Hash) bool {
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		_, ok := ss.peers[peer]
+		return ok
+	}
+
+	s1 := add(Hash{1})
+	add(Hash{2})
+	add(Hash{3})
+	// 2没有完成ping/pong,即使1更久没有使用也先淘汰2
+	add(Hash{4})
+	if has(Hash{2}) || !has(Hash{1}) {
+		t.Fatal("unbonded session was not evicted first")
+	}
+	s1.seal(Hash{}, []byte("x"))
+	add(Hash{5})
+	if has(Hash{3}) || !has(Hash{1}) || !has(Hash{5}) {
+		t.Fatal("least recently used session was not evicted")
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if len(ss.peers) != 3 || len(ss.ids) != 3 {
+		t.Fatalf("%d sessions and %d ids, want 3", len(ss.peers), len(ss.ids))
+	}
+}
@@ -0,0 +1,237 @@
+package sp2p
+
+import (
+	"context"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// simCluster 模拟网络上的一组节点,第一个节点是其他节点的种子
+type simCluster struct {
+	nodes []*sp2p
+}
+
+func newSimCluster(t *testing.T, sn *SimNetwork, n int) *simCluster {
+	t.Helper()
+
+	// 分区以后对面的节点不会回复,缩短超时让查找更快结束
+	timeout := func(c *Config) { c.RequestTimeout = time.Second }
+
+	sc := &simCluster{}
+	seed := newTestNode(t, sn, testAddr(1), timeout)
+	sc.nodes = append(sc.nodes, seed)
+
+	// 节点分批加入,每批引导完成以后再加入下一批
+	const batch = 8
+	for i := 2; i <= n; i += batch {
+		joined := len(sc.nodes)
+		for j := i; j < i+batch && j <= n; j++ {
+			sc.nodes = append(sc.nodes, newTestNode(t, sn, testAddr(j), timeout, func(c *Config) {
+				c.Seeds = []string{seed.tab.selfNode.string()}
+			}))
+		}
+
+		waitFor(t, 30*time.Second, "bootstrap did not finish", func() bool {
+			for _, s := range sc.nodes[joined:] {
+				if st := s.GetBootstrapStatus(); st.Rounds == 0 || st.Running {
+					return false
+				}
+			}
+			return true
+		})
+		// 种子节点只ping一次,超时了就像应用一样重新引导
+		for _, s := range sc.nodes[joined:] {
+			for i := 0; s.GetBootstrapStatus().Err != "" && i < 3; i++ {
+				s.Bootstrap()
+			}
+			if err := s.GetBootstrapStatus().Err; err != "" {
+				t.Fatalf("%s bootstrap error: %s", s.tab.selfNode.ID.Hex(), err)
+			}
+		}
+	}
+	return sc
+}
+
+// closest 在nodes中除了self以外离target最近的k个节点
+func closest(nodes []*sp2p, self *sp2p, target Hash, k int) []Hash {
+	h := &nodesByDistance{target: target, maxElems: k}
+	for _, s := range nodes {
+		if s != self {
+			h.push(s.tab.selfNode)
+		}
+	}
+
+	ids := make([]Hash, len(h.entries))
+	for i, n := range h.entries {
+		ids[i] = n.ID
+	}
+	return ids
+}
+
+// refresh 所有节点刷新一轮路由表,
+// 同时进行的查找不超过parallel个,几百个节点一起查找会占满CPU,请求还没处理就超时了
+func (sc *simCluster) refresh(parallel int) {
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, parallel)
+	)
+	for _, s := range sc.nodes {
+		s := s
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			s.refreshBuckets(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// checkLookups 轮流从每个group中随机选取节点查找随机目标,一共n次,结果中不能有该group以外的节点,
+// 结果中最近的节点必须是group中真实离目标最近的within个节点之一,
+// within为1的时候要求找到真实最近的节点,丢包的时候查询失败的节点会被移出结果,所以放宽到前几个
+func (sc *simCluster) checkLookups(t *testing.T, rnd *mrand.Rand, groups [][]*sp2p, n, parallel, within int) {
+	t.Helper()
+
+	type job struct {
+		s      *sp2p
+		group  []*sp2p
+		target Hash
+	}
+	jobs := make([]job, n)
+	for i := range jobs {
+		jobs[i].group = groups[i%len(groups)]
+		jobs[i].s = jobs[i].group[rnd.Intn(len(jobs[i].group))]
+		rnd.Read(jobs[i].target[:])
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+		sem  = make(chan struct{}, parallel)
+	)
+	for i, j := range jobs {
+		i, j := i, j
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+
+			// 分区以后最近的节点中有一半不在线,每个都要等两次超时,留足够的时间
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			nodes, err := j.s.lookup(ctx, j.target)
+			cancel()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("lookup %d: %v", i, err))
+				return
+			}
+			if len(nodes) == 0 {
+				errs = append(errs, fmt.Sprintf("lookup %d returned no node", i))
+				return
+			}
+			want := closest(j.group, j.s, j.target, within)
+			found := false
+			for _, id := range want {
+				found = found || nodes[0].ID == id
+			}
+			if !found {
+				errs = append(errs, fmt.Sprintf("lookup %d returned %s, want one of the %d closest nodes", i, nodes[0].ID.Hex(), within))
+			}
+			in := make(map[Hash]bool, len(j.group))
+			for _, s := range j.group {
+				in[s.tab.selfNode.ID] = true
+			}
+			for _, n := range nodes {
+				if !in[n.ID] {
+					errs = append(errs, fmt.Sprintf("lookup %d returned %s outside of the group", i, n.ID.Hex()))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) != 0 {
+		t.Fatal(strings.Join(errs, "\n"))
+	}
+}
+
+// checkConverged 每个节点的路由表中都有离它最近的节点
+func (sc *simCluster) checkConverged(t *testing.T) {
+	t.Helper()
+
+	for _, s := range sc.nodes {
+		if want := closest(sc.nodes, s, s.tab.selfNode.ID, 1)[0]; !hasNode(s, want) {
+			t.Fatalf("%s does not know its closest node %s", s.tab.selfNode.ID.Hex(), want.Hex())
+		}
+	}
+}
+
+func TestSimNetwork(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping sim network test in short mode")
+	}
+
+	// race检测下慢十倍左右,几百个节点在请求超时之前处理不完,用少一些的节点检查并发问题
+	size := 256
+	if raceEnabled {
+		size = 64
+	}
+
+	// 引导的时候种子节点只ping一次,所以加入网络的时候不丢包,收敛以后再打开丢包和乱序
+	c := SimConfig{Latency: 2 * time.Millisecond, Jitter: 3 * time.Millisecond, Seed: 1}
+	sn := NewSimNetwork(c)
+	sc := newSimCluster(t, sn, size)
+	sc.refresh(16)
+
+	// 查找返回的节点是异步bond的,网络安静下来以后路由表就收敛了
+	settle(t, sn)
+	sc.checkConverged(t)
+
+	// 不丢包的时候每次查找都能找到最近的节点
+	rnd := mrand.New(mrand.NewSource(1))
+	all := [][]*sp2p{sc.nodes}
+	sc.checkLookups(t, rnd, all, 20, 1, 1)
+
+	c.LossRate = 0.01
+	c.DupRate = 0.01
+	c.ReorderRate = 0.05
+	c.ReorderDelay = 10 * time.Millisecond
+	sn.SetConfig(c)
+	sc.checkLookups(t, rnd, all, 20, 10, 3)
+
+	// 分区以后每个分区内的查找只能返回分区内的节点
+	// 桶满了以后保留先加入的节点,按照加入的顺序交替分区,否则后加入的一边桶里几乎都是对面的节点
+	var (
+		left, right  []*sp2p
+		lAddr, rAddr []*net.UDPAddr
+	)
+	for i, s := range sc.nodes {
+		if i%2 == 0 {
+			left, lAddr = append(left, s), append(lAddr, testAddr(i+1))
+		} else {
+			right, rAddr = append(right, s), append(rAddr, testAddr(i+1))
+		}
+	}
+	sn.Partition(lAddr, rAddr)
+	sc.checkLookups(t, rnd, [][]*sp2p{left, right}, 20, 20, 3)
+
+	// 恢复并且不再丢包以后重新刷新,查找又能准确地覆盖整个网络
+	c.LossRate, c.DupRate, c.ReorderRate = 0, 0, 0
+	sn.SetConfig(c)
+	sn.Heal()
+	sc.refresh(16)
+	settle(t, sn)
+	sc.checkConverged(t)
+	sc.checkLookups(t, rnd, all, 20, 10, 1)
+}
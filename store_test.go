@@ -0,0 +1,184 @@
+package sp2p
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKVLastWriterWins(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	c := newTestNode(t, sn, testAddr(1)).cfg
+	k := kvKey([]byte("key"))
+	now := uint64(time.Now().UnixNano())
+
+	steps := []struct {
+		value []byte
+		ts    uint64
+		err   error
+		want  string
+	}{
+		{[]byte("b"), now, nil, "b"},
+		// 相同的写入重复收到不是错误
+		{[]byte("b"), now, nil, "b"},
+		{[]byte("old"), now - 1, errValueStale, "b"},
+		// 时间相同的时候字节序大的值保留
+		{[]byte("a"), now, errValueStale, "b"},
+		{[]byte("c"), now, nil, "c"},
+		{[]byte("new"), now + 1, nil, "new"},
+		{[]byte("future"), now + uint64(2*c.MaxClockSkew), errValueFuture, "new"},
+	}
+	for i, st := range steps {
+		if err := c.kvSet(k, st.value, st.ts); err != st.err {
+			t.Fatalf("step %d: kvSet returned %v, want %v", i, err, st.err)
+		}
+		v, _, err := c.kvGet(k)
+		if err != nil || string(v) != st.want {
+			t.Fatalf("step %d: kvGet returned %q, %v, want %q", i, v, err, st.want)
+		}
+	}
+}
+
+func TestPutGetQuorum(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Jitter: time.Millisecond, Seed: 1})
+	sc := newSimCluster(t, sn, 8)
+	sc.refresh(16)
+	settle(t, sn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a, b, c := sc.nodes[1], sc.nodes[4], sc.nodes[7]
+	key := []byte("key")
+	if err := a.Put(ctx, key, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	// Put在StoreAckNum个节点确认以后返回,剩下的复制在后台完成
+	settle(t, sn)
+
+	stored := func(want string) int {
+		n := 0
+		for _, s := range sc.nodes {
+			if v, _, err := s.cfg.kvGet(kvKey(key)); err == nil && string(v) == want {
+				n++
+			}
+		}
+		return n
+	}
+	// 8个节点都在离key最近的BucketSize个节点中
+	if n := stored("v1"); n != len(sc.nodes) {
+		t.Fatalf("v1 is stored on %d nodes, want %d", n, len(sc.nodes))
+	}
+
+	if v, err := b.Get(ctx, key); err != nil || !bytes.Equal(v, []byte("v1")) {
+		t.Fatalf("Get returned %q, %v, want v1", v, err)
+	}
+
+	// 后写入的值覆盖之前的值
+	if err := c.Put(ctx, key, []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	settle(t, sn)
+	if n := stored("v2"); n != len(sc.nodes) {
+		t.Fatalf("v2 is stored on %d nodes, want %d", n, len(sc.nodes))
+	}
+	if v, err := b.Get(ctx, key); err != nil || !bytes.Equal(v, []byte("v2")) {
+		t.Fatalf("Get returned %q, %v, want v2", v, err)
+	}
+}
+
+// 空值和过期的值不能保存,过期以后读不到,重新复制的时候被删除
+func TestKVExpire(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	s := newTestNode(t, sn, testAddr(1), func(c *Config) {
+		c.ValueExpiration = 200 * time.Millisecond
+		c.RepublishInterval = 100 * time.Millisecond
+	})
+	c := s.cfg
+	k := kvKey([]byte("key"))
+
+	if err := s.Put(context.Background(), []byte("key"), nil); err != errValueEmpty {
+		t.Fatalf("Put of an empty value returned %v", err)
+	}
+	if err := c.kvSet(k, []byte("old"), uint64(time.Now().Add(-time.Second).UnixNano())); err != errValueExpired {
+		t.Fatalf("kvSet of an expired value returned %v", err)
+	}
+
+	if err := c.kvSet(k, []byte("v"), uint64(time.Now().UnixNano())); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, err := c.kvGet(k); err != nil || string(v) != "v" {
+		t.Fatalf("kvGet returned %q, %v", v, err)
+	}
+	waitFor(t, 5*time.Second, "value did not expire", func() bool {
+		_, _, err := c.kvGet(k)
+		return err == errNotFound
+	})
+	waitFor(t, 5*time.Second, "expired value was not deleted", func() bool {
+		b, err := c.kvHash().Get(k.Bytes())
+		return err == nil && len(b) == 0
+	})
+}
+
+// 只保存离key最近的BucketSize个节点应该保存的值,每个节点写入的字节数有配额
+func TestStoreReject(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1))
+	b := newTestNode(t, sn, testAddr(2), func(c *Config) {
+		c.BucketSize = 4
+		c.MaxValueSize = 8
+		c.StoreByteLimit = RateLimit{Rate: 0.001, Burst: 12}
+	})
+	an := a.tab.selfNode
+	b.tab.bond(an.ID, an.addrString())
+
+	store := func(k Hash, v string) bool {
+		msg := &KMsg{FID: an.ID.Hex(), FAddr: an.addrString(), Data: &storeReq{Key: k.Hex(), Value: []byte(v), Time: uint64(time.Now().UnixNano())}}
+		msg.Data.(IMessage).OnHandle(b, msg)
+		_, _, err := b.cfg.kvGet(k)
+		return err == nil
+	}
+
+	// far的最高位和b相反,路由表中离far比b近的节点有BucketSize个
+	far := b.tab.selfNode.ID
+	far[0] ^= 0x80
+	for i := 1; i <= b.cfg.BucketSize; i++ {
+		id := far
+		id[len(id)-1] ^= byte(i)
+		b.tab.addNode(newNode(id, testAddr(100+i).IP, uint16(testAddr(100+i).Port)))
+	}
+	if store(far, "far") {
+		t.Fatal("stored a key that is not close to self")
+	}
+
+	near := b.tab.selfNode.ID
+	near[len(near)-1] ^= 1
+	if !store(near, "12345678") {
+		t.Fatal("close key was not stored")
+	}
+	near[len(near)-1] ^= 2
+	if store(near, "12345678") {
+		t.Fatal("store quota was not enforced")
+	}
+}
+
+// 保存值的节点定时把值复制给离key最近的节点,写入时间不变
+func TestRepublish(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1), func(c *Config) { c.RepublishInterval = 100 * time.Millisecond })
+	b := newTestNode(t, sn, testAddr(2))
+	waitBootstrap(t, a)
+	waitBootstrap(t, b)
+	a.tab.addNode(b.tab.selfNode)
+
+	k := kvKey([]byte("key"))
+	ts := uint64(time.Now().UnixNano())
+	if err := a.cfg.kvSet(k, []byte("v"), ts); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "value was not republished", func() bool {
+		v, vts, err := b.cfg.kvGet(k)
+		return err == nil && string(v) == "v" && vts == ts
+	})
+}
@@ -1,13 +1,11 @@
 package sp2p
 
 import (
-	"math/rand"
+	"bytes"
 	"net"
 	"sort"
 	"sync"
 	"time"
-
-	"github.com/emirpasic/gods/sets/hashset"
 )
 
 const nBuckets = len(Hash{})*8 + 1
@@ -16,17 +14,41 @@ type table struct {
 	ITable
 
 	mutex sync.Mutex
+	cfg   *Config
 
 	buckets  [nBuckets]*bucket
 	selfNode *node //info of local node
+
+	// 存活检查和启动协程,由sp2p设置
+	ping  func(*node) (time.Duration, error)
+	spawn func(func()) bool
+
+	// 完成了ping/pong的节点和它的真实地址
+	bonds map[Hash]bond
+	// ping过我们并且收到了pong的节点,这些节点会回复我们的请求
+	peerBonds map[Hash]bond
+	// 等待节点ping我们的请求
+	bondWaits map[Hash]chan struct{}
+	bondMu    sync.Mutex
 }
 
-func newTable(id Hash, addr *net.UDPAddr) *table {
+type bond struct {
+	addr   string
+	expire time.Time
+}
+
+func newTable(c *Config, id Hash, addr *net.UDPAddr) *table {
 
-	table := &table{selfNode: newNode(id, addr.IP, uint16(addr.Port))}
+	table := &table{
+		cfg:       c,
+		selfNode:  newNode(id, addr.IP, uint16(addr.Port)),
+		bonds:     make(map[Hash]bond),
+		peerBonds: make(map[Hash]bond),
+		bondWaits: make(map[Hash]chan struct{}),
+	}
 
 	for i := 0; i < nBuckets; i++ {
-		table.buckets[i] = newBuckets()
+		table.buckets[i] = newBuckets(c)
 	}
 
 	return table
@@ -39,9 +61,7 @@ func (t *table) getNode() *node {
 func (t *table) getAllNodes() []*node {
 	nodes := make([]*node, 0)
 	for _, b := range t.buckets {
-		b.peers.Each(func(index int, value interface{}) {
-			nodes = append(nodes, value.(*node))
-		})
+		nodes = append(nodes, b.nodes()...)
 	}
 	return nodes
 }
@@ -54,12 +74,233 @@ func (t *table) getRawNodes() []string {
 	return nodes
 }
 
+func (t *table) bucket(id Hash) *bucket {
+	return t.buckets[logdist(t.selfNode.ID, id)]
+}
+
+// addNode 自己不加到路由表中,否则查找的结果里会有自己
 func (t *table) addNode(node *node) {
-	t.buckets[logdist(t.selfNode.ID, node.ID)].addNodes(node)
+	if node.ID == t.selfNode.ID {
+		return
+	}
+	b := t.bucket(node.ID)
+	t.checkOldest(b, b.addNodes(node))
 }
 
 func (t *table) updateNode(node *node) {
-	t.buckets[logdist(t.selfNode.ID, node.ID)].updateNodes(node)
+	if node.ID == t.selfNode.ID {
+		return
+	}
+	b := t.bucket(node.ID)
+	t.checkOldest(b, b.updateNodes(node))
+}
+
+// checkOldest 桶满了的时候ping最久没有活动的节点,没有回复才会被替换缓存中的节点替换掉
+func (t *table) checkOldest(b *bucket, oldest *node) {
+	if oldest == nil {
+		return
+	}
+	if t.ping == nil || t.spawn == nil {
+		b.checked(oldest.ID, 0, nil)
+		return
+	}
+
+	ok := t.spawn(func() {
+		rtt, err := t.ping(oldest)
+		if err == errClosed {
+			rtt, err = 0, nil
+		} else if err != nil {
+			t.cfg.l.Debug("oldest node is dead", "node", oldest.string(), "err", err)
+		}
+		b.checked(oldest.ID, rtt, err)
+	})
+	if !ok {
+		b.checked(oldest.ID, 0, nil)
+	}
+}
+
+// pingResult 记录pingN的结果
+func (t *table) pingResult(n *node, rtt time.Duration, err error) {
+	if err != nil {
+		t.bucket(n.ID).pingFail(n.ID)
+	} else {
+		t.bucket(n.ID).pingSuccess(n.ID, rtt)
+	}
+}
+
+// restore 从kdb中读取上次保存的路由表,超过NodeExpireAge没有活动的节点会被删除,
+// 读出来的节点没有加到路由表中,由revalidate验证以后再加
+func (t *table) restore() []*node {
+	logger := t.cfg.l
+	h := t.cfg.db.KHash(t.cfg.dbPrefix(bucketPrefix))
+	prefix := []byte(t.cfg.NodesBackupKey)
+
+	nodes := make([]*node, 0)
+	stale := make([][]byte, 0)
+	if err := h.Range(func(key, value []byte) error {
+		if !bytes.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		n, err := nodeFromRecord(value)
+		if err != nil {
+			logger.Error("restore node error", "err", err)
+			stale = append(stale, key)
+			return nil
+		}
+		if n.ID == t.selfNode.ID || time.Since(n.updateAt) > t.cfg.NodeExpireAge {
+			stale = append(stale, key)
+			return nil
+		}
+		nodes = append(nodes, n)
+		return nil
+	}); err != nil {
+		logger.Error("restore table error", "err", err)
+	}
+
+	if len(stale) != 0 {
+		if err := h.MDel(stale...); err != nil {
+			logger.Error("delete stale nodes error", "err", err)
+		}
+	}
+
+	logger.Info("restore table", "nodes", len(nodes), "stale", len(stale))
+	return nodes
+}
+
+// bond 记录节点从addr回复了我们的ping
+func (t *table) bond(id Hash, addr string) {
+	t.bondMu.Lock()
+	defer t.bondMu.Unlock()
+
+	t.bonds[id] = bond{addr: addr, expire: time.Now().Add(t.cfg.BondExpiration)}
+}
+
+// bonded 检查节点最近是否从addr完成过ping/pong
+func (t *table) bonded(id Hash, addr string) bool {
+	a, ok := t.bondAddr(id)
+	return ok && a == addr
+}
+
+// bondAddr 节点最近完成ping/pong的地址
+func (t *table) bondAddr(id Hash) (string, bool) {
+	t.bondMu.Lock()
+	defer t.bondMu.Unlock()
+
+	b, ok := t.bonds[id]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(b.expire) {
+		delete(t.bonds, id)
+		return "", false
+	}
+	return b.addr, true
+}
+
+// peerBond 记录节点从addr ping了我们,我们回复了pong,节点对我们的验证也在BondExpiration内有效
+// 最多记录MaxNodeSize个节点,满了以后不再记录,请求这些节点之前需要重新等待它们的ping
+func (t *table) peerBond(id Hash, addr string) {
+	t.bondMu.Lock()
+	defer t.bondMu.Unlock()
+
+	if c, ok := t.bondWaits[id]; ok {
+		close(c)
+		delete(t.bondWaits, id)
+	}
+	if _, ok := t.peerBonds[id]; !ok && len(t.peerBonds) >= t.cfg.MaxNodeSize {
+		return
+	}
+	t.peerBonds[id] = bond{addr: addr, expire: time.Now().Add(t.cfg.BondExpiration)}
+}
+
+// peerBonded 节点最近是否从addr验证过我们的地址
+func (t *table) peerBonded(id Hash, addr string) bool {
+	t.bondMu.Lock()
+	defer t.bondMu.Unlock()
+
+	b, ok := t.peerBonds[id]
+	if ok && time.Now().After(b.expire) {
+		delete(t.peerBonds, id)
+		return false
+	}
+	return ok && b.addr == addr
+}
+
+// waitPeerBond 返回节点下一次ping我们的时候关闭的chan
+func (t *table) waitPeerBond(id Hash) <-chan struct{} {
+	t.bondMu.Lock()
+	defer t.bondMu.Unlock()
+
+	c, ok := t.bondWaits[id]
+	if !ok {
+		c = make(chan struct{})
+		t.bondWaits[id] = c
+	}
+	return c
+}
+
+// expireBonds 删除过期的bond
+func (t *table) expireBonds() {
+	t.bondMu.Lock()
+	defer t.bondMu.Unlock()
+
+	now := time.Now()
+	for id, b := range t.bonds {
+		if now.After(b.expire) {
+			delete(t.bonds, id)
+		}
+	}
+	for id, b := range t.peerBonds {
+		if now.After(b.expire) {
+			delete(t.peerBonds, id)
+		}
+	}
+	// 请求最多等待BondWait,剩下的都是一直没有ping我们的节点
+	t.bondWaits = make(map[Hash]chan struct{})
+}
+
+// flush 把路由表完整地写到kdb
+func (t *table) flush() {
+	for _, b := range t.buckets {
+		b.flush()
+	}
+}
+
+// revalidate ping恢复的节点,回复了的节点才加到路由表中,没有回复的节点从kdb中删除,
+// 所有的ping都结束以后返回
+func (t *table) revalidate(nodes []*node) {
+	if t.ping == nil || t.spawn == nil {
+		return
+	}
+
+	h := t.cfg.db.KHash(t.cfg.dbPrefix(bucketPrefix))
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		n := n
+		wg.Add(1)
+		ok := t.spawn(func() {
+			defer wg.Done()
+
+			rtt, err := t.ping(n)
+			if err == errClosed {
+				return
+			}
+			if err != nil {
+				t.cfg.l.Debug("restored node is dead", "node", n.string(), "err", err)
+				if err := h.MDel(t.cfg.nodesBackupKey(n.ID.Bytes())); err != nil {
+					t.cfg.l.Error("delete dead node error", "err", err)
+				}
+				return
+			}
+			t.addNode(n)
+			t.bucket(n.ID).pingSuccess(n.ID, rtt)
+		})
+		if !ok {
+			wg.Done()
+		}
+	}
+	wg.Wait()
 }
 
 func (t *table) size() int {
@@ -77,28 +318,14 @@ func (t *table) findRandomNodes(n int) []*node {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	nodes := make([]*node, 0)
-	for _, b := range t.buckets {
-		b.peers.Each(func(_ int, value interface{}) {
-			nodes = append(nodes, value.(*node))
-		})
-	}
-
-	n = cond(n > nBuckets, nBuckets, 5).(int)
-	if len(nodes) < n+5 {
+	nodes := t.getAllNodes()
+	if len(nodes) <= n {
 		return nodes
 	}
 
-	nodeSet := hashset.New()
-	rand.Seed(time.Now().Unix())
-	k := int32(len(nodes))
-	for nodeSet.Size() < n {
-		nodeSet.Add(nodes[rand.Int31n(k)])
-	}
-
-	rnodes := make([]*node, 0)
-	for _, n := range nodeSet.Values() {
-		rnodes = append(rnodes, n.(*node))
+	rnodes := make([]*node, 0, n)
+	for _, i := range randPerm(len(nodes))[:n] {
+		rnodes = append(rnodes, nodes[i])
 	}
 	return rnodes
 }
@@ -106,7 +333,7 @@ func (t *table) findRandomNodes(n int) []*node {
 // findNodeWithTarget find nodes that distance of target is less than measure with target
 func (t *table) findNodeWithTarget(target Hash, measure Hash) []*node {
 	minDis := make([]*node, 0)
-	for _, n := range t.findMinDisNodes(target, cfg.NodeResponseNumber) {
+	for _, n := range t.findMinDisNodes(target, t.cfg.NodeResponseNumber) {
 		if distCmp(target, n.ID, measure) < 0 {
 			minDis = append(minDis, n)
 		}
@@ -120,21 +347,19 @@ func (t *table) findNodeWithTargetBySelf(target Hash) []*node {
 }
 
 func (t *table) deleteNode(target Hash) {
-	t.buckets[logdist(t.selfNode.ID, target)].deleteNodes(target)
+	t.bucket(target).deleteNodes(target)
 }
 
 func (t *table) findMinDisNodes(target Hash, number int) []*node {
 
 	result := &nodesByDistance{
 		target:   target,
-		maxElems: cond(number > nBuckets, nBuckets, 5).(int),
+		maxElems: cond(number > nBuckets, nBuckets, number).(int),
 		entries:  make([]*node, 0),
 	}
 
-	for _, b := range t.buckets {
-		b.peers.Each(func(_ int, value interface{}) {
-			result.push(value.(*node))
-		})
+	for _, n := range t.getAllNodes() {
+		result.push(n)
 	}
 
 	return result.entries
@@ -166,3 +391,13 @@ func (h *nodesByDistance) push(n *node) {
 		h.entries[ix] = n
 	}
 }
+
+// remove deletes the node with the given id from the list.
+func (h *nodesByDistance) remove(id Hash) {
+	for i, n := range h.entries {
+		if n.ID == id {
+			h.entries = append(h.entries[:i], h.entries[i+1:]...)
+			return
+		}
+	}
+}
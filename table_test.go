@@ -0,0 +1,129 @@
+package sp2p
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTableIgnoresSelf(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1))
+
+	self := a.tab.selfNode
+	a.tab.addNode(self)
+	a.tab.updateNode(self)
+
+	// 别的节点返回的列表中有自己的时候也不会去bond自己
+	a.bondNodes([]*node{self})
+	time.Sleep(100 * time.Millisecond)
+
+	if hasNode(a, self.ID) {
+		t.Fatal("self is in the table")
+	}
+}
+
+func TestFindNodeRespUnsolicited(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1))
+	b := newTestNode(t, sn, testAddr(2))
+	c := newTestNode(t, sn, testAddr(3))
+
+	// b没有请求就给a发送findNodeResp,a不能去ping里面的节点
+	aid, cid := a.tab.selfNode.ID, c.tab.selfNode.ID
+	if err := b.write(&KMsg{TID: aid.Hex(), TAddr: a.localAddr.String(), RID: "nonexistent", Data: &findNodeResp{Nodes: []string{c.tab.selfNode.string()}}}); err != nil {
+		t.Fatal(err)
+	}
+	settle(t, sn)
+
+	if c.tab.peerBonded(aid, a.localAddr.String()) || a.bonded(cid, c.localAddr.String()) {
+		t.Fatal("a pinged a node from an unsolicited findNodeResp")
+	}
+
+	// 请求的回复中的节点会被ping,ping通以后加到路由表中
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := b.PingNode(ctx, c.Self()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "b and c did not bond", func() bool { return hasNode(b, cid) })
+
+	// a和b之间没有验证过地址,findNode先等待b反向ping再发送请求
+	nodes, err := a.findNode(ctx, b.tab.selfNode, cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b的路由表中离c最近的就是c自己
+	if len(nodes) == 0 || nodes[0].ID != cid {
+		t.Fatalf("findNode returned %d nodes, want c first", len(nodes))
+	}
+	waitFor(t, 5*time.Second, "c is not in a's table", func() bool { return hasNode(a, cid) })
+}
+
+// 重启以后从kdb恢复路由表: 回复了ping的节点才加到路由表中,没有回复的节点和过期的记录被删除,
+// 旧格式只有URL的记录当成刚刚活动过,交给revalidate验证
+func TestTableRestore(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	fast := func(c *Config) { c.RequestTimeout = 200 * time.Millisecond }
+	a := newTestNode(t, sn, testAddr(1), fast)
+	b := newTestNode(t, sn, testAddr(2))
+	c := newTestNode(t, sn, testAddr(3))
+	d := newTestNode(t, sn, testAddr(4))
+	e := newTestNode(t, sn, testAddr(5))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, s := range []*sp2p{b, c} {
+		if _, err := a.PingNode(ctx, s.Self()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bid, cid := b.tab.selfNode.ID, c.tab.selfNode.ID
+	waitFor(t, 5*time.Second, "nodes did not bond", func() bool {
+		return hasNode(a, bid) && hasNode(a, cid)
+	})
+
+	aid, ns := a.tab.selfNode.ID, a.cfg.Namespace
+	a.Close()
+	c.Close()
+
+	// d只有旧格式的URL,e的记录已经过期
+	h := a.cfg.db.KHash(a.cfg.dbPrefix(bucketPrefix))
+	if err := h.Set(a.cfg.nodesBackupKey(d.tab.selfNode.ID.Bytes()), []byte(d.tab.selfNode.string())); err != nil {
+		t.Fatal(err)
+	}
+	stale := *e.tab.selfNode
+	stale.updateAt = time.Now().Add(-2 * a.cfg.NodeExpireAge)
+	staleKey := a.cfg.nodesBackupKey(stale.ID.Bytes())
+	if err := h.Set(staleKey, stale.record()); err != nil {
+		t.Fatal(err)
+	}
+
+	a = newTestNode(t, sn, testAddr(1), fast, func(c *Config) { c.Namespace = ns })
+	if a.tab.selfNode.ID != aid {
+		t.Fatal("node key was not restored")
+	}
+	// ping之前不会把磁盘上的节点交给别人
+	if hasNode(a, cid) {
+		t.Fatal("dead node was added before revalidation")
+	}
+	waitBootstrap(t, a)
+	if hasNode(a, cid) {
+		t.Fatal("dead node was restored")
+	}
+	if v, err := h.Get(a.cfg.nodesBackupKey(cid.Bytes())); err == nil && len(v) != 0 {
+		t.Fatal("dead node record was not deleted")
+	}
+	if !hasNode(a, bid) {
+		t.Fatal("live node was not restored")
+	}
+	if !hasNode(a, d.tab.selfNode.ID) {
+		t.Fatal("legacy record was not restored")
+	}
+	if hasNode(a, stale.ID) {
+		t.Fatal("expired record was restored")
+	}
+	if v, err := h.Get(staleKey); err == nil && len(v) != 0 {
+		t.Fatal("expired record was not deleted")
+	}
+}
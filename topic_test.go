@@ -0,0 +1,127 @@
+package sp2p
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 订阅者通过汇合点互相认识以后组成mesh,发布的消息沿着mesh送到每个订阅者,每个订阅者只收到一次
+func TestTopicMesh(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	var nodes []*sp2p
+	for i := 1; i <= 5; i++ {
+		s := newTestNode(t, sn, testAddr(i), func(c *Config) { c.TopicMeshSize = 2 })
+		waitBootstrap(t, s)
+		nodes = append(nodes, s)
+	}
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b {
+				a.tab.addNode(b.tab.selfNode)
+			}
+		}
+	}
+
+	subs := make([]<-chan Message, 0)
+	for _, s := range nodes[1:] {
+		c, cancel := s.Subscribe("news")
+		defer cancel()
+		subs = append(subs, c)
+		// 依次加入,后加入的节点能从汇合点拿到前面的订阅者
+		settle(t, sn)
+	}
+	for _, s := range nodes[1:] {
+		s := s
+		waitFor(t, 5*time.Second, "mesh did not form", func() bool { return len(s.topicMesh("news")) != 0 })
+	}
+
+	a := nodes[0]
+	if err := a.Publish("news", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	settle(t, sn)
+
+	for i, c := range subs {
+		select {
+		case m := <-c:
+			if string(m.Payload) != "hello" || m.From != NodeID(a.tab.selfNode.ID) {
+				t.Fatalf("subscriber %d got %q from %s", i, m.Payload, m.From)
+			}
+		default:
+			t.Fatalf("subscriber %d got nothing", i)
+		}
+		select {
+		case m := <-c:
+			t.Fatalf("subscriber %d got %q twice", i, m.Payload)
+		default:
+		}
+	}
+}
+
+// 没有验证过地址的节点不能直接加入mesh,验证以后才加入;离开不需要验证
+func TestTopicGraftBond(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1))
+	b := newTestNode(t, sn, testAddr(2))
+	waitBootstrap(t, a)
+	waitBootstrap(t, b)
+
+	_, cancel := b.Subscribe("news")
+	defer cancel()
+
+	an := a.tab.selfNode
+	graft := &KMsg{FID: an.ID.Hex(), FAddr: an.addrString(), Data: &topicGraft{Topic: "news"}}
+	graft.Data.(IMessage).OnHandle(b, graft)
+	if len(b.topicMesh("news")) != 0 {
+		t.Fatal("unbonded node grafted")
+	}
+	waitFor(t, 5*time.Second, "graft after bond", func() bool { return len(b.topicMesh("news")) == 1 })
+
+	prune := &KMsg{FID: an.ID.Hex(), FAddr: an.addrString(), Data: &topicGraft{Topic: "news", Prune: true}}
+	prune.Data.(IMessage).OnHandle(b, prune)
+	if len(b.topicMesh("news")) != 0 {
+		t.Fatal("prune ignored")
+	}
+}
+
+// 超过去重窗口或者时间在未来的主题消息被丢弃,即使签名是对的,旧消息不能在去重缓存过期以后重放
+func TestTopicStale(t *testing.T) {
+	sn := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+	a := newTestNode(t, sn, testAddr(1))
+	b := newTestNode(t, sn, testAddr(2))
+
+	c, cancel := b.Subscribe("news")
+	defer cancel()
+
+	now := time.Now()
+	for i, ts := range []time.Time{now.Add(-dedupWindow), now.Add(2 * a.cfg.MaxClockSkew), now} {
+		m := &topicMsg{
+			ID:         a.nextID(),
+			Topic:      "news",
+			Origin:     a.tab.selfNode.ID.Hex(),
+			OriginAddr: a.tab.selfNode.addrString(),
+			Time:       uint64(ts.UnixNano()),
+			Payload:    []byte(f("msg %d", i)),
+		}
+		m.Sig = sign(a.cfg.priv, m.signData())
+		b.topicDeliver(&KMsg{FID: a.tab.selfNode.ID.Hex(), Data: m}, m)
+	}
+
+	if n := atomic.LoadUint64(&b.metrics.staleTopicMsg); n != 2 {
+		t.Fatalf("dropped %d stale topic messages, want 2", n)
+	}
+	select {
+	case m := <-c:
+		if string(m.Payload) != "msg 2" {
+			t.Fatalf("got %q", m.Payload)
+		}
+	default:
+		t.Fatal("fresh topic message was not delivered")
+	}
+	select {
+	case m := <-c:
+		t.Fatalf("got stale %q", m.Payload)
+	default:
+	}
+}
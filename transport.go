@@ -0,0 +1,44 @@
+package sp2p
+
+import (
+	"net"
+)
+
+// Transport 收发数据报,默认使用UDP,测试的时候可以换成模拟网络
+type Transport interface {
+	// ReadFrom 读取一个数据报,返回数据长度和发送者地址
+	ReadFrom(b []byte) (int, *net.UDPAddr, error)
+	// WriteTo 发送一个数据报
+	WriteTo(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() *net.UDPAddr
+	Close() error
+}
+
+// ListenUDP 监听UDP地址
+func ListenUDP(addr *net.UDPAddr) (Transport, error) {
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTransport{conn: conn}, nil
+}
+
+type udpTransport struct {
+	conn *net.UDPConn
+}
+
+func (t *udpTransport) ReadFrom(b []byte) (int, *net.UDPAddr, error) {
+	return t.conn.ReadFromUDP(b)
+}
+
+func (t *udpTransport) WriteTo(b []byte, addr *net.UDPAddr) (int, error) {
+	return t.conn.WriteToUDP(b, addr)
+}
+
+func (t *udpTransport) LocalAddr() *net.UDPAddr {
+	return t.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,298 @@
+package sp2p
+
+import (
+	"container/heap"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// SimConfig 模拟网络的参数,延迟都是虚拟时钟上的时间
+type SimConfig struct {
+	// 数据报的基础延迟
+	Latency time.Duration
+	// 在基础延迟上随机增加[0, Jitter)的延迟
+	Jitter time.Duration
+	// 丢包率 [0, 1]
+	LossRate float64
+	// 重复发送的概率 [0, 1]
+	DupRate float64
+	// 乱序的概率 [0, 1],乱序的数据报会额外延迟ReorderDelay,并且可以超过同一条链路上之后发送的数据报
+	ReorderRate  float64
+	ReorderDelay time.Duration
+	// 每个节点接收队列的大小,满了以后丢弃
+	QueueSize int
+	// 随机数种子,相同的种子得到相同的丢包、重复和延迟
+	Seed int64
+}
+
+// SimNetwork 内存中模拟的网络,用来在一个进程中运行大量节点
+//
+// 网络不使用真实的时间: 发送的时候用种子随机数决定丢包、重复和延迟,
+// 数据报按照(虚拟投递时间, 发送序号)放到事件队列中,投递协程按顺序取出事件,
+// 把虚拟时钟推进到事件的时间以后交给接收者,所以延迟只决定投递的先后顺序,不会让测试变慢。
+// 同一条链路上没有乱序的数据报按照发送的顺序投递
+type SimNetwork struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	cfg   SimConfig
+	rand  *mrand.Rand
+	nodes map[string]*simTransport
+	// 分区,不同分区之间的节点不能通信,没有分区的节点属于0号分区
+	groups map[string]int
+
+	// 虚拟时钟,等于最近投递的事件的时间
+	now    time.Duration
+	seq    uint64
+	events simEvents
+	// 每条链路上最后一个数据报的投递时间
+	links map[string]time.Duration
+	// 投递协程是否在运行,没有节点以后退出
+	running bool
+}
+
+// NewSimNetwork 创建一个模拟网络
+func NewSimNetwork(c SimConfig) *SimNetwork {
+	if c.QueueSize <= 0 {
+		c.QueueSize = 1024
+	}
+	n := &SimNetwork{
+		cfg:    c,
+		rand:   mrand.New(mrand.NewSource(c.Seed)),
+		nodes:  make(map[string]*simTransport),
+		groups: make(map[string]int),
+		links:  make(map[string]time.Duration),
+	}
+	n.cond = sync.NewCond(&n.mu)
+	return n
+}
+
+// SetConfig 修改网络参数,对之后发送的数据报生效
+func (n *SimNetwork) SetConfig(c SimConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if c.QueueSize <= 0 {
+		c.QueueSize = n.cfg.QueueSize
+	}
+	n.cfg = c
+}
+
+// Partition 把节点分成多个互相不能通信的分区,已经在路上的数据报也会被丢弃
+func (n *SimNetwork) Partition(groups ...[]*net.UDPAddr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.groups = make(map[string]int)
+	for i, g := range groups {
+		for _, addr := range g {
+			n.groups[addr.String()] = i + 1
+		}
+	}
+}
+
+// Heal 取消所有分区
+func (n *SimNetwork) Heal() {
+	n.Partition()
+}
+
+// Now 虚拟时钟从创建网络开始经过的时间
+func (n *SimNetwork) Now() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.now
+}
+
+// Idle 没有在路上的数据报,并且所有节点都读完了接收队列
+func (n *SimNetwork) Idle() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.events) != 0 {
+		return false
+	}
+	for _, t := range n.nodes {
+		if len(t.inbox) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Listen 在模拟网络中监听一个地址
+func (n *SimNetwork) Listen(addr *net.UDPAddr) (Transport, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.nodes[addr.String()]; ok {
+		return nil, errors.New(f("sim address %s already in use", addr))
+	}
+
+	t := &simTransport{
+		net:    n,
+		addr:   addr,
+		inbox:  make(chan simPacket, n.cfg.QueueSize),
+		closed: make(chan struct{}),
+	}
+	n.nodes[addr.String()] = t
+	if !n.running {
+		n.running = true
+		go n.run()
+	}
+	return t, nil
+}
+
+// send 按照网络参数把数据报放到事件队列
+func (n *SimNetwork) send(from, to *net.UDPAddr, b []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	src, dst := from.String(), to.String()
+	if _, ok := n.nodes[dst]; !ok || n.groups[src] != n.groups[dst] || n.rand.Float64() < n.cfg.LossRate {
+		return
+	}
+
+	copies := 1
+	if n.rand.Float64() < n.cfg.DupRate {
+		copies++
+	}
+
+	link := src + ">" + dst
+	for i := 0; i < copies; i++ {
+		at := n.now + n.cfg.Latency
+		if n.cfg.Jitter > 0 {
+			at += time.Duration(n.rand.Int63n(int64(n.cfg.Jitter)))
+		}
+		if n.rand.Float64() < n.cfg.ReorderRate {
+			at += n.cfg.ReorderDelay
+		} else {
+			if last := n.links[link]; at < last {
+				at = last
+			}
+			n.links[link] = at
+		}
+
+		n.seq++
+		heap.Push(&n.events, &simEvent{at: at, seq: n.seq, from: src, to: dst, p: simPacket{from: from, data: append([]byte(nil), b...)}})
+	}
+	n.cond.Signal()
+}
+
+// run 按照虚拟时间的顺序投递事件,没有节点以后退出
+func (n *SimNetwork) run() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for {
+		for len(n.events) == 0 {
+			if len(n.nodes) == 0 {
+				n.running = false
+				return
+			}
+			n.cond.Wait()
+		}
+
+		ev := heap.Pop(&n.events).(*simEvent)
+		n.now = ev.at
+		t, ok := n.nodes[ev.to]
+		if !ok || n.groups[ev.from] != n.groups[ev.to] {
+			continue
+		}
+
+		n.mu.Unlock()
+		t.push(ev.p)
+		n.mu.Lock()
+	}
+}
+
+func (n *SimNetwork) remove(addr *net.UDPAddr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.nodes, addr.String())
+	n.cond.Signal()
+}
+
+type simPacket struct {
+	from *net.UDPAddr
+	data []byte
+}
+
+type simEvent struct {
+	at       time.Duration
+	seq      uint64
+	from, to string
+	p        simPacket
+}
+
+// simEvents 按照投递时间排序的事件,时间相同的按照发送的顺序
+type simEvents []*simEvent
+
+func (e simEvents) Len() int { return len(e) }
+func (e simEvents) Less(i, j int) bool {
+	if e[i].at != e[j].at {
+		return e[i].at < e[j].at
+	}
+	return e[i].seq < e[j].seq
+}
+func (e simEvents) Swap(i, j int)       { e[i], e[j] = e[j], e[i] }
+func (e *simEvents) Push(x interface{}) { *e = append(*e, x.(*simEvent)) }
+func (e *simEvents) Pop() interface{} {
+	old := *e
+	ev := old[len(old)-1]
+	old[len(old)-1] = nil
+	*e = old[:len(old)-1]
+	return ev
+}
+
+type simTransport struct {
+	net       *SimNetwork
+	addr      *net.UDPAddr
+	inbox     chan simPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *simTransport) push(p simPacket) {
+	select {
+	case <-t.closed:
+	case t.inbox <- p:
+	default:
+		// 接收队列满了,和UDP一样直接丢弃
+	}
+}
+
+func (t *simTransport) ReadFrom(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case p := <-t.inbox:
+		return copy(b, p.data), p.from, nil
+	case <-t.closed:
+		return 0, nil, io.EOF
+	}
+}
+
+func (t *simTransport) WriteTo(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, io.EOF
+	default:
+	}
+
+	t.net.send(t.addr, addr, b)
+	return len(b), nil
+}
+
+func (t *simTransport) LocalAddr() *net.UDPAddr {
+	return t.addr
+}
+
+func (t *simTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		t.net.remove(t.addr)
+	})
+	return nil
+}
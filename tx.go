@@ -1,30 +1,34 @@
 package sp2p
 
 import (
-	"errors"
+	"net"
 )
 
 type KMsg struct {
-	Version string   `json:"version,omitempty"`
-	ID      string   `json:"id"`
-	TID      string   `json:"tid"`
-	TAddr   string   `json:"taddr,omitempty"`
-	FAddr   string   `json:"faddr,omitempty"`
-	FID     string   `json:"fid,omitempty"`
-	Data    IMessage `json:"data,omitempty"`
-}
-
-func (t *KMsg) Decode(msg []byte) error {
-	dt := msg[0]
-	if !hm.contain(dt) {
-		return errors.New(f("kmsg type %s is nonexistent", dt))
-	}
+	Version string `json:"version,omitempty"`
+	ID      string `json:"id"`
+	TID     string `json:"tid"`
+	TAddr   string `json:"taddr,omitempty"`
+	FAddr   string `json:"faddr,omitempty"`
+	FID     string `json:"fid,omitempty"`
+	// 子协议名称,为空是内置协议DiscProtocol
+	Proto string `json:"proto,omitempty"`
+	// 回复的请求消息ID
+	RID string `json:"rid,omitempty"`
+	// 可靠消息,接收方需要回复ackResp,发送方没有收到确认会重发
+	Reliable bool    `json:"reliable,omitempty"`
+	Data     IPacket `json:"data,omitempty"`
 
-	t.Data = hm.getHandler(dt)
-	return json.Unmarshal(msg[1:], t)
+	// 接收时观察到的发送者UDP地址
+	addr *net.UDPAddr
+	// 路由过来的消息,回复的时候沿原路返回
+	route *routeMsg
 }
 
-func (t *KMsg) Dumps() []byte {
-	d, _ := json.Marshal(t)
-	return append([]byte{t.Data.T()}, append(d, '\n')...)
+// SrcAddr 返回发送者的地址,优先使用接收时观察到的地址
+func (t *KMsg) SrcAddr() string {
+	if t.addr != nil {
+		return t.addr.String()
+	}
+	return t.FAddr
 }
@@ -3,7 +3,6 @@ package sp2p
 import (
 	"fmt"
 	"math/rand"
-	"net"
 	"time"
 	"strings"
 )
@@ -85,7 +84,7 @@ func nodeFromKMsg(msg *KMsg) (*node, error) {
 	if err != nil {
 		return nil, err
 	}
-	addr, err := net.ResolveUDPAddr("udp", msg.FAddr)
+	addr, err := parseUDPAddr(msg.SrcAddr())
 	if err != nil {
 		return nil, err
 	}
@@ -100,10 +99,6 @@ func mustNotErr(err error) {
 	panic(err.Error())
 }
 
-func nodesBackupKey(k []byte) []byte {
-	return append([]byte(cfg.NodesBackupKey), k...)
-}
-
 // table of leading zero counts for bytes [0..255]
 var lzcount = [256]int{
 	8, 7, 6, 6, 5, 5, 5, 5,